@@ -5,15 +5,18 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
-	"os"
+	"net/url"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal"
 	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal/auth"
 	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal/eventer"
+	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal/hub"
 	"github.com/clocklear/pirelayserver/ui"
 	"github.com/go-kit/kit/log"
 
@@ -61,6 +64,156 @@ func errorResponseWithCode(w http.ResponseWriter, err error, code int) error {
 	return jsonResponse(w, code, b)
 }
 
+// statusError fails a config update with a specific status code and payload
+type statusError struct {
+	code    int
+	payload interface{}
+}
+
+func (e statusError) Error() string {
+	return http.StatusText(e.code)
+}
+
+// withStatus fails a config update with the given error and status code
+func withStatus(err error, code int) error {
+	return statusError{
+		code:    code,
+		payload: errResponse{Error: err.Error()},
+	}
+}
+
+// validationStatus fails a config update with a 422 listing the problems
+// found by validation
+func validationStatus(err error) error {
+	ve, ok := err.(*internal.ValidationError)
+	if !ok {
+		return withStatus(err, http.StatusUnprocessableEntity)
+	}
+	return statusError{
+		code: http.StatusUnprocessableEntity,
+		payload: validationResponse{
+			Error:  "invalid config",
+			Errors: ve.Errors,
+		},
+	}
+}
+
+// hasScope reports whether the request's token grants the given scope
+func hasScope(r *http.Request, scope string) bool {
+	user, ok := r.Context().Value("user").(*jwt.Token)
+	if !ok || !user.Valid {
+		return false
+	}
+	rawPermissions, ok := user.Claims.(jwt.MapClaims)["permissions"].([]interface{})
+	if !ok {
+		return false
+	}
+	for i := range rawPermissions {
+		if p, ok := rawPermissions[i].(string); ok && p == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// errNotFound fails a config update with an empty 404
+var errNotFound = statusError{code: http.StatusNotFound}
+
+// updateErrorResponse responds to a failed config update
+func updateErrorResponse(w http.ResponseWriter, err error) error {
+	if se, ok := err.(statusError); ok {
+		return jsonResponse(w, se.code, se.payload)
+	}
+	return errorResponse(w, err)
+}
+
+// etag formats a config revision as an ETag
+func etag(rev uint64) string {
+	return fmt.Sprintf(`"%v"`, rev)
+}
+
+// readConfig returns the current config and sets its revision as the ETag.
+// The revision is read first, so a racing update can only make the ETag
+// stale, failing a later If-Match, and never newer than the config returned.
+func readConfig(w http.ResponseWriter, cfger internal.Configurer) (internal.Config, error) {
+	w.Header().Set("ETag", etag(cfger.Revision()))
+	return cfger.Get()
+}
+
+// checkIfMatch fails with 412 Precondition Failed when the request has an
+// If-Match header that doesn't match the current config revision
+func checkIfMatch(r *http.Request, cfger internal.Configurer) error {
+	h := r.Header.Get("If-Match")
+	if h == "" || h == "*" {
+		return nil
+	}
+	cur := etag(cfger.Revision())
+	for _, v := range strings.Split(h, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(v), "W/") == cur {
+			return nil
+		}
+	}
+	return withStatus(fmt.Errorf("config has been changed, current revision is %v", cur), http.StatusPreconditionFailed)
+}
+
+type validationResponse struct {
+	Error  string                `json:"error"`
+	Errors []internal.FieldError `json:"errors"`
+}
+
+// updateConfig runs fn as a config update, guarded by the request's If-Match
+// header.  The updated config is validated and applied before it is stored,
+// the new revision is set as the ETag, and the change is recorded as an event
+// with the given cause.
+func updateConfig(w http.ResponseWriter, r *http.Request, cfger internal.Configurer, ctrl internal.RelayController, el eventer.Eventer, cause string, fn func(*internal.Config) error) error {
+	return updateCheckedConfig(w, r, cfger, ctrl, el, cause, fn, nil)
+}
+
+// updateCheckedConfig is updateConfig with a further check of the updated
+// config, if given, made once the config is known to be valid and before it
+// is applied
+func updateCheckedConfig(w http.ResponseWriter, r *http.Request, cfger internal.Configurer, ctrl internal.RelayController, el eventer.Eventer, cause string, fn func(*internal.Config) error, check func(internal.Config) error) error {
+	status, err := ctrl.Status()
+	if err != nil {
+		return err
+	}
+	var prev uint64
+	err = cfger.Update(requestSubject(r), func(cfg *internal.Config) error {
+		if err := checkIfMatch(r, cfger); err != nil {
+			return err
+		}
+		prev = cfg.Revision
+		if err := fn(cfg); err != nil {
+			return err
+		}
+		if err := cfg.Validate(uint8(len(status.States))); err != nil {
+			return validationStatus(err)
+		}
+		if check != nil {
+			if err := check(*cfg); err != nil {
+				return err
+			}
+		}
+		// Apply config, see if errors arise
+		return ctrl.ApplyConfig(*cfg)
+	})
+	if err != nil {
+		return err
+	}
+	cur := cfger.Revision()
+	w.Header().Set("ETag", etag(cur))
+	if cur != prev {
+		el.Event(eventer.Event{
+			Type:     eventer.TypeConfigChanged,
+			Actor:    requestSubject(r),
+			Cause:    cause,
+			OldState: fmt.Sprint(prev),
+			NewState: fmt.Sprint(cur),
+		})
+	}
+	return nil
+}
+
 func cacheHeaders(paths []string, cacheTime uint32, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		hd := w.Header()
@@ -115,22 +268,49 @@ func withScope(scope string, next func(http.ResponseWriter, *http.Request)) func
 // 	http.Error(w, err, http.StatusForbidden)
 // }
 
-func getHandler(cfger internal.Configurer, ctrl internal.RelayController, el eventer.Eventer, l log.Logger) http.Handler {
+func getHandler(cfger internal.Configurer, ctrl internal.RelayController, el eventer.Eventer, sensors *internal.SensorStore, history *internal.RunHistory, changes *internal.ConfigHistory, h *hub.Hub, policy internal.ConflictPolicy, stream streamSettings, authSettings auth.Settings, l log.Logger) http.Handler {
 	r := mux.NewRouter()
-	r.HandleFunc("/oauth/exchange", getOAuthExchangeHandler(l)).Methods(http.MethodGet)
+	r.HandleFunc("/oauth/exchange", getOAuthExchangeHandler(authSettings, l)).Methods(http.MethodGet)
 
 	// Set up router for api routes
 	apiRouter := r.PathPrefix("/api").Subrouter()
 	apiRouter.HandleFunc("/relays", withScope(internal.ReadRelays, relayStatusHandler(ctrl))).Methods(http.MethodGet)
 	apiRouter.HandleFunc("/relays/{relay}/toggle", withScope(internal.WriteRelayToggle, toggleRelayHandler(ctrl))).Methods(http.MethodPost)
-	apiRouter.HandleFunc("/config/schedules", withScope(internal.ReadConfig, getScheduleHandler(cfger))).Methods(http.MethodGet)
-	apiRouter.HandleFunc("/config/schedules", withScope(internal.WriteConfig, addScheduleHandler(cfger, ctrl))).Methods(http.MethodPost)
-	apiRouter.HandleFunc("/config/schedules/{id}", withScope(internal.WriteConfig, removeScheduleHandler(cfger, ctrl))).Methods(http.MethodDelete)
-	apiRouter.HandleFunc("/config/relay/{relay}/name", withScope(internal.WriteRelayName, setRelayNameHandler(cfger, ctrl))).Methods(http.MethodPost)
-	apiRouter.HandleFunc("/config/keys", withScope(internal.WriteConfig, createAPIKeyHandler(cfger, ctrl))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/relays/{relay}/pulse", withScope(internal.WriteRelayToggle, pulseRelayHandler(ctrl))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/relays/{relay}/sequence", withScope(internal.WriteRelayToggle, runSequenceHandler(ctrl))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/relays/{relay}/sequence", withScope(internal.WriteRelayToggle, cancelSequenceHandler(ctrl))).Methods(http.MethodDelete)
+	apiRouter.HandleFunc("/scenes/{id}/activate", withScope(internal.WriteRelayToggle, activateSceneHandler(cfger, ctrl, el, l))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/config/schedules", withScope(internal.ReadConfig, getScheduleHandler(cfger, ctrl, history))).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/config/schedules", withScope(internal.WriteConfig, addScheduleHandler(cfger, ctrl, el, policy))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/config/schedules/{id}/history", withScope(internal.ReadConfig, getScheduleHistoryHandler(cfger, history))).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/config/schedules/{id}", withScope(internal.WriteConfig, removeScheduleHandler(cfger, ctrl, el))).Methods(http.MethodDelete)
+	apiRouter.HandleFunc("/config/profiles", withScope(internal.ReadConfig, getProfilesHandler(cfger))).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/config/profiles/{name}", withScope(internal.WriteConfig, setProfileHandler(cfger, ctrl, el))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/config/profiles/{name}", withScope(internal.WriteConfig, removeProfileHandler(cfger, ctrl, el))).Methods(http.MethodDelete)
+	apiRouter.HandleFunc("/config/profile", withScope(internal.WriteConfig, setActiveProfileHandler(cfger, ctrl, el))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/config/away", withScope(internal.ReadConfig, getAwayHandler(cfger))).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/config/away", withScope(internal.WriteConfig, setAwayHandler(cfger, ctrl, el))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/config/away", withScope(internal.WriteConfig, removeAwayHandler(cfger, ctrl, el))).Methods(http.MethodDelete)
+	apiRouter.HandleFunc("/config/scenes", withScope(internal.ReadConfig, getScenesHandler(cfger))).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/config/scenes/{id}", withScope(internal.WriteConfig, setSceneHandler(cfger, ctrl, el))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/config/scenes/{id}", withScope(internal.WriteConfig, removeSceneHandler(cfger, ctrl, el))).Methods(http.MethodDelete)
+	apiRouter.HandleFunc("/config/rules", withScope(internal.ReadConfig, getRulesHandler(cfger))).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/config/rules", withScope(internal.WriteConfig, setRuleHandler(cfger, ctrl, el))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/config/rules/{id}", withScope(internal.WriteConfig, removeRuleHandler(cfger, ctrl, el))).Methods(http.MethodDelete)
+	apiRouter.HandleFunc("/config/relay/{relay}/name", withScope(internal.WriteRelayName, setRelayNameHandler(cfger, ctrl, el))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/config/keys", withScope(internal.WriteConfig, createAPIKeyHandler(cfger, ctrl, el))).Methods(http.MethodPost)
 	apiRouter.HandleFunc("/config/keys", withScope(internal.ReadConfig, getAPIKeysHandler(cfger, ctrl))).Methods(http.MethodGet)
-	apiRouter.HandleFunc("/config/keys/{id}", withScope(internal.WriteConfig, removeAPIKeyHandler(cfger, ctrl))).Methods(http.MethodDelete)
+	apiRouter.HandleFunc("/config/export", withScope(internal.ReadConfig, exportConfigHandler(cfger))).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/config/import", withScope(internal.WriteConfig, importConfigHandler(cfger, ctrl, el))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/config/revisions", withScope(internal.ReadConfig, getConfigRevisionsHandler(changes))).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/config/revisions/diff", withScope(internal.ReadConfig, diffConfigRevisionsHandler(cfger, changes))).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/config/revisions/{revision}/rollback", withScope(internal.WriteConfig, rollbackConfigHandler(cfger, ctrl, changes, el))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/config/keys/{id}", withScope(internal.WriteConfig, removeAPIKeyHandler(cfger, ctrl, el))).Methods(http.MethodDelete)
 	apiRouter.HandleFunc("/events", withScope(internal.ReadEvents, getEventsHandler(el))).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/stream", streamHandler(ctrl, h, stream)).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/sensors", withScope(internal.ReadSensors, getSensorsHandler(sensors))).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/sensors/{name}", withScope(internal.WriteSensors, setSensorHandler(sensors))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/simulate", withScope(internal.ReadConfig, simulateHandler(cfger, ctrl))).Methods(http.MethodPost)
 	apiRouter.HandleFunc("/me", withScope(internal.ReadMe, getMeHandler())).Methods(http.MethodGet)
 
 	// Apply JWT middleware to all the API routes
@@ -140,19 +320,19 @@ func getHandler(cfger internal.Configurer, ctrl internal.RelayController, el eve
 			jwtmiddleware.FromParameter("auth_code")),
 		ValidationKeyGetter: func(token *jwt.Token) (interface{}, error) {
 			// Verify 'aud' claim
-			aud := os.Getenv("AUTH0_AUDIENCE")
+			aud := authSettings.Audience
 			checkAud := token.Claims.(jwt.MapClaims).VerifyAudience(aud, false)
 			if !checkAud {
 				return token, errors.New("invalid audience")
 			}
 			// Verify 'iss' claim
-			iss := fmt.Sprintf("https://%v/", os.Getenv("AUTH0_DOMAIN"))
+			iss := fmt.Sprintf("https://%v/", authSettings.Domain)
 			checkIss := token.Claims.(jwt.MapClaims).VerifyIssuer(iss, false)
 			if !checkIss {
 				return token, errors.New("invalid issuer")
 			}
 
-			cert, err := getPemCert(token)
+			cert, err := getPemCert(authSettings.Domain, token)
 			if err != nil {
 				panic(err.Error())
 			}
@@ -188,10 +368,10 @@ func getMeHandler() func(http.ResponseWriter, *http.Request) {
 	}
 }
 
-func getOAuthExchangeHandler(l log.Logger) func(http.ResponseWriter, *http.Request) {
+func getOAuthExchangeHandler(authSettings auth.Settings, l log.Logger) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		authenticator, err := auth.NewAuthenticator()
+		authenticator, err := auth.NewAuthenticator(authSettings)
 		if err != nil {
 			l.Log("err", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -213,7 +393,7 @@ func getOAuthExchangeHandler(l log.Logger) func(http.ResponseWriter, *http.Reque
 		}
 
 		oidcConfig := &oidc.Config{
-			ClientID: os.Getenv("AUTH0_CLIENT_ID"),
+			ClientID: authSettings.ClientID,
 		}
 
 		idToken, err := authenticator.Provider.Verifier(oidcConfig).Verify(context.TODO(), rawIDToken)
@@ -244,64 +424,1008 @@ func getOAuthExchangeHandler(l log.Logger) func(http.ResponseWriter, *http.Reque
 	}
 }
 
-func getEventsHandler(el eventer.Eventer) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		e, err := el.ListAll()
+// getEventsHandler returns the events matching the query, newest first.  If
+// there are more, the cursor of the next page is returned in X-Next-Cursor.
+func getEventsHandler(el eventer.Eventer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := parseEventQuery(r.URL.Query())
+		if err != nil {
+			errorResponseWithCode(w, err, http.StatusBadRequest)
+			return
+		}
+		p, err := el.Query(q)
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+		if p.Next != 0 {
+			w.Header().Set("X-Next-Cursor", strconv.FormatUint(p.Next, 10))
+		}
+		okResponse(w, p.Events)
+	}
+}
+
+// streamSettings tunes the event stream
+type streamSettings struct {
+	// Heartbeat is how often a comment is sent on an idle stream, so that
+	// proxies and clients don't give up on it
+	Heartbeat time.Duration
+	// Lifetime is how long a stream is kept open before the client is left to
+	// reconnect, which it does with Last-Event-ID so that nothing is missed.
+	// The server's write timeout applies to streams too, so it must be
+	// shorter.
+	Lifetime time.Duration
+}
+
+// streamRetry is how long clients wait before reconnecting to the stream
+const streamRetry = time.Second
+
+// streamScopes is the scope needed for each topic of the stream
+var streamScopes = map[hub.Topic]string{
+	hub.TopicRelay:  internal.ReadRelays,
+	hub.TopicEvent:  internal.ReadEvents,
+	hub.TopicConfig: internal.ReadConfig,
+}
+
+// streamHandler pushes relay state changes, events and config revisions as
+// Server-Sent Events.  Each topic needs the scope that reads it elsewhere in
+// the API; the topics parameter narrows them down further.
+func streamHandler(ctrl internal.RelayController, h *hub.Hub, settings streamSettings) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		topics := []hub.Topic{}
+		if v := r.URL.Query().Get("topics"); v != "" {
+			for _, s := range strings.Split(v, ",") {
+				t := hub.Topic(s)
+				scope, ok := streamScopes[t]
+				if !ok {
+					errorResponseWithCode(w, fmt.Errorf("unknown topic %q", s), http.StatusBadRequest)
+					return
+				}
+				if !hasScope(r, scope) {
+					errorResponseWithCode(w, fmt.Errorf("the %v topic requires the %v scope", t, scope), http.StatusForbidden)
+					return
+				}
+				topics = append(topics, t)
+			}
+		} else {
+			for _, t := range hub.Topics {
+				if hasScope(r, streamScopes[t]) {
+					topics = append(topics, t)
+				}
+			}
+		}
+		if len(topics) == 0 {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			errorResponse(w, errors.New("streaming is not supported"))
+			return
+		}
+
+		// EventSource sends the ID of the last message it saw when it
+		// reconnects; the parameter is for clients that can't set headers
+		lastID := r.Header.Get("Last-Event-ID")
+		if lastID == "" {
+			lastID = r.URL.Query().Get("lastEventId")
+		}
+		var sub *hub.Subscription
+		var missed []hub.Message
+		after, resumed := h.ParseID(lastID)
+		complete := false
+		if resumed {
+			sub, missed, complete = h.Resume(topics, after)
+		} else {
+			sub = h.Subscribe(topics)
+		}
+		defer sub.Close()
+
+		hd := w.Header()
+		hd.Set("Content-Type", "text/event-stream")
+		hd.Set("Cache-Control", "no-cache")
+		hd.Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "retry: %v\n\n", streamRetry.Milliseconds())
+
+		send := func(id uint64, event string, data interface{}) error {
+			return writeStreamEvent(w, h.FormatID(id), event, data)
+		}
+		if lastID != "" && !complete {
+			// Messages were missed, so the client has to fetch what it shows
+			// afresh
+			err := send(sub.Last, "resync", struct{}{})
+			if err != nil {
+				return
+			}
+		}
+		if !complete {
+			// Start off with the state of every relay
+			if sub.Wants(hub.TopicRelay) {
+				status, err := ctrl.Status()
+				if err == nil {
+					err = send(sub.Last, "relays", status)
+				}
+				if err != nil {
+					return
+				}
+			}
+		} else {
+			for _, msg := range missed {
+				err := send(msg.ID, string(msg.Topic), msg.Data)
+				if err != nil {
+					return
+				}
+			}
+		}
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(settings.Heartbeat)
+		defer heartbeat.Stop()
+		lifetime := time.NewTimer(settings.Lifetime)
+		defer lifetime.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-lifetime.C:
+				return
+			case <-heartbeat.C:
+				_, err := io.WriteString(w, ": heartbeat\n\n")
+				if err != nil {
+					return
+				}
+			case msg, ok := <-sub.Messages():
+				if !ok {
+					// Dropped for falling behind; the client reconnects and
+					// catches up from the backlog
+					return
+				}
+				err := send(msg.ID, string(msg.Topic), msg.Data)
+				if err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// writeStreamEvent writes a Server-Sent Event with a JSON payload
+func writeStreamEvent(w io.Writer, id, event string, data interface{}) error {
+	dat, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %v\nevent: %v\ndata: %s\n\n", id, event, dat)
+	return err
+}
+
+// parseEventQuery reads the filters of an event query
+func parseEventQuery(v url.Values) (eventer.Query, error) {
+	q := eventer.Query{
+		Actor:  v.Get("actor"),
+		Search: v.Get("search"),
+	}
+	var err error
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &q.Since}, {"until", &q.Until}} {
+		if s := v.Get(p.name); s != "" {
+			*p.t, err = time.Parse(time.RFC3339, s)
+			if err != nil {
+				return q, fmt.Errorf("invalid %v %q, must be RFC 3339", p.name, s)
+			}
+		}
+	}
+	if s := v.Get("relay"); s != "" {
+		relay, err := strconv.ParseUint(s, 10, 8)
+		if err != nil || relay == 0 {
+			return q, fmt.Errorf("invalid relay %q", s)
+		}
+		q.Relay = uint8(relay)
+	}
+	if s := v.Get("type"); s != "" {
+		for _, t := range strings.Split(s, ",") {
+			if !validEventType(eventer.Type(t)) {
+				return q, fmt.Errorf("unknown event type %q", t)
+			}
+			q.Types = append(q.Types, eventer.Type(t))
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		q.Limit, err = strconv.Atoi(s)
+		if err != nil || q.Limit < 1 {
+			return q, fmt.Errorf("invalid limit %q", s)
+		}
+	}
+	if s := v.Get("cursor"); s != "" {
+		q.Before, err = strconv.ParseUint(s, 10, 64)
+		if err != nil || q.Before == 0 {
+			return q, fmt.Errorf("invalid cursor %q", s)
+		}
+	}
+	return q, nil
+}
+
+func validEventType(t eventer.Type) bool {
+	for _, v := range eventer.Types {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+func getSensorsHandler(sensors *internal.SensorStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		okResponse(w, sensors.Readings())
+	}
+}
+
+type setSensorRequest struct {
+	Value float64 `json:"value"`
+}
+
+// setSensorHandler records a reading pushed by an external sensor process
+func setSensorHandler(sensors *internal.SensorStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := vars["name"]
+
+		decoder := json.NewDecoder(r.Body)
+		var req setSensorRequest
+		err := decoder.Decode(&req)
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+
+		sensors.Set(name, internal.Reading{
+			Value: req.Value,
+			Stamp: time.Now(),
+		})
+		okResponse(w, nil)
+	}
+}
+
+type simulateRequest struct {
+	Config  json.RawMessage           `json:"config"`
+	From    time.Time                 `json:"from"`
+	To      time.Time                 `json:"to"`
+	Initial map[uint8]internal.Action `json:"initial"`
+	Sensors map[string]float64        `json:"sensors"`
+}
+
+// simulateHandler dry-runs a config, or the current one if none is given,
+// without touching the relays.  The simulation starts from the current relay
+// states unless initial states are given, and covers the next week unless a
+// range is given.
+func simulateHandler(cfger internal.Configurer, ctrl internal.RelayController) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		decoder := json.NewDecoder(r.Body)
+		var req simulateRequest
+		err := decoder.Decode(&req)
+		if err != nil {
+			errorResponseWithCode(w, err, http.StatusBadRequest)
+			return
+		}
+
+		var cfg internal.Config
+		if len(req.Config) > 0 {
+			// Configs from older releases are migrated like config files
+			cfg, err = internal.ParseConfig(req.Config)
+			if err != nil {
+				errorResponseWithCode(w, err, http.StatusBadRequest)
+				return
+			}
+		} else {
+			cfg, err = cfger.Get()
+			if err != nil {
+				errorResponse(w, err)
+				return
+			}
+		}
+		status, err := ctrl.Status()
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+		err = cfg.Validate(uint8(len(status.States)))
+		if err != nil {
+			updateErrorResponse(w, validationStatus(err))
+			return
+		}
+		if req.Initial == nil {
+			req.Initial = make(map[uint8]internal.Action)
+			for _, v := range status.States {
+				req.Initial[v.Relay] = internal.Off
+				if v.State == 1 {
+					req.Initial[v.Relay] = internal.On
+				}
+			}
+		}
+		if req.From.IsZero() {
+			req.From = time.Now()
+		}
+		if req.To.IsZero() {
+			req.To = req.From.Add(7 * 24 * time.Hour)
+		}
+
+		res, err := internal.Simulate(internal.SimulationRequest{
+			Config:  cfg,
+			From:    req.From,
+			To:      req.To,
+			Relays:  uint8(len(status.States)),
+			Initial: req.Initial,
+			Sensors: req.Sensors,
+		})
+		if err != nil {
+			errorResponseWithCode(w, err, http.StatusBadRequest)
+			return
+		}
+		okResponse(w, res)
+	}
+}
+
+type setRelayNameRequest struct {
+	RelayName string `json:"relayName"`
+}
+
+func setRelayNameHandler(cfger internal.Configurer, ctrl internal.RelayController, el eventer.Eventer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		stridx := vars["relay"]
+		idx, err := strconv.ParseUint(stridx, 10, 8)
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+		if !ctrl.IsValidRelay(uint8(idx)) {
+			errorResponse(w, fmt.Errorf("%v is an invalid relay", idx))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var req setRelayNameRequest
+		err = decoder.Decode(&req)
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+
+		err = updateConfig(w, r, cfger, ctrl, el, fmt.Sprintf("relay %v renamed", idx), func(cfg *internal.Config) error {
+			if cfg.RelayNames == nil {
+				cfg.RelayNames = make(map[uint8]string)
+			}
+			cfg.RelayNames[uint8(idx)] = req.RelayName
+			return nil
+		})
+		if err != nil {
+			updateErrorResponse(w, err)
+			return
+		}
+
+		okResponse(w, nil)
+	}
+}
+
+func removeScheduleHandler(cfger internal.Configurer, ctrl internal.RelayController, el eventer.Eventer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		err := updateConfig(w, r, cfger, ctrl, el, fmt.Sprintf("schedule %v removed", id), func(cfg *internal.Config) error {
+			// Find this schedule in the config
+			idx := -1
+			for k, v := range cfg.Schedules {
+				if v.ID == id {
+					idx = k
+				}
+			}
+
+			// Not found?
+			if idx == -1 {
+				return errNotFound
+			}
+
+			// Splice this item out of the schedules
+			cfg.Schedules = append(cfg.Schedules[:idx], cfg.Schedules[idx+1:]...)
+
+			return nil
+		})
+		if err != nil {
+			updateErrorResponse(w, err)
+			return
+		}
+
+		// Good to go!
+		okResponse(w, nil)
+	}
+}
+
+type scheduleResponse struct {
+	internal.Schedule
+	Next    *time.Time    `json:"next,omitempty"`
+	LastRun *internal.Run `json:"lastRun,omitempty"`
+}
+
+// nextRun returns when a schedule next fires, or nil if it isn't scheduled,
+// e.g. because it belongs to an inactive profile
+func nextRun(ctrl internal.RelayController, id string) *time.Time {
+	if t, ok := ctrl.NextRun(id); ok {
+		return &t
+	}
+	return nil
+}
+
+func getScheduleHandler(cfger internal.Configurer, ctrl internal.RelayController, history *internal.RunHistory) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg, err := readConfig(w, cfger)
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+		ret := []scheduleResponse{}
+		for _, s := range cfg.Schedules {
+			sr := scheduleResponse{
+				Schedule: s,
+				Next:     nextRun(ctrl, s.ID),
+			}
+			if run, ok := history.LastRun(s.ID); ok {
+				sr.LastRun = &run
+			}
+			ret = append(ret, sr)
+		}
+		okResponse(w, ret)
+	}
+}
+
+// getScheduleHistoryHandler returns the recorded runs of a schedule, newest
+// first
+func getScheduleHistoryHandler(cfger internal.Configurer, history *internal.RunHistory) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		cfg, err := cfger.Get()
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+		found := false
+		for _, s := range cfg.AllSchedules() {
+			if s.ID == id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			jsonResponse(w, http.StatusNotFound, nil)
+			return
+		}
+
+		runs := history.Runs(id)
+		// Reverse the slice
+		for i := len(runs)/2 - 1; i >= 0; i-- {
+			opp := len(runs) - 1 - i
+			runs[i], runs[opp] = runs[opp], runs[i]
+		}
+		okResponse(w, runs)
+	}
+}
+
+type addScheduleResponse struct {
+	internal.Schedule
+	Next     *time.Time          `json:"next,omitempty"`
+	Warnings []internal.Conflict `json:"warnings,omitempty"`
+}
+
+type scheduleConflictResponse struct {
+	Error     string              `json:"error"`
+	Conflicts []internal.Conflict `json:"conflicts"`
+}
+
+func addScheduleHandler(cfger internal.Configurer, ctrl internal.RelayController, el eventer.Eventer, policy internal.ConflictPolicy) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		decoder := json.NewDecoder(r.Body)
+		var s internal.Schedule
+		err := decoder.Decode(&s)
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+
+		var warnings []internal.Conflict
+		update := func(cfg *internal.Config) error {
+			if s.ID == "" {
+				// New schedule
+				// Set random ID on this schedule
+				u := uuid.NewV4()
+				s.ID = u.String()
+
+				// Store this in the current config
+				cfg.Schedules = append(cfg.Schedules, s)
+			} else {
+				// Existing schedule
+				idx := -1
+				for k, v := range cfg.Schedules {
+					if v.ID == s.ID {
+						idx = k
+						break
+					}
+				}
+				// Did we find this thing?  If not, 404.
+				if idx == -1 {
+					return errNotFound
+				}
+				// Replace the existing item in the cfg with our new one
+				cfg.Schedules = append(cfg.Schedules[:idx], cfg.Schedules[idx+1:]...)
+				cfg.Schedules = append(cfg.Schedules, s)
+			}
+			return nil
+		}
+		// Conflicts are looked for once the config is validated, so that a
+		// malformed schedule gets its field errors rather than a parse error
+		check := func(cfg internal.Config) error {
+			warnings = []internal.Conflict{}
+			rejected := []internal.Conflict{}
+			if policy.Horizon > 0 {
+				conflicts, err := internal.FindConflicts(cfg.ActiveSchedules(time.Now()), cfg.Scenes, time.Now(), policy.Horizon)
+				if err != nil {
+					return withStatus(err, http.StatusBadRequest)
+				}
+				for _, c := range conflicts {
+					if !c.Involves(s.ID) {
+						continue
+					}
+					if policy.Rejects(c) {
+						rejected = append(rejected, c)
+					} else {
+						warnings = append(warnings, c)
+					}
+				}
+			}
+			if len(rejected) > 0 {
+				return statusError{
+					code: http.StatusConflict,
+					payload: scheduleConflictResponse{
+						Error:     "schedule conflicts with existing schedules of equal priority",
+						Conflicts: rejected,
+					},
+				}
+			}
+			return nil
+		}
+		err = updateCheckedConfig(w, r, cfger, ctrl, el, "schedule saved", update, check)
+		if err != nil {
+			updateErrorResponse(w, err)
+			return
+		}
+
+		// Good to go!
+		jsonResponse(w, http.StatusCreated, addScheduleResponse{
+			Schedule: s,
+			Next:     nextRun(ctrl, s.ID),
+			Warnings: warnings,
+		})
+	}
+}
+
+type profilesResponse struct {
+	Active   string                      `json:"active"`
+	Override string                      `json:"override,omitempty"`
+	Profiles map[string]internal.Profile `json:"profiles"`
+}
+
+func getProfilesHandler(cfger internal.Configurer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg, err := readConfig(w, cfger)
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+		profiles := cfg.Profiles
+		if profiles == nil {
+			profiles = make(map[string]internal.Profile)
+		}
+		okResponse(w, profilesResponse{
+			Active:   cfg.ResolveProfile(time.Now()),
+			Override: cfg.ProfileOverride,
+			Profiles: profiles,
+		})
+	}
+}
+
+func setProfileHandler(cfger internal.Configurer, ctrl internal.RelayController, el eventer.Eventer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := vars["name"]
+
+		decoder := json.NewDecoder(r.Body)
+		var p internal.Profile
+		err := decoder.Decode(&p)
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+
+		// Give new schedules an ID
+		if p.Schedules == nil {
+			p.Schedules = []internal.Schedule{}
+		}
+		for k, v := range p.Schedules {
+			if v.ID == "" {
+				p.Schedules[k].ID = uuid.NewV4().String()
+			}
+		}
+
+		err = updateConfig(w, r, cfger, ctrl, el, fmt.Sprintf("profile %v saved", name), func(cfg *internal.Config) error {
+			if cfg.Profiles == nil {
+				cfg.Profiles = make(map[string]internal.Profile)
+			}
+			cfg.Profiles[name] = p
+
+			return nil
+		})
+		if err != nil {
+			updateErrorResponse(w, err)
+			return
+		}
+
+		okResponse(w, p)
+	}
+}
+
+func removeProfileHandler(cfger internal.Configurer, ctrl internal.RelayController, el eventer.Eventer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := vars["name"]
+
+		err := updateConfig(w, r, cfger, ctrl, el, fmt.Sprintf("profile %v removed", name), func(cfg *internal.Config) error {
+			// Not found?
+			if _, ok := cfg.Profiles[name]; !ok {
+				return errNotFound
+			}
+			delete(cfg.Profiles, name)
+			if cfg.ProfileOverride == name {
+				cfg.ProfileOverride = ""
+			}
+
+			return nil
+		})
+		if err != nil {
+			updateErrorResponse(w, err)
+			return
+		}
+
+		okResponse(w, nil)
+	}
+}
+
+type setActiveProfileRequest struct {
+	Profile string `json:"profile"`
+}
+
+// setActiveProfileHandler switches profiles by hand.  An empty profile name
+// hands control back to the date rules.
+func setActiveProfileHandler(cfger internal.Configurer, ctrl internal.RelayController, el eventer.Eventer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		decoder := json.NewDecoder(r.Body)
+		var req setActiveProfileRequest
+		err := decoder.Decode(&req)
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+
+		err = updateConfig(w, r, cfger, ctrl, el, "active profile set", func(cfg *internal.Config) error {
+			if _, ok := cfg.Profiles[req.Profile]; req.Profile != "" && !ok {
+				return withStatus(fmt.Errorf("profile %v not found", req.Profile), http.StatusNotFound)
+			}
+			cfg.ProfileOverride = req.Profile
+
+			return nil
+		})
+		if err != nil {
+			updateErrorResponse(w, err)
+			return
+		}
+
+		okResponse(w, nil)
+	}
+}
+
+type awayResponse struct {
+	Active bool               `json:"active"`
+	Away   *internal.AwayMode `json:"away"`
+}
+
+func getAwayHandler(cfger internal.Configurer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg, err := readConfig(w, cfger)
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+		okResponse(w, awayResponse{
+			Active: cfg.Away.Active(time.Now()),
+			Away:   cfg.Away,
+		})
+	}
+}
+
+func setAwayHandler(cfger internal.Configurer, ctrl internal.RelayController, el eventer.Eventer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		decoder := json.NewDecoder(r.Body)
+		var a internal.AwayMode
+		err := decoder.Decode(&a)
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+		err = a.Validate(time.Now())
+		if err != nil {
+			errorResponseWithCode(w, err, http.StatusBadRequest)
+			return
+		}
+
+		// Give away schedules an ID
+		if a.Schedules == nil {
+			a.Schedules = []internal.Schedule{}
+		}
+		for k, v := range a.Schedules {
+			if v.ID == "" {
+				a.Schedules[k].ID = uuid.NewV4().String()
+			}
+		}
+
+		err = updateConfig(w, r, cfger, ctrl, el, "away mode set", func(cfg *internal.Config) error {
+			cfg.Away = &a
+
+			return nil
+		})
+		if err != nil {
+			updateErrorResponse(w, err)
+			return
+		}
+
+		jsonResponse(w, http.StatusCreated, awayResponse{
+			Active: a.Active(time.Now()),
+			Away:   &a,
+		})
+	}
+}
+
+// removeAwayHandler cancels away mode, restoring the normal schedules at once
+func removeAwayHandler(cfger internal.Configurer, ctrl internal.RelayController, el eventer.Eventer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := updateConfig(w, r, cfger, ctrl, el, "away mode cancelled", func(cfg *internal.Config) error {
+			// Not found?
+			if cfg.Away == nil {
+				return errNotFound
+			}
+			cfg.Away = nil
+
+			return nil
+		})
+		if err != nil {
+			updateErrorResponse(w, err)
+			return
+		}
+
+		okResponse(w, nil)
+	}
+}
+
+func getScenesHandler(cfger internal.Configurer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg, err := readConfig(w, cfger)
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+		scenes := cfg.Scenes
+		if scenes == nil {
+			scenes = make(map[string]internal.Scene)
+		}
+		okResponse(w, scenes)
+	}
+}
+
+func setSceneHandler(cfger internal.Configurer, ctrl internal.RelayController, el eventer.Eventer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		decoder := json.NewDecoder(r.Body)
+		var sc internal.Scene
+		err := decoder.Decode(&sc)
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+
+		err = updateConfig(w, r, cfger, ctrl, el, fmt.Sprintf("scene %v saved", id), func(cfg *internal.Config) error {
+			if cfg.Scenes == nil {
+				cfg.Scenes = make(map[string]internal.Scene)
+			}
+			cfg.Scenes[id] = sc
+			return nil
+		})
+		if err != nil {
+			updateErrorResponse(w, err)
+			return
+		}
+
+		okResponse(w, sc)
+	}
+}
+
+func removeSceneHandler(cfger internal.Configurer, ctrl internal.RelayController, el eventer.Eventer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		err := updateConfig(w, r, cfger, ctrl, el, fmt.Sprintf("scene %v removed", id), func(cfg *internal.Config) error {
+			// Not found?
+			if _, ok := cfg.Scenes[id]; !ok {
+				return errNotFound
+			}
+
+			// Refuse to orphan schedules that activate this scene
+			for _, v := range cfg.AllSchedules() {
+				if v.Action == internal.SceneAction && v.Scene == id {
+					return withStatus(fmt.Errorf("scene is used by schedule %v", v.ID), http.StatusConflict)
+				}
+			}
+			for _, v := range cfg.Rules {
+				if v.Action.Action == internal.SceneAction && v.Action.Scene == id {
+					return withStatus(fmt.Errorf("scene is used by rule %v", v.ID), http.StatusConflict)
+				}
+			}
+
+			delete(cfg.Scenes, id)
+			return nil
+		})
+		if err != nil {
+			updateErrorResponse(w, err)
+			return
+		}
+
+		okResponse(w, nil)
+	}
+}
+
+// activateSceneHandler applies a scene.  Scenes without delays are applied
+// before responding with the new relay states; scenes with delays run in the
+// background and are answered with a 202 straight away.  A scene can't be
+// activated while another is still being activated.
+func activateSceneHandler(cfger internal.Configurer, ctrl internal.RelayController, el eventer.Eventer, l log.Logger) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		cfg, err := cfger.Get()
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+		sc, ok := cfg.Scenes[id]
+		if !ok {
+			jsonResponse(w, http.StatusNotFound, nil)
+			return
+		}
+
+		cause := manualCause(r, "manual activation")
+		if internal.SceneActive(ctrl) {
+			errorResponseWithCode(w, internal.ErrSceneActive, http.StatusConflict)
+			return
+		}
+		if sc.HasDelays() {
+			go func() {
+				err := internal.ActivateScene(ctrl, el, id, sc, cause)
+				if err != nil {
+					l.Log("err", err, "scene", id)
+				}
+			}()
+			jsonResponse(w, http.StatusAccepted, nil)
+			return
+		}
+
+		err = internal.ActivateScene(ctrl, el, id, sc, cause)
+		if err == internal.ErrSceneActive {
+			errorResponseWithCode(w, err, http.StatusConflict)
+			return
+		}
 		if err != nil {
 			errorResponse(w, err)
 			return
 		}
-		// Clone the slice
-		b := make([]eventer.Event, len(e))
-		copy(b, e)
-		// Reverse the slice
-		for i := len(b)/2 - 1; i >= 0; i-- {
-			opp := len(b) - 1 - i
-			b[i], b[opp] = b[opp], b[i]
+
+		status, err := ctrl.Status()
+		if err != nil {
+			errorResponse(w, err)
+			return
 		}
-		okResponse(w, b)
+		okResponse(w, status)
 	}
 }
 
-type setRelayNameRequest struct {
-	RelayName string `json:"relayName"`
-}
-
-func setRelayNameHandler(cfger internal.Configurer, ctrl internal.RelayController) func(http.ResponseWriter, *http.Request) {
+func getRulesHandler(cfger internal.Configurer) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		stridx := vars["relay"]
-		idx, err := strconv.ParseUint(stridx, 10, 8)
+		cfg, err := readConfig(w, cfger)
 		if err != nil {
 			errorResponse(w, err)
 			return
 		}
-		if !ctrl.IsValidRelay(uint8(idx)) {
-			errorResponse(w, fmt.Errorf("%v is an invalid relay", idx))
-			return
+		rules := cfg.Rules
+		if rules == nil {
+			rules = []internal.Rule{}
 		}
+		okResponse(w, rules)
+	}
+}
 
+// setRuleHandler creates a rule, or replaces an existing one when an id is
+// given
+func setRuleHandler(cfger internal.Configurer, ctrl internal.RelayController, el eventer.Eventer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
 		decoder := json.NewDecoder(r.Body)
-		var req setRelayNameRequest
-		err = decoder.Decode(&req)
+		var rule internal.Rule
+		err := decoder.Decode(&rule)
 		if err != nil {
 			errorResponse(w, err)
 			return
 		}
 
-		cfg, err := cfger.Get()
+		err = updateConfig(w, r, cfger, ctrl, el, "rule saved", func(cfg *internal.Config) error {
+			if rule.ID == "" {
+				rule.ID = uuid.NewV4().String()
+				cfg.Rules = append(cfg.Rules, rule)
+				return nil
+			}
+			for k, v := range cfg.Rules {
+				if v.ID == rule.ID {
+					cfg.Rules[k] = rule
+					return nil
+				}
+			}
+			// Didn't find this thing, 404.
+			return errNotFound
+		})
 		if err != nil {
-			errorResponse(w, err)
+			updateErrorResponse(w, err)
 			return
 		}
 
-		if cfg.RelayNames == nil {
-			cfg.RelayNames = make(map[uint8]string)
-		}
-		cfg.RelayNames[uint8(idx)] = req.RelayName
-		err = cfger.Set(cfg)
+		jsonResponse(w, http.StatusCreated, rule)
+	}
+}
+
+func removeRuleHandler(cfger internal.Configurer, ctrl internal.RelayController, el eventer.Eventer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		err := updateConfig(w, r, cfger, ctrl, el, fmt.Sprintf("rule %v removed", id), func(cfg *internal.Config) error {
+			rules := []internal.Rule{}
+			for _, v := range cfg.Rules {
+				if v.ID != id {
+					rules = append(rules, v)
+				}
+			}
+
+			// Not found?
+			if len(rules) == len(cfg.Rules) {
+				return errNotFound
+			}
+			cfg.Rules = rules
+			return nil
+		})
 		if err != nil {
-			errorResponse(w, err)
+			updateErrorResponse(w, err)
 			return
 		}
 
@@ -309,132 +1433,243 @@ func setRelayNameHandler(cfger internal.Configurer, ctrl internal.RelayControlle
 	}
 }
 
-func removeScheduleHandler(cfger internal.Configurer, ctrl internal.RelayController) func(http.ResponseWriter, *http.Request) {
+func getConfigRevisionsHandler(changes *internal.ConfigHistory) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		id := vars["id"]
+		revs := changes.List()
+		// Reverse the slice
+		for i := len(revs)/2 - 1; i >= 0; i-- {
+			opp := len(revs) - 1 - i
+			revs[i], revs[opp] = revs[opp], revs[i]
+		}
+		okResponse(w, revs)
+	}
+}
 
-		// Find this schedule in the config
-		cfg, err := cfger.Get()
+type configDiffResponse struct {
+	From    uint64   `json:"from"`
+	To      uint64   `json:"to"`
+	Summary []string `json:"summary"`
+	Diff    string   `json:"diff"`
+}
+
+// parseRevision reads a revision from a query parameter, or returns def if
+// it is missing
+func parseRevision(r *http.Request, name string, def uint64) (uint64, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	rev, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %v revision %q", name, v)
+	}
+	return rev, nil
+}
+
+func diffConfigRevisionsHandler(cfger internal.Configurer, changes *internal.ConfigHistory) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cur := cfger.Revision()
+		to, err := parseRevision(r, "to", cur)
 		if err != nil {
-			errorResponse(w, err)
+			errorResponseWithCode(w, err, http.StatusBadRequest)
+			return
+		}
+		from, err := parseRevision(r, "from", to-1)
+		if err != nil {
+			errorResponseWithCode(w, err, http.StatusBadRequest)
 			return
 		}
 
-		idx := -1
-		for k, v := range cfg.Schedules {
-			if v.ID == id {
-				idx = k
+		configs := []internal.Config{}
+		for _, rev := range []uint64{from, to} {
+			cfg, _, ok := changes.Get(rev)
+			if !ok {
+				errorResponseWithCode(w, fmt.Errorf("revision %v not found", rev), http.StatusNotFound)
+				return
 			}
+			configs = append(configs, cfg)
 		}
-
-		// Not found?
-		if idx == -1 {
-			jsonResponse(w, http.StatusNotFound, nil)
+		diff, err := configDiff(fmt.Sprintf("revision %v", from), fmt.Sprintf("revision %v", to), configs[0], configs[1])
+		if err != nil {
+			errorResponse(w, err)
 			return
 		}
+		okResponse(w, configDiffResponse{
+			From:    from,
+			To:      to,
+			Summary: internal.SummarizeChanges(configs[0], configs[1]),
+			Diff:    diff,
+		})
+	}
+}
 
-		// Splice this item out of the schedules
-		cfg.Schedules = append(cfg.Schedules[:idx], cfg.Schedules[idx+1:]...)
-
-		// Apply config, see if errors arise
-		err = ctrl.ApplyConfig(cfg)
+func rollbackConfigHandler(cfger internal.Configurer, ctrl internal.RelayController, changes *internal.ConfigHistory, el eventer.Eventer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		rev, err := strconv.ParseUint(vars["revision"], 10, 64)
 		if err != nil {
-			errorResponse(w, err)
+			errorResponseWithCode(w, fmt.Errorf("invalid revision %q", vars["revision"]), http.StatusBadRequest)
+			return
+		}
+		// API keys revoked since the revision stay revoked, unless they are
+		// asked for too.  Rolling back already needs the scope that guards
+		// the keys.
+		keys := r.URL.Query().Get("keys") == "true"
+		old, _, ok := changes.Get(rev)
+		if !ok {
+			errorResponseWithCode(w, fmt.Errorf("revision %v not found", rev), http.StatusNotFound)
 			return
 		}
 
-		// No errors?  Save the config
-		err = cfger.Set(cfg)
+		err = updateConfig(w, r, cfger, ctrl, el, fmt.Sprintf("rollback to revision %v", rev), func(cfg *internal.Config) error {
+			apiKeys := cfg.APIKeys
+			*cfg = old
+			if !keys {
+				cfg.APIKeys = apiKeys
+			}
+			return nil
+		})
 		if err != nil {
-			errorResponse(w, err)
+			updateErrorResponse(w, err)
 			return
 		}
 
-		// Good to go!
-		okResponse(w, nil)
+		_, change, _ := changes.Get(cfger.Revision())
+		okResponse(w, change)
+	}
+}
+
+// configDiff returns a unified diff of two configs, leaving out API key
+// secrets and the revision numbers
+func configDiff(aName, bName string, a, b internal.Config) (string, error) {
+	a, b = a.Redacted(), b.Redacted()
+	a.Revision, b.Revision = 0, 0
+	ad, err := json.Marshal(a)
+	if err != nil {
+		return "", err
+	}
+	bd, err := json.Marshal(b)
+	if err != nil {
+		return "", err
 	}
+	return internal.JSONDiff(aName, bName, ad, bd)
 }
 
-func getScheduleHandler(cfger internal.Configurer) func(http.ResponseWriter, *http.Request) {
+func exportConfigHandler(cfger internal.Configurer) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		cfg, err := cfger.Get()
+		names := []string{}
+		if v := r.URL.Query().Get("sections"); v != "" {
+			names = strings.Split(v, ",")
+		}
+		sections, err := internal.ParseSections(names)
+		if err != nil {
+			errorResponseWithCode(w, err, http.StatusBadRequest)
+			return
+		}
+		// API keys are as good as passwords, so only those who could create
+		// them may export them
+		secrets := r.URL.Query().Get("secrets") == "true"
+		if secrets && !hasScope(r, internal.WriteConfig) {
+			errorResponseWithCode(w, fmt.Errorf("exporting secrets requires the %v scope", internal.WriteConfig), http.StatusForbidden)
+			return
+		}
+
+		cfg, err := readConfig(w, cfger)
 		if err != nil {
 			errorResponse(w, err)
 			return
 		}
-		okResponse(w, cfg.Schedules)
+		w.Header().Set("Content-Disposition", `attachment; filename="pirelayserver-config.json"`)
+		okResponse(w, cfg.Export(sections, secrets))
 	}
 }
 
-func addScheduleHandler(cfger internal.Configurer, ctrl internal.RelayController) func(http.ResponseWriter, *http.Request) {
+type importRequest struct {
+	Config   json.RawMessage `json:"config"`
+	Sections []string        `json:"sections,omitempty"`
+	DryRun   bool            `json:"dryRun,omitempty"`
+}
+
+type importResponse struct {
+	DryRun   bool     `json:"dryRun"`
+	Revision uint64   `json:"revision"`
+	Summary  []string `json:"summary"`
+	Diff     string   `json:"diff"`
+}
+
+func importConfigHandler(cfger internal.Configurer, ctrl internal.RelayController, el eventer.Eventer) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		// Decode request
+		var req importRequest
 		decoder := json.NewDecoder(r.Body)
-		var s internal.Schedule
-		err := decoder.Decode(&s)
+		err := decoder.Decode(&req)
 		if err != nil {
-			errorResponse(w, err)
+			errorResponseWithCode(w, err, http.StatusBadRequest)
 			return
 		}
-
-		// Load current config
-		cfg, err := cfger.Get()
+		if len(req.Config) == 0 {
+			errorResponseWithCode(w, fmt.Errorf("bad request, missing config"), http.StatusBadRequest)
+			return
+		}
+		sections, err := internal.ParseSections(req.Sections)
 		if err != nil {
-			errorResponse(w, err)
+			errorResponseWithCode(w, err, http.StatusBadRequest)
+			return
+		}
+		// Exports from older releases are migrated like config files
+		in, err := internal.ParseConfig(req.Config)
+		if err != nil {
+			errorResponseWithCode(w, err, http.StatusBadRequest)
 			return
 		}
 
-		if s.ID == "" {
-			// New schedule
-			// Set random ID on this schedule
-			u := uuid.NewV4()
-			s.ID = u.String()
+		var prev, next internal.Config
+		merge := func(cfg *internal.Config) error {
+			merged, err := cfg.Import(in, sections)
+			if err != nil {
+				return withStatus(err, http.StatusBadRequest)
+			}
+			prev, next = *cfg, merged
+			*cfg = merged
+			return nil
+		}
 
-			// Store this in the current config
-			cfg.Schedules = append(cfg.Schedules, s)
-		} else {
-			// Existing schedule
-			found := false
-			idx := -1
-			for k, v := range cfg.Schedules {
-				if v.ID == s.ID {
-					idx = k
-					found = true
-					break
+		resp := importResponse{DryRun: req.DryRun}
+		if req.DryRun {
+			var status internal.Status
+			cfg, err := readConfig(w, cfger)
+			if err == nil {
+				err = merge(&cfg)
+			}
+			if err == nil {
+				status, err = ctrl.Status()
+			}
+			if err == nil {
+				if verr := next.Validate(uint8(len(status.States))); verr != nil {
+					err = validationStatus(verr)
 				}
 			}
-			// Did we find this thing?  If not, 404.
-			if !found {
-				jsonResponse(w, http.StatusNotFound, nil)
+			if err != nil {
+				updateErrorResponse(w, err)
 				return
 			}
-			// Store this in the current config
-			cfg, err = cfger.Get()
+			resp.Revision = prev.Revision
+		} else {
+			err = updateConfig(w, r, cfger, ctrl, el, fmt.Sprintf("import (%v)", sections), merge)
 			if err != nil {
-				errorResponse(w, err)
+				updateErrorResponse(w, err)
 				return
 			}
-			// Replace the existing item in the cfg with our new one
-			cfg.Schedules = append(cfg.Schedules[:idx], cfg.Schedules[idx+1:]...)
-			cfg.Schedules = append(cfg.Schedules, s)
-		}
-
-		// Apply config, see if errors arise
-		err = ctrl.ApplyConfig(cfg)
-		if err != nil {
-			errorResponse(w, err)
-			return
+			resp.Revision = cfger.Revision()
 		}
 
-		// No errors?  Save the config
-		err = cfger.Set(cfg)
+		resp.Summary = internal.SummarizeChanges(prev, next)
+		resp.Diff, err = configDiff("current", "imported", prev, next)
 		if err != nil {
 			errorResponse(w, err)
 			return
 		}
-
-		// Good to go!
-		jsonResponse(w, http.StatusCreated, s)
+		okResponse(w, resp)
 	}
 }
 
@@ -458,7 +1693,7 @@ func toggleRelayHandler(ctrl internal.RelayController) func(http.ResponseWriter,
 			errorResponse(w, err)
 			return
 		}
-		err = ctrl.Toggle(uint8(idx))
+		err = ctrl.Toggle(uint8(idx), manualCause(r, "manual toggle"))
 		if err != nil {
 			errorResponse(w, err)
 			return
@@ -474,6 +1709,97 @@ func toggleRelayHandler(ctrl internal.RelayController) func(http.ResponseWriter,
 	}
 }
 
+type pulseRelayRequest struct {
+	Duration internal.Duration `json:"duration"`
+}
+
+type runSequenceRequest struct {
+	Steps []internal.SequenceStep `json:"steps"`
+}
+
+func pulseRelayHandler(ctrl internal.RelayController) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		stridx := vars["relay"]
+		idx, err := strconv.ParseUint(stridx, 10, 8)
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+		if !ctrl.IsValidRelay(uint8(idx)) {
+			errorResponseWithCode(w, fmt.Errorf("%v is an invalid relay", idx), http.StatusBadRequest)
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var req pulseRelayRequest
+		err = decoder.Decode(&req)
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+		if req.Duration <= 0 {
+			errorResponseWithCode(w, fmt.Errorf("bad request, pulse duration must be positive"), http.StatusBadRequest)
+			return
+		}
+
+		err = ctrl.RunSequence(uint8(idx), internal.PulseSteps(req.Duration), manualCause(r, "manual pulse"))
+		if err != nil {
+			errorResponseWithCode(w, err, http.StatusBadRequest)
+			return
+		}
+		jsonResponse(w, http.StatusAccepted, nil)
+	}
+}
+
+func runSequenceHandler(ctrl internal.RelayController) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		stridx := vars["relay"]
+		idx, err := strconv.ParseUint(stridx, 10, 8)
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+		if !ctrl.IsValidRelay(uint8(idx)) {
+			errorResponseWithCode(w, fmt.Errorf("%v is an invalid relay", idx), http.StatusBadRequest)
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var req runSequenceRequest
+		err = decoder.Decode(&req)
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+
+		err = ctrl.RunSequence(uint8(idx), req.Steps, manualCause(r, "manual sequence"))
+		if err != nil {
+			errorResponseWithCode(w, err, http.StatusBadRequest)
+			return
+		}
+		jsonResponse(w, http.StatusAccepted, nil)
+	}
+}
+
+func cancelSequenceHandler(ctrl internal.RelayController) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		stridx := vars["relay"]
+		idx, err := strconv.ParseUint(stridx, 10, 8)
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+		if !ctrl.CancelSequence(uint8(idx)) {
+			jsonResponse(w, http.StatusNotFound, nil)
+			return
+		}
+		okResponse(w, nil)
+	}
+}
+
 type createAPIKeyRequest struct {
 	Desc string `json:"desc"`
 }
@@ -482,6 +1808,22 @@ type createAPIKeyResponse struct {
 	Key string `json:"key"`
 }
 
+// manualCause describes an action requested by the authenticated subject
+func manualCause(r *http.Request, action string) internal.Cause {
+	return internal.Cause{Reason: action, Actor: requestSubject(r)}
+}
+
+// requestSubject returns the JWT subject of the user making the request, if
+// there is one
+func requestSubject(r *http.Request) string {
+	user, _ := r.Context().Value("user").(*jwt.Token)
+	subject, err := getSubjectFromToken(user)
+	if err != nil {
+		return ""
+	}
+	return subject
+}
+
 func getSubjectFromToken(tok *jwt.Token) (string, error) {
 	if tok == nil {
 		return "", fmt.Errorf("missing jwt token")
@@ -501,7 +1843,7 @@ func getSubjectFromToken(tok *jwt.Token) (string, error) {
 	return subject, nil
 }
 
-func createAPIKeyHandler(cfger internal.Configurer, ctrl internal.RelayController) func(http.ResponseWriter, *http.Request) {
+func createAPIKeyHandler(cfger internal.Configurer, ctrl internal.RelayController, el eventer.Eventer) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Read the user, determine subject
 		user := r.Context().Value("user").(*jwt.Token)
@@ -528,23 +1870,6 @@ func createAPIKeyHandler(cfger internal.Configurer, ctrl internal.RelayControlle
 			return
 		}
 
-		// Grab the current config
-		config, err := cfger.Get()
-		if err != nil {
-			errorResponse(w, err)
-			return
-		}
-
-		// Create map if it doesn't exist
-		if config.APIKeys == nil {
-			config.APIKeys = make(map[string]internal.APIKeyCollection)
-		}
-
-		// Create user entry if it doesn't exist
-		if _, ok := config.APIKeys[subject]; !ok {
-			config.APIKeys[subject] = internal.APIKeyCollection{}
-		}
-
 		// Create API key
 		apiKey := internal.APIKey{
 			Desc: req.Desc,
@@ -552,14 +1877,34 @@ func createAPIKeyHandler(cfger internal.Configurer, ctrl internal.RelayControlle
 		}
 		apiKeyId := uuid.NewV4().String()
 
-		// Add to config, persist
-		config.APIKeys[subject][apiKeyId] = apiKey
-		err = cfger.Set(config)
+		err = updateConfig(w, r, cfger, ctrl, el, "API key created", func(config *internal.Config) error {
+			// Create map if it doesn't exist
+			if config.APIKeys == nil {
+				config.APIKeys = make(map[string]internal.APIKeyCollection)
+			}
+
+			// Create user entry if it doesn't exist
+			if _, ok := config.APIKeys[subject]; !ok {
+				config.APIKeys[subject] = internal.APIKeyCollection{}
+			}
+
+			// Add to config
+			config.APIKeys[subject][apiKeyId] = apiKey
+			return nil
+		})
 		if err != nil {
-			errorResponse(w, err)
+			updateErrorResponse(w, err)
 			return
 		}
 
+		el.Event(eventer.Event{
+			Type:     eventer.TypeAuth,
+			Name:     req.Desc,
+			Actor:    subject,
+			NewState: "api key created",
+			Msg:      fmt.Sprintf("API key '%v' created by %v", req.Desc, subject),
+		})
+
 		// Good to go
 		resp := createAPIKeyResponse{
 			Key: apiKey.Key,
@@ -588,7 +1933,7 @@ func getAPIKeysHandler(cfger internal.Configurer, ctrl internal.RelayController)
 		}
 
 		// Grab the current config
-		config, err := cfger.Get()
+		config, err := readConfig(w, cfger)
 		if err != nil {
 			errorResponse(w, err)
 			return
@@ -622,7 +1967,7 @@ func getAPIKeysHandler(cfger internal.Configurer, ctrl internal.RelayController)
 	}
 }
 
-func removeAPIKeyHandler(cfger internal.Configurer, ctrl internal.RelayController) func(http.ResponseWriter, *http.Request) {
+func removeAPIKeyHandler(cfger internal.Configurer, ctrl internal.RelayController, el eventer.Eventer) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Read the user, determine subject
 		user := r.Context().Value("user").(*jwt.Token)
@@ -644,39 +1989,30 @@ func removeAPIKeyHandler(cfger internal.Configurer, ctrl internal.RelayControlle
 			return
 		}
 
-		// Grab the current config
-		config, err := cfger.Get()
-		if err != nil {
-			errorResponse(w, err)
-			return
-		}
-
-		// Create map if it doesn't exist
-		if config.APIKeys == nil {
-			config.APIKeys = make(map[string]internal.APIKeyCollection)
-		}
-
-		// Create user entry if it doesn't exist
-		userKeys, ok := config.APIKeys[subject]
-		if !ok {
-			userKeys = internal.APIKeyCollection{}
-		}
-
-		// Does the requested key exist?
-		_, exists := userKeys[id]
-		if !exists {
-			errorResponseWithCode(w, fmt.Errorf("api key not found"), http.StatusNotFound)
-			return
-		}
+		var desc string
+		err = updateConfig(w, r, cfger, ctrl, el, "API key revoked", func(config *internal.Config) error {
+			// Does the requested key exist?
+			k, exists := config.APIKeys[subject][id]
+			if !exists {
+				return withStatus(fmt.Errorf("api key not found"), http.StatusNotFound)
+			}
 
-		// Key exists, remove, persist collection
-		delete(userKeys, id)
-		config.APIKeys[subject] = userKeys
-		err = cfger.Set(config)
+			// Key exists, remove
+			desc = k.Desc
+			delete(config.APIKeys[subject], id)
+			return nil
+		})
 		if err != nil {
-			errorResponse(w, err)
+			updateErrorResponse(w, err)
 			return
 		}
+		el.Event(eventer.Event{
+			Type:     eventer.TypeAuth,
+			Name:     desc,
+			Actor:    subject,
+			NewState: "api key revoked",
+			Msg:      fmt.Sprintf("API key '%v' revoked by %v", desc, subject),
+		})
 
 		// Good to go!
 		okResponse(w, nil)
@@ -696,9 +2032,9 @@ type JSONWebKeys struct {
 	X5c []string `json:"x5c"`
 }
 
-func getPemCert(token *jwt.Token) (string, error) {
+func getPemCert(domain string, token *jwt.Token) (string, error) {
 	cert := ""
-	resp, err := http.Get(fmt.Sprintf("https://%v/.well-known/jwks.json", os.Getenv("AUTH0_DOMAIN")))
+	resp, err := http.Get(fmt.Sprintf("https://%v/.well-known/jwks.json", domain))
 
 	if err != nil {
 		return cert, err
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+
+	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal"
+	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal/eventer"
+)
+
+// testService is what the handlers run against in tests
+type testService struct {
+	cfger   internal.Configurer
+	ctrl    internal.RelayController
+	changes *internal.ConfigHistory
+	el      eventer.Eventer
+}
+
+// newTestService returns a stub controller with three relays, running cfg
+// from a config file in a new temporary directory
+func newTestService(t *testing.T, cfg internal.Config) testService {
+	dir, err := ioutil.TempDir("", "handler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	el, err := eventer.WithJSONLEventer(filepath.Join(dir, "events.jsonl"), eventer.Retention{}, eventer.SyncNever, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { el.Close() })
+
+	changes, err := internal.WithConfigHistory("", 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfger, err := internal.WithJsonConfigurer(filepath.Join(dir, "config.json"), el, 3, changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfger.Set(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctrl, err := internal.NewStubRelayController(log.NewNopLogger(), 3, cfger, el, internal.NewSensorStore(0), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testService{cfger: cfger, ctrl: ctrl, changes: changes, el: el}
+}
+
+func TestSequenceHandlers(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  func(internal.RelayController) func(http.ResponseWriter, *http.Request)
+		relay    string
+		body     string
+		wantCode int
+	}{
+		{
+			name:     "pulse",
+			handler:  pulseRelayHandler,
+			relay:    "1",
+			body:     `{"duration": "1ms"}`,
+			wantCode: http.StatusAccepted,
+		},
+		{
+			name:     "pulse relay 0",
+			handler:  pulseRelayHandler,
+			relay:    "0",
+			body:     `{"duration": "1ms"}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "pulse relay out of range",
+			handler:  pulseRelayHandler,
+			relay:    "4",
+			body:     `{"duration": "1ms"}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "pulse without a duration",
+			handler:  pulseRelayHandler,
+			relay:    "1",
+			body:     `{}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "sequence",
+			handler:  runSequenceHandler,
+			relay:    "3",
+			body:     `{"steps": [{"action": "on"}, {"action": "off", "delay": "1ms"}]}`,
+			wantCode: http.StatusAccepted,
+		},
+		{
+			name:     "sequence on relay 0",
+			handler:  runSequenceHandler,
+			relay:    "0",
+			body:     `{"steps": [{"action": "on"}]}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "sequence without steps",
+			handler:  runSequenceHandler,
+			relay:    "1",
+			body:     `{"steps": []}`,
+			wantCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newTestService(t, internal.Config{})
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			r = mux.SetURLVars(r, map[string]string{"relay": tt.relay})
+			w := httptest.NewRecorder()
+			tt.handler(svc.ctrl)(w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("got %v %s, want %v", w.Code, w.Body, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestAddScheduleHandler(t *testing.T) {
+	existing := internal.Schedule{ID: "a", Relay: 1, Expression: "0 8 * * *", Action: internal.On}
+	tests := []struct {
+		name     string
+		body     string
+		reject   bool
+		wantCode int
+		// wantSchedules is how many schedules are stored afterwards
+		wantSchedules int
+	}{
+		{
+			name:          "added",
+			body:          `{"relay": 2, "expression": "0 8 * * *", "action": "on"}`,
+			wantCode:      http.StatusCreated,
+			wantSchedules: 2,
+		},
+		{
+			name:          "invalid",
+			body:          `{"relay": 4, "expression": "bad", "action": "on"}`,
+			wantCode:      http.StatusUnprocessableEntity,
+			wantSchedules: 1,
+		},
+		{
+			name:          "conflict warned about",
+			body:          `{"relay": 1, "expression": "0 8 * * *", "action": "off"}`,
+			wantCode:      http.StatusCreated,
+			wantSchedules: 2,
+		},
+		{
+			name:          "conflict rejected",
+			body:          `{"relay": 1, "expression": "0 8 * * *", "action": "off"}`,
+			reject:        true,
+			wantCode:      http.StatusConflict,
+			wantSchedules: 1,
+		},
+		{
+			name:          "missing",
+			body:          `{"id": "nope", "relay": 1, "expression": "0 8 * * *", "action": "off"}`,
+			wantCode:      http.StatusNotFound,
+			wantSchedules: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newTestService(t, internal.Config{Schedules: []internal.Schedule{existing}})
+			policy := internal.ConflictPolicy{Horizon: 48 * time.Hour, Reject: tt.reject}
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			addScheduleHandler(svc.cfger, svc.ctrl, svc.el, policy)(w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("got %v %s, want %v", w.Code, w.Body, tt.wantCode)
+			}
+			cfg, err := svc.cfger.Get()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(cfg.Schedules) != tt.wantSchedules {
+				t.Errorf("got %v schedules, want %v", len(cfg.Schedules), tt.wantSchedules)
+			}
+		})
+	}
+}
+
+func TestRollbackConfigHandler(t *testing.T) {
+	keys := map[string]internal.APIKeyCollection{"alice": {"k1": {Key: "secret"}}}
+	tests := []struct {
+		name     string
+		query    string
+		wantKeys bool
+	}{
+		{
+			name: "keys kept",
+		},
+		{
+			name:     "keys rolled back",
+			query:    "?keys=true",
+			wantKeys: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newTestService(t, internal.Config{RelayNames: map[uint8]string{1: "Pump"}, APIKeys: keys})
+			rev := svc.cfger.Revision()
+			err := svc.cfger.Update("test", func(cfg *internal.Config) error {
+				cfg.RelayNames = map[uint8]string{1: "Lights"}
+				cfg.APIKeys = map[string]internal.APIKeyCollection{}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/"+tt.query, nil)
+			r = mux.SetURLVars(r, map[string]string{"revision": fmt.Sprint(rev)})
+			w := httptest.NewRecorder()
+			rollbackConfigHandler(svc.cfger, svc.ctrl, svc.changes, svc.el)(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got %v %s, want %v", w.Code, w.Body, http.StatusOK)
+			}
+			cfg, err := svc.cfger.Get()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, gotKeys := cfg.APIKeys["alice"]
+			if cfg.RelayNames[1] != "Pump" || gotKeys != tt.wantKeys {
+				t.Errorf("got relay 1 named %q and keys %v, want Pump and keys %v", cfg.RelayNames[1], gotKeys, tt.wantKeys)
+			}
+		})
+	}
+}
+
+func TestConfigChangedEvents(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(svc testService) func(http.ResponseWriter, *http.Request)
+		vars    map[string]string
+		body    string
+		// want lists the causes of the config_changed events recorded
+		want []string
+	}{
+		{
+			name: "relay renamed",
+			handler: func(svc testService) func(http.ResponseWriter, *http.Request) {
+				return setRelayNameHandler(svc.cfger, svc.ctrl, svc.el)
+			},
+			vars: map[string]string{"relay": "1"},
+			body: `{"relayName": "Pump"}`,
+			want: []string{"relay 1 renamed"},
+		},
+		{
+			name: "schedule saved",
+			handler: func(svc testService) func(http.ResponseWriter, *http.Request) {
+				return addScheduleHandler(svc.cfger, svc.ctrl, svc.el, internal.ConflictPolicy{})
+			},
+			body: `{"relay": 2, "expression": "0 8 * * *", "action": "on"}`,
+			want: []string{"schedule saved"},
+		},
+		{
+			name: "nothing removed",
+			handler: func(svc testService) func(http.ResponseWriter, *http.Request) {
+				return removeScheduleHandler(svc.cfger, svc.ctrl, svc.el)
+			},
+			vars: map[string]string{"id": "nope"},
+			want: []string{},
+		},
+		{
+			name: "rolled back",
+			handler: func(svc testService) func(http.ResponseWriter, *http.Request) {
+				return rollbackConfigHandler(svc.cfger, svc.ctrl, svc.changes, svc.el)
+			},
+			vars: map[string]string{"revision": "1"},
+			want: []string{"rollback to revision 1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newTestService(t, internal.Config{})
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			r = mux.SetURLVars(r, tt.vars)
+			w := httptest.NewRecorder()
+			tt.handler(svc)(w, r)
+
+			page, err := svc.el.Query(eventer.Query{Types: []eventer.Type{eventer.TypeConfigChanged}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, e := range page.Events {
+				got = append(got, e.Cause)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
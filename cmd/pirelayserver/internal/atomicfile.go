@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic replaces filename with data so that a crash or power loss
+// leaves either the old or the new contents, never a truncated file.  The
+// data is written to a temp file in the same directory, synced, and renamed
+// over filename.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(filename)
+	f, err := ioutil.TempFile(dir, filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	// Clean up the temp file if anything goes wrong before the rename
+	defer os.Remove(tmp)
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp, perm)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, filename)
+	if err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes a rename within dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	// Not every platform supports syncing a directory; the rename itself has
+	// still happened
+	d.Sync()
+	return nil
+}
+
+// backupName returns the name of the nth backup of filename
+func backupName(filename string, n int) string {
+	return fmt.Sprintf("%v.%v", filename, n)
+}
+
+// rotateBackups shifts filename.1 to filename.2 and so on, dropping the
+// oldest, then copies filename to filename.1
+func rotateBackups(filename string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return nil
+	}
+	err := shiftBackups(filename, keep)
+	if err != nil {
+		return err
+	}
+	return copyFile(filename, backupName(filename, 1))
+}
+
+// shiftBackups makes room for a new filename.1, dropping the oldest backup
+func shiftBackups(filename string, keep int) error {
+	os.Remove(backupName(filename, keep))
+	for i := keep - 1; i >= 1; i-- {
+		err := os.Rename(backupName(filename, i), backupName(filename, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -3,32 +3,40 @@ package auth
 import (
 	"context"
 	"log"
-	"os"
 
 	"golang.org/x/oauth2"
 
 	oidc "github.com/coreos/go-oidc"
 )
 
+// Settings configures the Auth0 tenant and app the service authenticates with
+type Settings struct {
+	Domain       string
+	Audience     string
+	ClientID     string
+	ClientSecret string
+	CallbackURL  string
+}
+
 type Authenticator struct {
 	Provider *oidc.Provider
 	Config   oauth2.Config
 	Ctx      context.Context
 }
 
-func NewAuthenticator() (*Authenticator, error) {
+func NewAuthenticator(s Settings) (*Authenticator, error) {
 	ctx := context.Background()
 
-	provider, err := oidc.NewProvider(ctx, "https://"+os.Getenv("AUTH0_DOMAIN")+"/")
+	provider, err := oidc.NewProvider(ctx, "https://"+s.Domain+"/")
 	if err != nil {
 		log.Printf("failed to get provider: %v", err)
 		return nil, err
 	}
 
 	conf := oauth2.Config{
-		ClientID:     os.Getenv("AUTH0_CLIENT_ID"),
-		ClientSecret: os.Getenv("AUTH0_CLIENT_SECRET"),
-		RedirectURL:  os.Getenv("AUTH0_CALLBACK_URL"),
+		ClientID:     s.ClientID,
+		ClientSecret: s.ClientSecret,
+		RedirectURL:  s.CallbackURL,
 		Endpoint:     provider.Endpoint(),
 		Scopes:       []string{oidc.ScopeOpenID, "profile"},
 	}
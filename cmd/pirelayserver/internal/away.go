@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// restoreLookback is how far back the normal schedules are replayed to work
+// out which state each relay should return to when away mode ends
+const restoreLookback = 7 * 24 * time.Hour
+
+// AwayMode suspends the normal schedules between Start and End.  While it is
+// in effect only its own Schedules run, and Relays are forced into the given
+// states as soon as it begins.
+type AwayMode struct {
+	Start     time.Time        `json:"start"`
+	End       time.Time        `json:"end"`
+	Schedules []Schedule       `json:"schedules"`
+	Relays    map[uint8]Action `json:"relays,omitempty"`
+}
+
+// Active reports whether away mode is in effect at t
+func (a *AwayMode) Active(t time.Time) bool {
+	return a != nil && !t.Before(a.Start) && t.Before(a.End)
+}
+
+// Expired reports whether away mode has come and gone by t
+func (a *AwayMode) Expired(t time.Time) bool {
+	return a != nil && !t.Before(a.End)
+}
+
+// Validate checks that the away period makes sense at t
+func (a *AwayMode) Validate(t time.Time) error {
+	if !a.End.After(a.Start) {
+		return fmt.Errorf("away mode must end after it starts")
+	}
+	if !a.End.After(t) {
+		return fmt.Errorf("away mode must end in the future")
+	}
+	for k, v := range a.Relays {
+		if v != On && v != Off {
+			return fmt.Errorf("invalid action %q for relay %v", v, k)
+		}
+	}
+	return nil
+}
+
+// once is a cron.Schedule that fires a single time
+type once time.Time
+
+func (o once) Next(t time.Time) time.Time {
+	if t.Before(time.Time(o)) {
+		return time.Time(o)
+	}
+	return time.Time{}
+}
+
+// impliedStates works out, from schedules running on the jitter seed, the
+// action each relay was most recently asked to perform during the lookback
+// window ending at t.  When several schedules last fired during the same
+// minute the highest priority one wins.
+func impliedStates(schedules []Schedule, seed int64, t time.Time, lookback time.Duration) map[uint8]Action {
+	type firing struct {
+		at       time.Time
+		priority int
+		action   Action
+	}
+	last := make(map[uint8]firing)
+	for _, s := range schedules {
+		if s.Action != On && s.Action != Off {
+			continue
+		}
+		spec, err := s.Spec(seed)
+		if err != nil {
+			continue
+		}
+		prev := lastRun(spec, t.Add(-lookback), t)
+		if prev.IsZero() {
+			continue
+		}
+		f := firing{at: prev.Truncate(time.Minute), priority: s.Priority, action: s.Action}
+		cur, ok := last[s.Relay]
+		if !ok || f.at.After(cur.at) || (f.at.Equal(cur.at) && f.priority > cur.priority) {
+			last[s.Relay] = f
+		}
+	}
+	ret := make(map[uint8]Action)
+	for k, v := range last {
+		ret[k] = v.action
+	}
+	return ret
+}
+
+// lastRun returns the last time spec fired after from and at or before t, or
+// the zero time if it didn't fire in between.  Schedules can only be asked
+// when they next fire, so this narrows down the latest time whose next firing
+// is still at or before t.  Firings fall on whole seconds, so once that is
+// within a second the next firing is the last one.
+func lastRun(spec cron.Schedule, from, t time.Time) time.Time {
+	due := func(x time.Time) bool {
+		n := spec.Next(x)
+		return !n.IsZero() && !n.After(t)
+	}
+	if !due(from) {
+		return time.Time{}
+	}
+	lo, hi := from, t
+	for hi.Sub(lo) > time.Second {
+		mid := lo.Add(hi.Sub(lo) / 2)
+		if due(mid) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return spec.Next(lo)
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestImpliedStates(t *testing.T) {
+	now := time.Date(2026, 6, 8, 12, 0, 30, 0, time.UTC)
+	tests := []struct {
+		name      string
+		schedules []Schedule
+		want      map[uint8]Action
+	}{
+		{
+			name: "last of several",
+			schedules: []Schedule{
+				{ID: "a", Relay: 1, Expression: "0 8 * * *", Action: On},
+				{ID: "b", Relay: 1, Expression: "0 11 * * *", Action: Off},
+				{ID: "c", Relay: 2, Expression: "0 20 * * *", Action: On},
+			},
+			want: map[uint8]Action{1: Off, 2: On},
+		},
+		{
+			name: "every minute",
+			schedules: []Schedule{
+				{ID: "a", Relay: 1, Expression: "* * * * *", Action: On},
+				{ID: "b", Relay: 1, Expression: "59 11 * * *", Action: Off},
+			},
+			want: map[uint8]Action{1: On},
+		},
+		{
+			name: "due at t",
+			schedules: []Schedule{
+				{ID: "a", Relay: 1, Expression: "* * * * *", Action: On},
+				{ID: "b", Relay: 1, Expression: "0 12 * * *", Action: Off, Priority: 1},
+			},
+			want: map[uint8]Action{1: Off},
+		},
+		{
+			name: "same minute, higher priority wins",
+			schedules: []Schedule{
+				{ID: "a", Relay: 1, Expression: "0 8 * * *", Action: Off, Priority: 1},
+				{ID: "b", Relay: 1, Expression: "0 8 * * *", Action: On},
+			},
+			want: map[uint8]Action{1: Off},
+		},
+		{
+			name: "before the lookback",
+			schedules: []Schedule{
+				{ID: "a", Relay: 1, Expression: "0 8 1 1 *", Action: On},
+			},
+			want: map[uint8]Action{},
+		},
+		{
+			name: "pulses and invalid expressions ignored",
+			schedules: []Schedule{
+				{ID: "a", Relay: 1, Expression: "0 8 * * *", Action: On},
+				{ID: "b", Relay: 1, Expression: "0 9 * * *", Action: Pulse, Duration: Duration(time.Minute)},
+				{ID: "c", Relay: 1, Expression: "bad", Action: Off},
+			},
+			want: map[uint8]Action{1: On},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := impliedStates(tt.schedules, 42, now, restoreLookback)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLastRun(t *testing.T) {
+	from := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	end := from.Add(restoreLookback)
+	jittered := Schedule{ID: "a", Expression: "0 12 * * *", Jitter: Duration(10 * time.Minute)}
+	fireTime := func(day int) time.Time {
+		nominal := time.Date(2026, 6, day, 12, 0, 0, 0, time.UTC)
+		return nominal.Add(jitterOffset(0, jittered, nominal))
+	}
+	tests := []struct {
+		name string
+		sch  Schedule
+		to   time.Time
+		want time.Time
+	}{
+		{
+			name: "every minute",
+			sch:  Schedule{ID: "a", Expression: "* * * * *"},
+			to:   end,
+			want: end,
+		},
+		{
+			name: "daily",
+			sch:  Schedule{ID: "a", Expression: "30 7 * * *"},
+			to:   end,
+			want: time.Date(2026, 6, 7, 7, 30, 0, 0, time.UTC),
+		},
+		{
+			name: "not in the window",
+			sch:  Schedule{ID: "a", Expression: "0 0 1 1 *"},
+			to:   end,
+		},
+		{
+			name: "jittered, at t",
+			sch:  jittered,
+			to:   fireTime(5),
+			want: fireTime(5),
+		},
+		{
+			name: "jittered, just before t",
+			sch:  jittered,
+			to:   fireTime(5).Add(-time.Second),
+			want: fireTime(4),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, err := tt.sch.Spec(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := lastRun(spec, from, tt.to); !got.Equal(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal/eventer"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	configBucket = []byte("config")
+	currentKey   = []byte("current")
+)
+
+// BoltConfigurer is a Configurer backed by a bbolt database.  Every change is
+// stored in a single transaction, so the config is never left half written.
+type BoltConfigurer struct {
+	db      *bolt.DB
+	relays  uint8
+	cfg     Config
+	el      eventer.Eventer
+	changes *ConfigHistory
+	// m serializes writers, while cm only guards cfg so that readers never
+	// wait on an update that is busy applying the config
+	m  sync.Mutex
+	cm sync.RWMutex
+}
+
+// WithBoltConfigurer loads the config stored in db.  The first time it is
+// used with a database, the config is imported from importFile (a
+// JsonConfigurer file) if it exists, or else a blank config is created.  A
+// stored config from an older release is migrated, keeping the original
+// under a "current.vN" key.  Every change is recorded in changes, if given.
+func WithBoltConfigurer(db *bolt.DB, el eventer.Eventer, relayCount uint8, importFile string, changes *ConfigHistory) (Configurer, error) {
+	c := &BoltConfigurer{
+		db:      db,
+		relays:  relayCount,
+		el:      el,
+		changes: changes,
+	}
+	var dat []byte
+	steps := []MigrationStep{}
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(configBucket)
+		if err != nil {
+			return err
+		}
+		cur := b.Get(currentKey)
+		if cur == nil {
+			return nil
+		}
+		// Values are only valid during the transaction
+		cur = append([]byte{}, cur...)
+		dat, err = MigrateConfig(cur, func(m MigrationStep, before, after []byte) error {
+			err := b.Put([]byte(fmt.Sprintf("%s.v%v", currentKey, m.From)), before)
+			if err != nil {
+				return err
+			}
+			steps = append(steps, m)
+			return b.Put(currentKey, after)
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Events can't be recorded inside the transaction, as the eventer may
+	// share the database
+	for _, m := range steps {
+		el.Event(migrationEvent(m, fmt.Sprintf("Stored config migrated from version %v to %v (%v)", m.From, m.To, m.Desc)))
+	}
+
+	if dat == nil {
+		err = c.importFile(importFile)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		cfg := Config{}
+		err = json.Unmarshal(dat, &cfg)
+		if err != nil {
+			return nil, err
+		}
+		err = cfg.Validate(relayCount)
+		if err != nil {
+			return nil, err
+		}
+		c.cfg = cfg
+	}
+
+	if changes != nil {
+		err = changes.recordInitial(c.cfg, time.Now())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// importFile stores the config in filename, or a blank config if there is no
+// such file.  The revision carries on from the imported config.
+func (c *BoltConfigurer) importFile(filename string) error {
+	cfg := Config{
+		Schedules:  []Schedule{},
+		RelayNames: make(map[uint8]string),
+	}
+	dat, err := ReadConfigFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		cfg, err = ParseConfig(dat)
+		if err != nil {
+			return fmt.Errorf("importing %v: %v", filename, err)
+		}
+		err = cfg.Validate(c.relays)
+		if err != nil {
+			return fmt.Errorf("importing %v: %v", filename, err)
+		}
+		c.cfg.Revision = cfg.Revision
+		defer c.el.Event(eventer.Event{
+			Type: eventer.TypeConfigChanged,
+			Msg:  fmt.Sprintf("Imported config from %v", filename),
+		})
+	}
+	return c.Set(cfg)
+}
+
+func (c *BoltConfigurer) Get() (Config, error) {
+	c.cm.RLock()
+	defer c.cm.RUnlock()
+	return c.cfg, nil
+}
+
+func (c *BoltConfigurer) Revision() uint64 {
+	c.cm.RLock()
+	defer c.cm.RUnlock()
+	return c.cfg.Revision
+}
+
+// Set the config
+func (c *BoltConfigurer) Set(cfg Config) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.set(cfg, "")
+}
+
+func (c *BoltConfigurer) Update(actor string, fn func(*Config) error) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	cfg, err := c.Get()
+	if err != nil {
+		return err
+	}
+	cfg, err = cfg.Clone()
+	if err != nil {
+		return err
+	}
+	err = fn(&cfg)
+	if err == ErrUnchanged {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return c.set(cfg, actor)
+}
+
+func (c *BoltConfigurer) set(cfg Config, actor string) error {
+	cfg.Revision = c.Revision() + 1
+	cfg.Version = ConfigVersion
+	dat, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(configBucket).Put(currentKey, dat)
+	})
+	if err != nil {
+		return err
+	}
+	c.cm.Lock()
+	prev := c.cfg
+	c.cfg = cfg
+	c.cm.Unlock()
+	recordChange(c.changes, c.el, prev, cfg, actor)
+	return nil
+}
@@ -0,0 +1,36 @@
+package internal
+
+import "time"
+
+// Clock tells the time and waits on it.  The relay controllers run on the
+// system clock; the simulator drives a virtual one so that a season of
+// schedules can be replayed in an instant.
+type Clock interface {
+	Now() time.Time
+	// Sleep blocks until d has passed
+	Sleep(d time.Duration)
+	// AfterFunc calls f in its own goroutine once d has passed
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a call waiting on a Clock
+type Timer interface {
+	// Stop keeps the call from happening, and reports whether it had not
+	// happened yet
+	Stop() bool
+}
+
+// systemClock is the Clock of the host
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
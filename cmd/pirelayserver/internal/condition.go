@@ -0,0 +1,347 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Conditions are small boolean expressions evaluated when a schedule fires,
+// for example `sensor.water_temp < 26 && relay.1 == on`.  Operands are
+// numbers, `on`/`off`, `relay.N` (1 when the relay is on, 0 when off) and
+// `sensor.NAME`.  Comparisons use <, <=, >, >=, == and !=; they can be
+// combined with &&, || and ! and grouped with parentheses.  A bare operand is
+// true when it is non-zero.
+
+// ConditionEnv holds the values a condition is evaluated against
+type ConditionEnv struct {
+	Relays  map[uint8]uint8
+	Sensors map[string]float64
+}
+
+// Condition is a parsed condition expression
+type Condition struct {
+	src  string
+	root condNode
+}
+
+// ParseCondition parses a condition expression
+func ParseCondition(src string) (*Condition, error) {
+	toks, err := tokenizeCondition(src)
+	if err != nil {
+		return nil, err
+	}
+	p := condParser{toks: toks}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("condition %q: %v", src, err)
+	}
+	if !p.done() {
+		return nil, fmt.Errorf("condition %q: unexpected %q", src, p.peek())
+	}
+	return &Condition{src: src, root: root}, nil
+}
+
+// String returns the source of the condition
+func (c *Condition) String() string {
+	return c.src
+}
+
+// Eval evaluates the condition.  Referencing a relay or sensor that has no
+// value is an error.
+func (c *Condition) Eval(env ConditionEnv) (bool, error) {
+	v, err := c.root.eval(env)
+	if err != nil {
+		return false, fmt.Errorf("condition %q: %v", c.src, err)
+	}
+	return v != 0, nil
+}
+
+// conditionError starts the reason given for skipping a schedule or rule whose
+// condition couldn't be evaluated
+const conditionError = "condition could not be evaluated"
+
+// EvalCondition parses src and evaluates it against the current relay states
+// and sensor readings
+func EvalCondition(src string, ctrl RelayController, sensors SensorReader) (bool, error) {
+	c, err := ParseCondition(src)
+	if err != nil {
+		return false, err
+	}
+	env, err := currentEnv(ctrl, sensors)
+	if err != nil {
+		return false, err
+	}
+	return c.Eval(env)
+}
+
+func currentEnv(ctrl RelayController, sensors SensorReader) (ConditionEnv, error) {
+	env := ConditionEnv{
+		Relays:  make(map[uint8]uint8),
+		Sensors: make(map[string]float64),
+	}
+	status, err := ctrl.Status()
+	if err != nil {
+		return env, err
+	}
+	for _, v := range status.States {
+		env.Relays[v.Relay] = v.State
+	}
+	if sensors != nil {
+		for k, v := range sensors.Readings() {
+			env.Sensors[k] = v.Value
+		}
+	}
+	return env, nil
+}
+
+type condNode interface {
+	eval(env ConditionEnv) (float64, error)
+}
+
+type condNumber float64
+
+func (n condNumber) eval(ConditionEnv) (float64, error) {
+	return float64(n), nil
+}
+
+type condRelay uint8
+
+func (r condRelay) eval(env ConditionEnv) (float64, error) {
+	v, ok := env.Relays[uint8(r)]
+	if !ok {
+		return 0, fmt.Errorf("unknown relay %v", uint8(r))
+	}
+	return float64(v), nil
+}
+
+type condSensor string
+
+func (s condSensor) eval(env ConditionEnv) (float64, error) {
+	v, ok := env.Sensors[string(s)]
+	if !ok {
+		return 0, fmt.Errorf("no reading for sensor %v", string(s))
+	}
+	return v, nil
+}
+
+type condNot struct {
+	n condNode
+}
+
+func (c condNot) eval(env ConditionEnv) (float64, error) {
+	v, err := c.n.eval(env)
+	return boolToFloat(v == 0), err
+}
+
+type condBinary struct {
+	op   string
+	l, r condNode
+}
+
+func (c condBinary) eval(env ConditionEnv) (float64, error) {
+	l, err := c.l.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	// Short circuit the logical operators
+	switch {
+	case c.op == "&&" && l == 0:
+		return 0, nil
+	case c.op == "||" && l != 0:
+		return 1, nil
+	}
+	r, err := c.r.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	switch c.op {
+	case "&&", "||":
+		return boolToFloat(r != 0), nil
+	case "<":
+		return boolToFloat(l < r), nil
+	case "<=":
+		return boolToFloat(l <= r), nil
+	case ">":
+		return boolToFloat(l > r), nil
+	case ">=":
+		return boolToFloat(l >= r), nil
+	case "==":
+		return boolToFloat(l == r), nil
+	case "!=":
+		return boolToFloat(l != r), nil
+	}
+	return 0, fmt.Errorf("unknown operator %v", c.op)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func tokenizeCondition(src string) ([]string, error) {
+	toks := []string{}
+	rs := []rune(src)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			toks = append(toks, string(r))
+			i++
+		case strings.ContainsRune("<>=!&|", r):
+			if i+1 < len(rs) {
+				two := string(rs[i : i+2])
+				switch two {
+				case "<=", ">=", "==", "!=", "&&", "||":
+					toks = append(toks, two)
+					i += 2
+					continue
+				}
+			}
+			if r != '<' && r != '>' && r != '!' {
+				return nil, fmt.Errorf("condition %q: unexpected %q", src, string(r))
+			}
+			toks = append(toks, string(r))
+			i++
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '_' || r == '-':
+			j := i
+			for j < len(rs) && (unicode.IsLetter(rs[j]) || unicode.IsDigit(rs[j]) || rs[j] == '.' || rs[j] == '_' || rs[j] == '-') {
+				j++
+			}
+			toks = append(toks, string(rs[i:j]))
+			i = j
+		default:
+			return nil, fmt.Errorf("condition %q: unexpected %q", src, string(r))
+		}
+	}
+	return toks, nil
+}
+
+type condParser struct {
+	toks []string
+	pos  int
+}
+
+func (p *condParser) done() bool {
+	return p.pos >= len(p.toks)
+}
+
+func (p *condParser) peek() string {
+	if p.done() {
+		return ""
+	}
+	return p.toks[p.pos]
+}
+
+func (p *condParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *condParser) parseOr() (condNode, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.next()
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = condBinary{op: "||", l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *condParser) parseAnd() (condNode, error) {
+	l, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.next()
+		r, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l = condBinary{op: "&&", l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *condParser) parseUnary() (condNode, error) {
+	switch p.peek() {
+	case "!":
+		p.next()
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return condNot{n: n}, nil
+	case "(":
+		p.next()
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		return n, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *condParser) parseComparison() (condNode, error) {
+	l, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	switch op := p.peek(); op {
+	case "<", "<=", ">", ">=", "==", "!=":
+		p.next()
+		r, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return condBinary{op: op, l: l, r: r}, nil
+	}
+	return l, nil
+}
+
+func (p *condParser) parseOperand() (condNode, error) {
+	if p.done() {
+		return nil, fmt.Errorf("unexpected end of condition")
+	}
+	t := p.next()
+	switch {
+	case t == "on":
+		return condNumber(1), nil
+	case t == "off":
+		return condNumber(0), nil
+	case strings.HasPrefix(t, "relay."):
+		n, err := strconv.ParseUint(strings.TrimPrefix(t, "relay."), 10, 8)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid relay reference %q", t)
+		}
+		return condRelay(n), nil
+	case strings.HasPrefix(t, "sensor."):
+		name := strings.TrimPrefix(t, "sensor.")
+		if name == "" {
+			return nil, fmt.Errorf("invalid sensor reference %q", t)
+		}
+		return condSensor(name), nil
+	}
+	v, err := strconv.ParseFloat(t, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected %q", t)
+	}
+	return condNumber(v), nil
+}
@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCondition(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		wantErr bool
+	}{
+		{name: "comparison", src: "relay.1 == on"},
+		{name: "combined", src: "sensor.water_temp < 26 && !(relay.2 == off || relay.3)"},
+		{name: "negative number", src: "sensor.air_temp > -5.5"},
+		{name: "empty", src: "", wantErr: true},
+		{name: "relay zero", src: "relay.0 == on", wantErr: true},
+		{name: "relay not a number", src: "relay.x == on", wantErr: true},
+		{name: "sensor without a name", src: "sensor. > 1", wantErr: true},
+		{name: "single ampersand", src: "relay.1 & relay.2", wantErr: true},
+		{name: "missing operand", src: "relay.1 ==", wantErr: true},
+		{name: "unclosed parenthesis", src: "(relay.1 == on", wantErr: true},
+		{name: "unopened parenthesis", src: "relay.1 == on)", wantErr: true},
+		{name: "two operands", src: "1 2", wantErr: true},
+		{name: "unknown word", src: "pump == on", wantErr: true},
+		{name: "unexpected character", src: "relay.1 == #", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseCondition(tt.src)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConditionEval(t *testing.T) {
+	env := ConditionEnv{
+		Relays:  map[uint8]uint8{1: 1, 2: 0},
+		Sensors: map[string]float64{"water_temp": 25.5},
+	}
+	tests := []struct {
+		name    string
+		src     string
+		want    bool
+		wantErr bool
+	}{
+		{name: "relay on", src: "relay.1 == on", want: true},
+		{name: "bare relay", src: "relay.2", want: false},
+		{name: "not", src: "!relay.2", want: true},
+		{name: "not equal", src: "relay.1 != off", want: true},
+		{name: "sensor and relay", src: "sensor.water_temp < 26 && relay.1 == on", want: true},
+		{name: "sensor or relay", src: "sensor.water_temp >= 26 || relay.2 == on", want: false},
+		{name: "grouping", src: "!(relay.1 == on && relay.2 == on)", want: true},
+		{name: "and binds tighter than or", src: "relay.1 || relay.2 && relay.2", want: true},
+		{name: "and skips the right side", src: "relay.2 == on && sensor.air_temp > 0", want: false},
+		{name: "or skips the right side", src: "relay.1 == on || sensor.air_temp > 0", want: true},
+		{name: "unknown relay", src: "relay.3 == on", wantErr: true},
+		{name: "missing sensor", src: "sensor.air_temp > 0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := ParseCondition(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := c.Eval(env)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvalCondition(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		readings map[string]Reading
+		src      string
+		want     bool
+		wantErr  bool
+	}{
+		{
+			name:     "current reading",
+			readings: map[string]Reading{"water_temp": {Value: 27, Stamp: now}},
+			src:      "sensor.water_temp > 26 && relay.1 == on",
+			want:     true,
+		},
+		{
+			name:     "stale reading",
+			readings: map[string]Reading{"water_temp": {Value: 27, Stamp: now.Add(-2 * time.Hour)}},
+			src:      "sensor.water_temp > 26",
+			wantErr:  true,
+		},
+		{
+			name: "relay off",
+			src:  "relay.2 == on",
+			want: false,
+		},
+		{
+			name:    "invalid",
+			src:     "relay.1 ==",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newTestController(t, 2, Config{})
+			err := c.On(1, testCause)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sensors := NewSensorStore(time.Hour)
+			for k, v := range tt.readings {
+				sensors.Set(k, v)
+			}
+			got, err := EvalCondition(tt.src, c, sensors)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -4,30 +4,110 @@ package internal
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal/eventer"
 )
 
+// configBackups is how many previous versions of the config file are kept
+const configBackups = 5
+
+// ErrUnchanged can be returned from an Update function to abandon the update
+// without failing it
+var ErrUnchanged = errors.New("config unchanged")
+
 type Action string
 
 const (
 	Off Action = "off"
 	On  Action = "on"
+	// SceneAction activates the scene named by Schedule.Scene
+	SceneAction Action = "scene"
+	// Pulse switches the relay on for Schedule.Duration, then off
+	Pulse Action = "pulse"
+	// Sequence runs Schedule.Steps against the relay
+	Sequence Action = "sequence"
 )
 
-// Config is a pirelayserver config
+// Config is a pirelayserver config.  Schedules always run; the schedules of
+// the active profile (if any) run alongside them.  Both are suspended while
+// away mode is in effect.
 type Config struct {
-	Schedules  []Schedule                  `json:"schedules"`
-	RelayNames map[uint8]string            `json:"relayNames"`
-	APIKeys    map[string]APIKeyCollection `json:"apiKeys"`
+	// Version is the schema version of the config, see ConfigVersion
+	Version         int                         `json:"version"`
+	Schedules       []Schedule                  `json:"schedules"`
+	RelayNames      map[uint8]string            `json:"relayNames"`
+	APIKeys         map[string]APIKeyCollection `json:"apiKeys"`
+	Profiles        map[string]Profile          `json:"profiles,omitempty"`
+	ProfileOverride string                      `json:"profileOverride,omitempty"`
+	Away            *AwayMode                   `json:"away,omitempty"`
+	Scenes          map[string]Scene            `json:"scenes,omitempty"`
+	Rules           []Rule                      `json:"rules,omitempty"`
+	JitterSeed      int64                       `json:"jitterSeed,omitempty"`
+	// Revision is bumped by the Configurer every time the config is stored
+	Revision uint64 `json:"revision,omitempty"`
+}
+
+// Clone returns a deep copy of the config, so it can be modified without
+// affecting anyone else holding it
+func (c Config) Clone() (Config, error) {
+	ret := Config{}
+	dat, err := json.Marshal(c)
+	if err != nil {
+		return ret, err
+	}
+	err = json.Unmarshal(dat, &ret)
+	return ret, err
 }
 
-// Schedule is a mapping of a relay action along with a cron expression
+// Schedule is a mapping of a relay action along with a cron expression.
+// When schedules with different actions fire on the same relay during the same
+// minute, the one with the highest priority wins.  A schedule with a jitter
+// window fires at a random offset of up to that much either side of each
+// occurrence.
 type Schedule struct {
-	ID         string `json:"id"`
-	Relay      uint8  `json:"relay"`
-	Expression string `json:"expression"`
-	Action     Action `json:"action"`
+	ID         string         `json:"id"`
+	Relay      uint8          `json:"relay"`
+	Expression string         `json:"expression"`
+	Action     Action         `json:"action"`
+	Priority   int            `json:"priority,omitempty"`
+	Scene      string         `json:"scene,omitempty"`
+	Duration   Duration       `json:"duration,omitempty"`
+	Steps      []SequenceStep `json:"steps,omitempty"`
+	Condition  string         `json:"condition,omitempty"`
+	Jitter     Duration       `json:"jitter,omitempty"`
+}
+
+// SequenceSteps returns the steps a pulse or sequence schedule runs
+func (s Schedule) SequenceSteps() []SequenceStep {
+	if s.Action == Pulse {
+		return PulseSteps(s.Duration)
+	}
+	return s.Steps
+}
+
+// AllSchedules returns every schedule in the config, whether or not it is
+// currently active
+func (c Config) AllSchedules() []Schedule {
+	ret := append([]Schedule{}, c.Schedules...)
+	names := []string{}
+	for k := range c.Profiles {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		ret = append(ret, c.Profiles[n].Schedules...)
+	}
+	if c.Away != nil {
+		ret = append(ret, c.Away.Schedules...)
+	}
+	return ret
 }
 
 type State struct {
@@ -51,17 +131,46 @@ type APIKeyCollection map[string]APIKey
 type Configurer interface {
 	Get() (Config, error)
 	Set(Config) error
+	// Update runs fn against a copy of the current config and stores the
+	// result if fn succeeds.  Updates are serialized, so none are lost to
+	// concurrent changes.  fn may read the config, but must not store it.
+	// actor is recorded as the subject of the change.
+	Update(actor string, fn func(*Config) error) error
+	// Revision returns the revision of the current config
+	Revision() uint64
 }
 
-// JsonConfigurer is a Configurer implementation backed by a JSON file
+// JsonConfigurer is a Configurer implementation backed by a JSON file, or a
+// YAML or TOML file if the filename says so.  The file is replaced atomically
+// on every write, and the previous versions are kept as filename.1 (newest)
+// to filename.5 (oldest).
 type JsonConfigurer struct {
 	filename string
+	format   configFormat
+	relays   uint8
 	cfg      Config
+	el       eventer.Eventer
+	changes  *ConfigHistory
+	// dat is the file as last written or loaded, so that Watch can tell the
+	// configurer's own writes from edits
+	dat []byte
+	// m serializes writers, while cm only guards cfg so that readers never
+	// wait on an update that is busy applying the config
+	m  sync.Mutex
+	cm sync.RWMutex
 }
 
-func WithJsonConfigurer(filename string) (Configurer, error) {
+// WithJsonConfigurer loads the config in filename, creating it if necessary.
+// A config that can't be loaded, or isn't valid for relayCount relays, is
+// replaced with the newest backup that is.  Every change is recorded in
+// changes, if given.
+func WithJsonConfigurer(filename string, el eventer.Eventer, relayCount uint8, changes *ConfigHistory) (Configurer, error) {
 	c := &JsonConfigurer{
 		filename: filename,
+		format:   formatFor(filename),
+		relays:   relayCount,
+		el:       el,
+		changes:  changes,
 	}
 	_, err := os.Stat(filename)
 	if os.IsNotExist(err) {
@@ -74,19 +183,62 @@ func WithJsonConfigurer(filename string) (Configurer, error) {
 			return nil, err
 		}
 	}
-	cfg, err := c.Load()
+	err = c.migrate()
+	if err == nil {
+		c.cfg, err = c.load(filename)
+	}
+	if err != nil {
+		c.cfg, err = c.restore(err)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.dat, err = ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	c.cfg = cfg
+	if changes != nil {
+		err = changes.recordInitial(c.cfg, time.Now())
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	return c, nil
 }
 
 // Load the config
 func (c *JsonConfigurer) Load() (Config, error) {
+	return loadConfig(c.filename, c.format)
+}
+
+// load reads and validates a config file
+func (c *JsonConfigurer) load(filename string) (Config, error) {
+	cfg, err := loadConfig(filename, c.format)
+	if err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.Validate(c.relays)
+}
+
+// loadConfig reads a config file, migrating it to ConfigVersion in memory if
+// it is older
+func loadConfig(filename string, format configFormat) (Config, error) {
+	dat, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return Config{}, err
+	}
+	dat, err = format.toJSON(dat)
+	if err != nil {
+		return Config{}, err
+	}
+	return ParseConfig(dat)
+}
+
+// ParseConfig decodes a config, migrating it in memory if it is older
+func ParseConfig(dat []byte) (Config, error) {
 	cfg := Config{}
-	dat, err := ioutil.ReadFile(c.filename)
+	dat, err := MigrateConfig(dat, nil)
 	if err != nil {
 		return cfg, err
 	}
@@ -94,20 +246,115 @@ func (c *JsonConfigurer) Load() (Config, error) {
 	return cfg, err
 }
 
+// restore falls back to the newest valid backup when the config file can't
+// be loaded or isn't valid, e.g. because it was truncated by a power loss.
+// The broken file is kept as filename.corrupt and replaced with the backup.
+func (c *JsonConfigurer) restore(cause error) (Config, error) {
+	for i := 1; i <= configBackups; i++ {
+		name := backupName(c.filename, i)
+		cfg, err := c.load(name)
+		if err != nil {
+			continue
+		}
+		dat, err := ioutil.ReadFile(name)
+		if err != nil {
+			return cfg, err
+		}
+		copyFile(c.filename, c.filename+".corrupt")
+		err = writeFileAtomic(c.filename, dat, 0644)
+		if err != nil {
+			return cfg, err
+		}
+		c.el.Event(eventer.Event{
+			Type: eventer.TypeConfigError,
+			Msg:  fmt.Sprintf("Config file %v could not be loaded (%v), restored from backup %v", c.filename, cause, name),
+		})
+		return cfg, nil
+	}
+	return Config{}, cause
+}
+
 func (c *JsonConfigurer) Get() (Config, error) {
+	c.cm.RLock()
+	defer c.cm.RUnlock()
 	return c.cfg, nil
 }
 
+func (c *JsonConfigurer) Revision() uint64 {
+	c.cm.RLock()
+	defer c.cm.RUnlock()
+	return c.cfg.Revision
+}
+
 // Set the config
 func (c *JsonConfigurer) Set(cfg Config) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.set(cfg, "")
+}
+
+func (c *JsonConfigurer) Update(actor string, fn func(*Config) error) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	cfg, err := c.Get()
+	if err != nil {
+		return err
+	}
+	cfg, err = cfg.Clone()
+	if err != nil {
+		return err
+	}
+	err = fn(&cfg)
+	if err == ErrUnchanged {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return c.set(cfg, actor)
+}
+
+func (c *JsonConfigurer) set(cfg Config, actor string) error {
+	cfg.Revision = c.Revision() + 1
+	cfg.Version = ConfigVersion
 	dat, err := json.Marshal(cfg)
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(c.filename, dat, 0644)
+	dat, err = c.format.fromJSON(dat, c.dat)
+	if err != nil {
+		return err
+	}
+	err = rotateBackups(c.filename, configBackups)
 	if err != nil {
 		return err
 	}
+	err = writeFileAtomic(c.filename, dat, 0644)
+	if err != nil {
+		return err
+	}
+	c.dat = dat
+	c.cm.Lock()
+	prev := c.cfg
 	c.cfg = cfg
+	c.cm.Unlock()
+	recordChange(c.changes, c.el, prev, cfg, actor)
 	return nil
 }
+
+// recordChange adds a stored config to the history, if there is one.  The
+// change itself has already been made, so a failure to record it is only
+// reported.
+func recordChange(changes *ConfigHistory, el eventer.Eventer, prev, cfg Config, actor string) {
+	if changes == nil {
+		return
+	}
+	err := changes.Record(prev, cfg, actor, time.Now())
+	if err != nil {
+		el.Event(eventer.Event{
+			Type:  eventer.TypeConfigError,
+			Actor: actor,
+			Msg:   fmt.Sprintf("Failed to record config revision %v in history: %v", cfg.Revision, err),
+		})
+	}
+}
@@ -0,0 +1,307 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal/hub"
+)
+
+// Actors of changes that aren't made by a user
+const (
+	ActorFile      = "config file"
+	ActorScheduler = "scheduler"
+	ActorRules     = "rules"
+)
+
+// ConfigChange describes a stored revision of the config
+type ConfigChange struct {
+	Revision uint64    `json:"revision"`
+	At       time.Time `json:"at"`
+	// Subject is who made the change: the JWT subject of the user, or one of
+	// the Actor constants
+	Subject string   `json:"subject,omitempty"`
+	Summary []string `json:"summary"`
+}
+
+type configHistoryEntry struct {
+	ConfigChange
+	Config Config `json:"config"`
+}
+
+// ConfigHistory keeps the most recent revisions of the config along with who
+// made each change, so they can be compared and rolled back to.  It is
+// persisted to a JSON file.
+type ConfigHistory struct {
+	filename string
+	keep     int
+	entries  []configHistoryEntry
+	h        *hub.Hub
+	m        sync.RWMutex
+}
+
+// WithConfigHistory loads the config history stored in filename, if any,
+// keeping at most keep revisions.  An empty filename keeps the history in
+// memory only.  Recorded changes are published to hb.
+func WithConfigHistory(filename string, keep int, hb *hub.Hub) (*ConfigHistory, error) {
+	h := &ConfigHistory{
+		filename: filename,
+		keep:     keep,
+		h:        hb,
+	}
+	if filename == "" {
+		return h, nil
+	}
+	dat, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(dat, &h.entries)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Record adds a revision of the config, summarizing how it differs from prev
+func (h *ConfigHistory) Record(prev, cfg Config, subject string, at time.Time) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	change := ConfigChange{
+		Revision: cfg.Revision,
+		At:       at,
+		Subject:  subject,
+		Summary:  SummarizeChanges(prev, cfg),
+	}
+	err := h.add(configHistoryEntry{
+		ConfigChange: change,
+		Config:       cfg,
+	})
+	if err != nil {
+		return err
+	}
+	h.h.Publish(hub.TopicConfig, change)
+	return nil
+}
+
+// recordInitial records cfg as the first revision when the history doesn't
+// already have it, so that there is something to compare the next change to
+func (h *ConfigHistory) recordInitial(cfg Config, at time.Time) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	for _, e := range h.entries {
+		if e.Revision == cfg.Revision {
+			return nil
+		}
+	}
+	return h.add(configHistoryEntry{
+		ConfigChange: ConfigChange{
+			Revision: cfg.Revision,
+			At:       at,
+			Summary:  []string{"loaded from disk"},
+		},
+		Config: cfg,
+	})
+}
+
+func (h *ConfigHistory) add(e configHistoryEntry) error {
+	h.entries = append(h.entries, e)
+	if h.keep > 0 && len(h.entries) > h.keep {
+		h.entries = h.entries[len(h.entries)-h.keep:]
+	}
+	return h.save()
+}
+
+// List returns the recorded changes, oldest first
+func (h *ConfigHistory) List() []ConfigChange {
+	h.m.RLock()
+	defer h.m.RUnlock()
+	ret := []ConfigChange{}
+	for _, e := range h.entries {
+		ret = append(ret, e.ConfigChange)
+	}
+	return ret
+}
+
+// Get returns the given revision of the config
+func (h *ConfigHistory) Get(rev uint64) (Config, ConfigChange, bool) {
+	h.m.RLock()
+	defer h.m.RUnlock()
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		if h.entries[i].Revision == rev {
+			return h.entries[i].Config, h.entries[i].ConfigChange, true
+		}
+	}
+	return Config{}, ConfigChange{}, false
+}
+
+func (h *ConfigHistory) save() error {
+	if h.filename == "" {
+		return nil
+	}
+	dat, err := json.Marshal(h.entries)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(h.filename, dat, 0600)
+}
+
+// Redacted returns a copy of the config with API key secrets blanked, so it
+// can be shown to anyone allowed to read the config
+func (c Config) Redacted() Config {
+	ret := c
+	if c.APIKeys == nil {
+		return ret
+	}
+	ret.APIKeys = make(map[string]APIKeyCollection)
+	for sub, keys := range c.APIKeys {
+		coll := APIKeyCollection{}
+		for id, k := range keys {
+			k.Key = ""
+			coll[id] = k
+		}
+		ret.APIKeys[sub] = coll
+	}
+	return ret
+}
+
+// SummarizeChanges lists the differences between two configs in words
+func SummarizeChanges(prev, cfg Config) []string {
+	ret := []string{}
+	note := func(format string, args ...interface{}) {
+		ret = append(ret, fmt.Sprintf(format, args...))
+	}
+
+	ps := make(map[string]Schedule)
+	for _, s := range prev.Schedules {
+		ps[s.ID] = s
+	}
+	cs := make(map[string]bool)
+	for _, s := range cfg.Schedules {
+		cs[s.ID] = true
+		if old, ok := ps[s.ID]; !ok {
+			note("added schedule %v", s.ID)
+		} else if !reflect.DeepEqual(old, s) {
+			note("changed schedule %v", s.ID)
+		}
+	}
+	for _, s := range prev.Schedules {
+		if !cs[s.ID] {
+			note("removed schedule %v", s.ID)
+		}
+	}
+
+	relays := make(map[uint8]bool)
+	for k := range prev.RelayNames {
+		relays[k] = true
+	}
+	for k := range cfg.RelayNames {
+		relays[k] = true
+	}
+	for _, k := range sortedRelays(relays) {
+		if prev.RelayNames[k] != cfg.RelayNames[k] {
+			note("renamed relay %v to %q", k, cfg.RelayNames[k])
+		}
+	}
+
+	summarizeMap(note, "profile", toInterfaces(prev.Profiles), toInterfaces(cfg.Profiles))
+	if prev.ProfileOverride != cfg.ProfileOverride {
+		if cfg.ProfileOverride == "" {
+			note("cleared active profile override")
+		} else {
+			note("set active profile override to %v", cfg.ProfileOverride)
+		}
+	}
+	switch {
+	case prev.Away == nil && cfg.Away != nil:
+		note("set away mode")
+	case prev.Away != nil && cfg.Away == nil:
+		note("cleared away mode")
+	case !reflect.DeepEqual(prev.Away, cfg.Away):
+		note("changed away mode")
+	}
+	summarizeMap(note, "scene", toInterfaces(prev.Scenes), toInterfaces(cfg.Scenes))
+
+	pr := make(map[string]interface{})
+	for _, r := range prev.Rules {
+		pr[r.ID] = r
+	}
+	cr := make(map[string]interface{})
+	for _, r := range cfg.Rules {
+		cr[r.ID] = r
+	}
+	summarizeMap(note, "rule", pr, cr)
+
+	pk := make(map[string]interface{})
+	for sub, keys := range prev.APIKeys {
+		for id, k := range keys {
+			pk[sub+"/"+id] = k
+		}
+	}
+	ck := make(map[string]interface{})
+	for sub, keys := range cfg.APIKeys {
+		for id, k := range keys {
+			ck[sub+"/"+id] = k
+		}
+	}
+	summarizeMap(note, "api key", pk, ck)
+
+	if prev.JitterSeed != cfg.JitterSeed {
+		note("changed jitter seed")
+	}
+	return ret
+}
+
+// summarizeMap notes the keys added, changed and removed between two maps
+func summarizeMap(note func(string, ...interface{}), kind string, prev, cfg map[string]interface{}) {
+	keys := []string{}
+	for k := range prev {
+		keys = append(keys, k)
+	}
+	for k := range cfg {
+		if _, ok := prev[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		old, had := prev[k]
+		cur, has := cfg[k]
+		switch {
+		case !had:
+			note("added %v %v", kind, k)
+		case !has:
+			note("removed %v %v", kind, k)
+		case !reflect.DeepEqual(old, cur):
+			note("changed %v %v", kind, k)
+		}
+	}
+}
+
+// toInterfaces converts a map of profiles or scenes for summarizeMap
+func toInterfaces(m interface{}) map[string]interface{} {
+	ret := make(map[string]interface{})
+	v := reflect.ValueOf(m)
+	for _, k := range v.MapKeys() {
+		ret[k.String()] = v.MapIndex(k).Interface()
+	}
+	return ret
+}
+
+func sortedRelays(m map[uint8]bool) []uint8 {
+	ret := []uint8{}
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
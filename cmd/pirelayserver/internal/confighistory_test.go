@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSummarizeChanges(t *testing.T) {
+	base := Config{
+		Schedules: []Schedule{
+			{ID: "a", Relay: 1, Expression: "0 8 * * *", Action: On},
+			{ID: "b", Relay: 1, Expression: "0 20 * * *", Action: Off},
+		},
+		RelayNames: map[uint8]string{1: "Pump"},
+		APIKeys: map[string]APIKeyCollection{
+			"alice": {"k1": {Key: "secret", Desc: "laptop"}},
+		},
+		Scenes: map[string]Scene{"spa": {Relays: map[uint8]Action{1: On}}},
+	}
+	tests := []struct {
+		name   string
+		change func(cfg *Config)
+		want   []string
+	}{
+		{
+			name:   "unchanged",
+			change: func(cfg *Config) {},
+			want:   []string{},
+		},
+		{
+			name: "schedules",
+			change: func(cfg *Config) {
+				cfg.Schedules = []Schedule{
+					{ID: "a", Relay: 1, Expression: "0 9 * * *", Action: On},
+					{ID: "c", Relay: 2, Expression: "0 8 * * *", Action: On},
+				}
+			},
+			want: []string{"changed schedule a", "added schedule c", "removed schedule b"},
+		},
+		{
+			name: "relay names",
+			change: func(cfg *Config) {
+				cfg.RelayNames = map[uint8]string{2: "Lights"}
+			},
+			want: []string{`renamed relay 1 to ""`, `renamed relay 2 to "Lights"`},
+		},
+		{
+			name: "profiles",
+			change: func(cfg *Config) {
+				cfg.Profiles = map[string]Profile{"summer": {}}
+				cfg.ProfileOverride = "summer"
+			},
+			want: []string{"added profile summer", "set active profile override to summer"},
+		},
+		{
+			name: "away mode",
+			change: func(cfg *Config) {
+				cfg.Away = &AwayMode{End: time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)}
+			},
+			want: []string{"set away mode"},
+		},
+		{
+			name: "scenes and rules",
+			change: func(cfg *Config) {
+				cfg.Scenes = map[string]Scene{"spa": {Relays: map[uint8]Action{1: Off}}, "movie": {}}
+				cfg.Rules = []Rule{{ID: "r"}}
+			},
+			want: []string{"added scene movie", "changed scene spa", "added rule r"},
+		},
+		{
+			name: "api keys",
+			change: func(cfg *Config) {
+				cfg.APIKeys = map[string]APIKeyCollection{
+					"alice": {"k2": {Key: "other"}},
+				}
+			},
+			want: []string{"removed api key alice/k1", "added api key alice/k2"},
+		},
+		{
+			name: "jitter seed",
+			change: func(cfg *Config) {
+				cfg.JitterSeed = 42
+			},
+			want: []string{"changed jitter seed"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := base.Clone()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.change(&cfg)
+			got := SummarizeChanges(base, cfg)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package internal
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// maxOccurrences bounds how many firings of a single schedule are inspected
+// during conflict analysis so that expressions like `@every 1s` stay cheap
+const maxOccurrences = 10000
+
+type ConflictKind string
+
+const (
+	// Contradictory conflicts have schedules asking for different actions on
+	// the same relay during the same minute
+	Contradictory ConflictKind = "contradictory"
+	// Overlapping conflicts have schedules repeating the same action on the
+	// same relay during the same minute
+	Overlapping ConflictKind = "overlapping"
+)
+
+// Conflict describes a set of schedules that fire on the same relay during the
+// same minute.  When exactly one of them has the highest priority it wins at
+// fire time and the conflict is considered resolved.  Scene schedules take
+// part on every relay of the scene, in the minute its step switches it.
+type Conflict struct {
+	Kind        ConflictKind `json:"kind"`
+	Relay       uint8        `json:"relay"`
+	At          time.Time    `json:"at"`
+	Occurrences int          `json:"occurrences"`
+	Schedules   []string     `json:"schedules"`
+	Resolved    bool         `json:"resolved"`
+	Winner      string       `json:"winner,omitempty"`
+}
+
+// Involves reports whether the given schedule takes part in the conflict
+func (c Conflict) Involves(id string) bool {
+	for _, v := range c.Schedules {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// ConflictPolicy controls how schedule conflicts are handled when schedules are
+// submitted.  Horizon is how far ahead firings are compared; when Reject is set
+// unresolved contradictory conflicts are refused instead of reported.
+type ConflictPolicy struct {
+	Horizon time.Duration
+	Reject  bool
+}
+
+// Rejects reports whether the policy refuses the given conflict
+func (p ConflictPolicy) Rejects(c Conflict) bool {
+	return p.Reject && c.Kind == Contradictory && !c.Resolved
+}
+
+type conflictSlot struct {
+	relay uint8
+	at    time.Time
+}
+
+// slotEntry is a schedule switching the relay of a conflictSlot
+type slotEntry struct {
+	schedule Schedule
+	action   Action
+}
+
+// relayAction is a relay switched by a schedule
+type relayAction struct {
+	relay  uint8
+	action Action
+	// offset is how long after the schedule fires the relay is switched
+	offset time.Duration
+}
+
+// relayActions lists the relays a schedule switches.  A scene schedule
+// switches every relay of the scene, after the delays of the steps before;
+// one whose scene doesn't exist switches nothing.
+func (s Schedule) relayActions(scenes map[string]Scene) []relayAction {
+	if s.Action != SceneAction {
+		return []relayAction{{relay: s.Relay, action: s.Action}}
+	}
+	sc, ok := scenes[s.Scene]
+	if !ok {
+		return nil
+	}
+	ret := []relayAction{}
+	var offset time.Duration
+	for _, st := range sc.plan() {
+		offset += time.Duration(st.Delay)
+		ret = append(ret, relayAction{relay: st.Relay, action: sc.Relays[st.Relay], offset: offset})
+	}
+	return ret
+}
+
+// FindConflicts walks every firing of the given schedules between from and
+// from+horizon and reports the schedules that collide on a relay.  Scenes are
+// looked up in scenes.  Repeated collisions between the same schedules are
+// folded into a single Conflict carrying the first occurrence.
+func FindConflicts(schedules []Schedule, scenes map[string]Scene, from time.Time, horizon time.Duration) ([]Conflict, error) {
+	start := from.Truncate(time.Minute)
+	end := from.Add(horizon)
+	slots := make(map[conflictSlot][]slotEntry)
+	for _, s := range schedules {
+		sch, err := cron.ParseStandard(s.Expression)
+		if err != nil {
+			return nil, err
+		}
+		actions := s.relayActions(scenes)
+		last := make(map[uint8]time.Time)
+		t := sch.Next(start.Add(-time.Second))
+		for i := 0; i < maxOccurrences && !t.IsZero() && !t.After(end); i++ {
+			for _, a := range actions {
+				minute := t.Add(a.offset).Truncate(time.Minute)
+				if !minute.Equal(last[a.relay]) {
+					k := conflictSlot{relay: a.relay, at: minute}
+					slots[k] = append(slots[k], slotEntry{schedule: s, action: a.action})
+					last[a.relay] = minute
+				}
+			}
+			t = sch.Next(t)
+		}
+	}
+
+	found := make(map[string]*Conflict)
+	for k, v := range slots {
+		if len(v) < 2 {
+			continue
+		}
+		c := newConflict(k, v)
+		key := string(c.Kind) + "|" + strings.Join(c.Schedules, ",")
+		if existing, ok := found[key]; ok {
+			existing.Occurrences++
+			if c.At.Before(existing.At) {
+				existing.At = c.At
+			}
+			continue
+		}
+		found[key] = &c
+	}
+
+	ret := []Conflict{}
+	for _, c := range found {
+		ret = append(ret, *c)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if !ret[i].At.Equal(ret[j].At) {
+			return ret[i].At.Before(ret[j].At)
+		}
+		return ret[i].Relay < ret[j].Relay
+	})
+	return ret, nil
+}
+
+func newConflict(slot conflictSlot, entries []slotEntry) Conflict {
+	c := Conflict{
+		Kind:        Overlapping,
+		Relay:       slot.relay,
+		At:          slot.at,
+		Occurrences: 1,
+	}
+	schedules := []Schedule{}
+	for _, e := range entries {
+		c.Schedules = append(c.Schedules, e.schedule.ID)
+		schedules = append(schedules, e.schedule)
+		if e.action != entries[0].action {
+			c.Kind = Contradictory
+		}
+	}
+	sort.Strings(c.Schedules)
+	if w, ok := highestPriority(schedules); ok {
+		c.Resolved = true
+		c.Winner = w.ID
+	}
+	return c
+}
+
+// highestPriority returns the schedule with the strictly highest priority
+func highestPriority(schedules []Schedule) (Schedule, bool) {
+	var best Schedule
+	unique := false
+	for i, s := range schedules {
+		switch {
+		case i == 0 || s.Priority > best.Priority:
+			best = s
+			unique = true
+		case s.Priority == best.Priority:
+			unique = false
+		}
+	}
+	return best, unique
+}
+
+// OutrankedBy returns the higher priority schedule, if any, that switches a
+// relay s switches to a different action during the same minute, when s fires
+// at at.  A scene schedule yields if any relay of the scene is outranked.
+func OutrankedBy(s Schedule, peers []Schedule, scenes map[string]Scene, at time.Time) (Schedule, bool) {
+	for _, a := range s.relayActions(scenes) {
+		minute := at.Add(a.offset).Truncate(time.Minute)
+		for _, p := range peers {
+			if p.ID == s.ID || p.Priority <= s.Priority {
+				continue
+			}
+			sch, err := cron.ParseStandard(p.Expression)
+			if err != nil {
+				continue
+			}
+			for _, pa := range p.relayActions(scenes) {
+				if pa.relay != a.relay || pa.action == a.action {
+					continue
+				}
+				next := sch.Next(minute.Add(-pa.offset).Add(-time.Second))
+				if !next.IsZero() && next.Add(pa.offset).Before(minute.Add(time.Minute)) {
+					return p, true
+				}
+			}
+		}
+	}
+	return Schedule{}, false
+}
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFindConflicts(t *testing.T) {
+	from := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	at := func(h, m int) time.Time { return from.Add(time.Duration(h)*time.Hour + time.Duration(m)*time.Minute) }
+	scenes := map[string]Scene{
+		"spa": {
+			Relays: map[uint8]Action{1: On, 2: On},
+			Steps:  []SceneStep{{Relay: 1}, {Relay: 2, Delay: Duration(5 * time.Minute)}},
+		},
+	}
+	tests := []struct {
+		name      string
+		schedules []Schedule
+		want      []Conflict
+		wantErr   bool
+	}{
+		{
+			name: "different minutes",
+			schedules: []Schedule{
+				{ID: "a", Relay: 1, Expression: "0 8 * * *", Action: On},
+				{ID: "b", Relay: 1, Expression: "1 8 * * *", Action: Off},
+			},
+			want: []Conflict{},
+		},
+		{
+			name: "different relays",
+			schedules: []Schedule{
+				{ID: "a", Relay: 1, Expression: "0 8 * * *", Action: On},
+				{ID: "b", Relay: 2, Expression: "0 8 * * *", Action: Off},
+			},
+			want: []Conflict{},
+		},
+		{
+			name: "contradictory",
+			schedules: []Schedule{
+				{ID: "b", Relay: 1, Expression: "0 8 * * *", Action: Off},
+				{ID: "a", Relay: 1, Expression: "0 8 * * *", Action: On},
+			},
+			want: []Conflict{
+				{Kind: Contradictory, Relay: 1, At: at(8, 0), Occurrences: 2, Schedules: []string{"a", "b"}},
+			},
+		},
+		{
+			name: "resolved by priority",
+			schedules: []Schedule{
+				{ID: "a", Relay: 1, Expression: "0 8 * * *", Action: On},
+				{ID: "b", Relay: 1, Expression: "0 8 * * *", Action: Off, Priority: 1},
+			},
+			want: []Conflict{
+				{Kind: Contradictory, Relay: 1, At: at(8, 0), Occurrences: 2, Schedules: []string{"a", "b"}, Resolved: true, Winner: "b"},
+			},
+		},
+		{
+			name: "overlapping",
+			schedules: []Schedule{
+				{ID: "a", Relay: 1, Expression: "0 8 * * *", Action: On},
+				{ID: "b", Relay: 1, Expression: "0 8 * * 1", Action: On},
+			},
+			want: []Conflict{
+				{Kind: Overlapping, Relay: 1, At: at(8, 0), Occurrences: 1, Schedules: []string{"a", "b"}},
+			},
+		},
+		{
+			name: "scene step after its delay",
+			schedules: []Schedule{
+				{ID: "a", Expression: "0 8 * * *", Action: SceneAction, Scene: "spa"},
+				{ID: "b", Relay: 2, Expression: "5 8 * * *", Action: Off},
+			},
+			want: []Conflict{
+				{Kind: Contradictory, Relay: 2, At: at(8, 5), Occurrences: 2, Schedules: []string{"a", "b"}},
+			},
+		},
+		{
+			name: "scene step delayed out of the minute",
+			schedules: []Schedule{
+				{ID: "a", Expression: "0 8 * * *", Action: SceneAction, Scene: "spa"},
+				{ID: "b", Relay: 2, Expression: "0 8 * * *", Action: Off},
+			},
+			want: []Conflict{},
+		},
+		{
+			name: "missing scene",
+			schedules: []Schedule{
+				{ID: "a", Expression: "0 8 * * *", Action: SceneAction, Scene: "nope"},
+				{ID: "b", Relay: 1, Expression: "0 8 * * *", Action: Off},
+			},
+			want: []Conflict{},
+		},
+		{
+			name: "invalid expression",
+			schedules: []Schedule{
+				{ID: "a", Relay: 1, Expression: "bad", Action: On},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FindConflicts(tt.schedules, scenes, from, 48*time.Hour)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
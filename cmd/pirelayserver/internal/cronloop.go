@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// cronLoop runs jobs on cron schedules.  It waits on a Clock rather than the
+// system clock, so the scheduler runs the same way under the simulator as it
+// does for real.  Each job runs in its own goroutine, as with robfig/cron.
+type cronLoop struct {
+	clock   Clock
+	entries map[cron.EntryID]*cronEntry
+	lastID  cron.EntryID
+	running bool
+	m       sync.Mutex
+}
+
+type cronEntry struct {
+	schedule cron.Schedule
+	job      func()
+	next     time.Time
+	timer    Timer
+	// armed tells the current wait apart from stale ones, whose calls may
+	// already be on their way when the timer is stopped
+	armed int
+}
+
+func newCronLoop(clock Clock) *cronLoop {
+	return &cronLoop{
+		clock:   clock,
+		entries: make(map[cron.EntryID]*cronEntry),
+	}
+}
+
+// Schedule adds a job that runs whenever spec is due
+func (c *cronLoop) Schedule(spec cron.Schedule, job func()) cron.EntryID {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.lastID++
+	e := &cronEntry{schedule: spec, job: job}
+	c.entries[c.lastID] = e
+	if c.running {
+		c.arm(e, c.clock.Now())
+	}
+	return c.lastID
+}
+
+// AddFunc adds a job that runs on a standard cron expression or descriptor
+func (c *cronLoop) AddFunc(spec string, job func()) (cron.EntryID, error) {
+	sch, err := cron.ParseStandard(spec)
+	if err != nil {
+		return 0, err
+	}
+	return c.Schedule(sch, job), nil
+}
+
+// RemoveAll drops every job
+func (c *cronLoop) RemoveAll() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	for id, e := range c.entries {
+		c.disarm(e)
+		delete(c.entries, id)
+	}
+}
+
+// Next returns when the given job is next due
+func (c *cronLoop) Next(id cron.EntryID) (time.Time, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	e, ok := c.entries[id]
+	if !ok || !c.running || e.next.IsZero() {
+		return time.Time{}, false
+	}
+	return e.next, true
+}
+
+// Start runs the jobs as they become due
+func (c *cronLoop) Start() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.running {
+		return
+	}
+	c.running = true
+	now := c.clock.Now()
+	for _, e := range c.entries {
+		c.arm(e, now)
+	}
+}
+
+// Stop keeps any more jobs from running.  Jobs already running are left to
+// finish.
+func (c *cronLoop) Stop() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.running = false
+	for _, e := range c.entries {
+		c.disarm(e)
+	}
+}
+
+// arm waits for the next time e is due after now
+func (c *cronLoop) arm(e *cronEntry, now time.Time) {
+	c.disarm(e)
+	e.next = e.schedule.Next(now)
+	if !e.next.IsZero() {
+		c.wait(e)
+	}
+}
+
+func (c *cronLoop) wait(e *cronEntry) {
+	armed := e.armed
+	e.timer = c.clock.AfterFunc(e.next.Sub(c.clock.Now()), func() { c.fire(e, armed) })
+}
+
+func (c *cronLoop) disarm(e *cronEntry) {
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+	e.timer = nil
+	e.next = time.Time{}
+	e.armed++
+}
+
+func (c *cronLoop) fire(e *cronEntry, armed int) {
+	c.m.Lock()
+	if !c.running || e.armed != armed {
+		c.m.Unlock()
+		return
+	}
+	now := c.clock.Now()
+	if now.Before(e.next) {
+		// The clock was set back while waiting
+		c.wait(e)
+		c.m.Unlock()
+		return
+	}
+	c.arm(e, now)
+	c.m.Unlock()
+	e.job()
+}
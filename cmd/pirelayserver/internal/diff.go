@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// diffContext is how many unchanged lines are shown around each change
+const diffContext = 3
+
+// JSONDiff returns a unified diff of the indented JSON of a and b, labelled
+// with the given names.  Object keys are sorted first so that only real
+// changes show up.  It returns an empty string when they are equal.
+func JSONDiff(aName, bName string, a, b []byte) (string, error) {
+	al, err := jsonLines(a)
+	if err != nil {
+		return "", err
+	}
+	bl, err := jsonLines(b)
+	if err != nil {
+		return "", err
+	}
+	return unifiedDiff(aName, bName, al, bl), nil
+}
+
+func jsonLines(dat []byte) ([]string, error) {
+	if len(dat) == 0 {
+		return nil, nil
+	}
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(dat))
+	d.UseNumber()
+	err := d.Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(b), "\n"), nil
+}
+
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// diffLines computes a line diff of a and b from their longest common
+// subsequence.  Configs are small enough that the quadratic table is fine.
+func diffLines(a, b []string) []diffOp {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	ops := []diffOp{}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		ops = append(ops, diffOp{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		ops = append(ops, diffOp{'+', b[j]})
+	}
+	return ops
+}
+
+func unifiedDiff(aName, bName string, a, b []string) string {
+	ops := diffLines(a, b)
+	var sb strings.Builder
+	// Line numbers of each op in a and b
+	ai := make([]int, len(ops)+1)
+	bi := make([]int, len(ops)+1)
+	for k, op := range ops {
+		ai[k+1], bi[k+1] = ai[k], bi[k]
+		if op.kind != '+' {
+			ai[k+1]++
+		}
+		if op.kind != '-' {
+			bi[k+1]++
+		}
+	}
+	for k := 0; k < len(ops); {
+		if ops[k].kind == ' ' {
+			k++
+			continue
+		}
+		// Extend the hunk until changes are more than twice the context apart
+		start := k - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := k
+		for n := k; n < len(ops) && n-end <= 2*diffContext; n++ {
+			if ops[n].kind != ' ' {
+				end = n
+			}
+		}
+		end += diffContext + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+		if sb.Len() == 0 {
+			fmt.Fprintf(&sb, "--- %v\n+++ %v\n", aName, bName)
+		}
+		fmt.Fprintf(&sb, "@@ -%v,%v +%v,%v @@\n", ai[start]+1, ai[end]-ai[start], bi[start]+1, bi[end]-bi[start])
+		for _, op := range ops[start:end] {
+			fmt.Fprintf(&sb, "%c%v\n", op.kind, op.line)
+		}
+		k = end
+	}
+	return sb.String()
+}
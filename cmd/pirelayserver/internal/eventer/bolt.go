@@ -0,0 +1,222 @@
+package eventer
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal/hub"
+)
+
+var eventsBucket = []byte("events")
+
+// BoltEventer is an Eventer backed by a bbolt database.  Each event is its own
+// key, so recording one doesn't rewrite the others.
+type BoltEventer struct {
+	db *bolt.DB
+	r  Retention
+	h  *hub.Hub
+	// ret mirrors the stored events; m serializes the writes that change it
+	ret *retainer
+	m   sync.Mutex
+}
+
+// WithBoltEventer keeps events in db.  The first time it is used with a
+// database, the events in importFile (a JSON Lines or CSV event log) are
+// imported, if it exists.  Events beyond retention are expired as the log is
+// opened.  Recorded events are published to h.
+func WithBoltEventer(db *bolt.DB, r Retention, importFile string, h *hub.Hub) (Eventer, error) {
+	el := &BoltEventer{
+		db: db,
+		r:  r,
+		h:  h,
+	}
+	var created bool
+	err := db.Update(func(tx *bolt.Tx) error {
+		created = tx.Bucket(eventsBucket) == nil
+		_, err := tx.CreateBucketIfNotExists(eventsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = el.load()
+	if err != nil {
+		return nil, err
+	}
+	if created && importFile != "" {
+		err = el.importFile(importFile)
+	} else {
+		err = el.store(nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return el, nil
+}
+
+// load rebuilds ret from the stored events
+func (l *BoltEventer) load() error {
+	l.ret = newRetainer(l.r)
+	return l.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(eventsBucket).ForEach(func(k, v []byte) error {
+			e, err := decodeEvent(k, v)
+			if err != nil {
+				return err
+			}
+			l.ret.add(e, int64(len(v)))
+			return nil
+		})
+	})
+}
+
+// importFile copies the events of an event log file into the database
+func (l *BoltEventer) importFile(filename string) error {
+	events, err := ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = l.store(events)
+	if err != nil {
+		return err
+	}
+	return l.Event(Event{
+		Type: TypeStorage,
+		Msg:  fmt.Sprintf("Imported %v events from %v", len(events), filename),
+	})
+}
+
+// store adds events under the next sequence numbers, then deletes the events
+// beyond retention, archiving them first if an archive is kept.  The stored
+// events are published once committed.
+func (l *BoltEventer) store(events []Event) error {
+	l.m.Lock()
+	defer l.m.Unlock()
+	stored := make([]Event, len(events))
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(eventsBucket)
+		for i, e := range events {
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			e.ID = seq
+			stored[i] = e
+			dat, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			err = b.Put(eventKey(seq), dat)
+			if err != nil {
+				return err
+			}
+			l.ret.add(e, int64(len(dat)))
+		}
+
+		ids := l.ret.expire(time.Now())
+		if l.r.ArchiveDir != "" && len(ids) > 0 {
+			expired := []Event{}
+			for _, id := range ids {
+				e, err := decodeEvent(eventKey(id), b.Get(eventKey(id)))
+				if err != nil {
+					return err
+				}
+				expired = append(expired, e)
+			}
+			err := archive(l.r.ArchiveDir, expired)
+			if err != nil {
+				return err
+			}
+		}
+		for _, id := range ids {
+			err := b.Delete(eventKey(id))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// The transaction was rolled back, so ret no longer matches the
+		// database
+		if lerr := l.load(); lerr != nil {
+			return lerr
+		}
+		return err
+	}
+	for _, e := range stored {
+		l.h.Publish(hub.TopicEvent, e)
+	}
+	return nil
+}
+
+func (l *BoltEventer) Event(e Event) error {
+	return l.store([]Event{e.Fill(time.Now())})
+}
+
+func (l *BoltEventer) ListAll() ([]Event, error) {
+	ret := []Event{}
+	err := l.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(eventsBucket).ForEach(func(k, v []byte) error {
+			e, err := decodeEvent(k, v)
+			if err != nil {
+				return err
+			}
+			ret = append(ret, e)
+			return nil
+		})
+	})
+	return ret, err
+}
+
+// Query walks the events backwards from the cursor, so a page only reads as
+// many events as it needs
+func (l *BoltEventer) Query(q Query) (Page, error) {
+	p := Page{Events: []Event{}}
+	err := l.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(eventsBucket).Cursor()
+		k, v := c.Last()
+		if q.Before != 0 {
+			k, v = c.Seek(eventKey(q.Before))
+			if k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		}
+		for ; k != nil; k, v = c.Prev() {
+			e, err := decodeEvent(k, v)
+			if err != nil {
+				return err
+			}
+			if q.Matches(e) && !p.add(q, e) {
+				break
+			}
+		}
+		return nil
+	})
+	return p, err
+}
+
+func eventKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+// decodeEvent reads a stored event.  Its ID is its key, as events stored by
+// older releases don't include it.
+func decodeEvent(k, v []byte) (Event, error) {
+	var e Event
+	err := json.Unmarshal(v, &e)
+	e.ID = binary.BigEndian.Uint64(k)
+	return e, err
+}
@@ -1,15 +1,152 @@
 package eventer
 
 import (
+	"fmt"
+	"strings"
 	"time"
 )
 
+// Type classifies an event
+type Type string
+
+const (
+	TypeBoot     Type = "boot"
+	TypeShutdown Type = "shutdown"
+	// TypeRelayOn and TypeRelayOff are recorded whenever a relay is switched,
+	// even if it was already in that state
+	TypeRelayOn         Type = "relay_on"
+	TypeRelayOff        Type = "relay_off"
+	TypeSequence        Type = "sequence"
+	TypeScene           Type = "scene"
+	TypeScheduleFired   Type = "schedule_fired"
+	TypeScheduleSkipped Type = "schedule_skipped"
+	TypeScheduleMissed  Type = "schedule_missed"
+	TypeScheduleFailed  Type = "schedule_failed"
+	TypeProfile         Type = "profile_changed"
+	TypeAway            Type = "away"
+	TypeRuleFired       Type = "rule_fired"
+	TypeRuleSkipped     Type = "rule_skipped"
+	TypeRuleFailed      Type = "rule_failed"
+	TypeNotification    Type = "notification"
+	TypeConfigChanged   Type = "config_changed"
+	TypeConfigError     Type = "config_error"
+	TypeAuth            Type = "auth"
+	// TypeStorage covers housekeeping of the event log itself
+	TypeStorage Type = "storage"
+)
+
+// Types lists every type of event
+var Types = []Type{
+	TypeBoot,
+	TypeShutdown,
+	TypeRelayOn,
+	TypeRelayOff,
+	TypeSequence,
+	TypeScene,
+	TypeScheduleFired,
+	TypeScheduleSkipped,
+	TypeScheduleMissed,
+	TypeScheduleFailed,
+	TypeProfile,
+	TypeAway,
+	TypeRuleFired,
+	TypeRuleSkipped,
+	TypeRuleFailed,
+	TypeNotification,
+	TypeConfigChanged,
+	TypeConfigError,
+	TypeAuth,
+	TypeStorage,
+}
+
+// Event is a single entry in the event log.  Only Type is required; the other
+// fields are filled in where they apply.
 type Event struct {
+	// ID orders the events of a log; it is assigned by the Eventer
+	ID    uint64    `csv:"-" json:"id,omitempty"`
 	Stamp time.Time `csv:"stamp" json:"stamp"`
-	Msg   string    `csv:"msg" json:"msg"`
+	Type  Type      `csv:"type" json:"type,omitempty"`
+	// Relay is the relay the event is about, if any
+	Relay uint8 `csv:"relay" json:"relay,omitempty"`
+	// Name is the name of the relay, schedule, scene or rule the event is
+	// about
+	Name string `csv:"name" json:"name,omitempty"`
+	// Actor is who made the change: a JWT subject, or a part of the service
+	// such as the scheduler
+	Actor string `csv:"actor" json:"actor,omitempty"`
+	// Cause is why the change was made, e.g. "manual toggle"
+	Cause    string `csv:"cause" json:"cause,omitempty"`
+	OldState string `csv:"oldState" json:"oldState,omitempty"`
+	NewState string `csv:"newState" json:"newState,omitempty"`
+	// Msg is the human readable description.  It is derived from the other
+	// fields when it isn't given.
+	Msg string `csv:"msg" json:"msg"`
+}
+
+// Fill stamps the event with now if it has no stamp, and derives its message
+// if it has none
+func (e Event) Fill(now time.Time) Event {
+	if e.Stamp.IsZero() {
+		e.Stamp = now
+	}
+	if e.Msg == "" {
+		e.Msg = e.Message()
+	}
+	return e
+}
+
+// Message describes the event from its fields
+func (e Event) Message() string {
+	var b strings.Builder
+	if e.Type == TypeScheduleFailed {
+		b.WriteString("ALERT: ")
+	}
+	switch e.Type {
+	case TypeRelayOn, TypeRelayOff:
+		fmt.Fprintf(&b, "Switched %v %v", e.subject(), e.NewState)
+		if e.OldState == e.NewState {
+			b.WriteString(" (already " + e.OldState + ")")
+		}
+	default:
+		t := strings.ReplaceAll(string(e.Type), "_", " ")
+		if t == "" {
+			t = "event"
+		}
+		b.WriteString(strings.ToUpper(t[:1]) + t[1:])
+		if e.Name != "" || e.Relay != 0 {
+			b.WriteString(" " + e.subject())
+		}
+		switch {
+		case e.OldState != "":
+			fmt.Fprintf(&b, " from %v to %v", e.OldState, e.NewState)
+		case e.NewState != "":
+			b.WriteString(" " + e.NewState)
+		}
+	}
+	if e.Cause != "" {
+		b.WriteString(", cause: " + e.Cause)
+	}
+	if e.Actor != "" {
+		b.WriteString(" by " + e.Actor)
+	}
+	return b.String()
+}
+
+// subject names what the event is about, e.g. "'Pump' (relay 1)"
+func (e Event) subject() string {
+	switch {
+	case e.Name != "" && e.Relay != 0:
+		return fmt.Sprintf("'%v' (relay %v)", e.Name, e.Relay)
+	case e.Relay != 0:
+		return fmt.Sprintf("relay %v", e.Relay)
+	}
+	return fmt.Sprintf("'%v'", e.Name)
 }
 
 type Eventer interface {
-	Event(msg string) error
+	// Event records e, stamping it and deriving its message if needed
+	Event(e Event) error
 	ListAll() ([]Event, error)
+	// Query returns the events selected by q, newest first
+	Query(q Query) (Page, error)
 }
@@ -0,0 +1,384 @@
+package eventer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal/hub"
+)
+
+// SyncPolicy decides when appended events are flushed to disk
+type SyncPolicy string
+
+const (
+	// SyncAlways fsyncs after every event
+	SyncAlways SyncPolicy = "always"
+	// SyncInterval fsyncs in the background, at most once every syncInterval
+	SyncInterval SyncPolicy = "interval"
+	// SyncNever leaves flushing to the operating system
+	SyncNever SyncPolicy = "never"
+)
+
+const syncInterval = time.Second
+
+// ParseSyncPolicy checks the name of a SyncPolicy
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch p := SyncPolicy(s); p {
+	case SyncAlways, SyncInterval, SyncNever:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown fsync policy %q, must be %v, %v or %v", s, SyncAlways, SyncInterval, SyncNever)
+}
+
+// JSONLEventer is an Eventer backed by a JSON Lines file.  Each event is
+// appended as a line of its own, so recording one never rewrites the others.
+// Expired events are dropped from memory straight away, and from the file
+// once it holds twice as many events as are kept, by compacting it.  The last
+// ID handed out is kept alongside the file when it is compacted, so that IDs
+// aren't reused once the events that carried them are gone.
+type JSONLEventer struct {
+	filename string
+	policy   SyncPolicy
+	f        *os.File
+	events   []Event
+	ret      *retainer
+	// pending are expired events that are still in the file, waiting to be
+	// archived when it is compacted
+	pending []Event
+	// lines is the number of events in the file, which may be more than are
+	// kept in memory
+	lines  int
+	lastID uint64
+	dirty  bool
+	h      *hub.Hub
+	done   chan struct{}
+	m      sync.Mutex
+}
+
+// WithJSONLEventer opens the event log in filename.  A partially written last
+// line, as left by a crash or power loss, is dropped.  When the log is first
+// created, the events in importFile (the CSV event log of older releases) are
+// imported, if it exists.  Events beyond retention are expired as the log is
+// opened.  Recorded events are published to h.
+func WithJSONLEventer(filename string, r Retention, policy SyncPolicy, importFile string, h *hub.Hub) (*JSONLEventer, error) {
+	l := &JSONLEventer{
+		filename: filename,
+		policy:   policy,
+		ret:      newRetainer(r),
+		h:        h,
+		done:     make(chan struct{}),
+	}
+	notes := []string{}
+
+	events, size, err := readJSONL(filename)
+	created := os.IsNotExist(err)
+	if err != nil && !created {
+		return nil, err
+	}
+	if !created {
+		fi, err := os.Stat(filename)
+		if err != nil {
+			return nil, err
+		}
+		if fi.Size() > size {
+			err = os.Truncate(filename, size)
+			if err != nil {
+				return nil, err
+			}
+			notes = append(notes, fmt.Sprintf("Dropped a partially written event at the end of %v", filename))
+		}
+	}
+	if created && importFile != "" {
+		imported, err := readCSV(importFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			events = imported
+			notes = append(notes, fmt.Sprintf("Imported %v events from %v", len(imported), importFile))
+		}
+	}
+	// Events of older releases have no ID
+	for i := range events {
+		if events[i].ID <= l.lastID {
+			events[i].ID = l.lastID + 1
+		}
+		l.lastID = events[i].ID
+		dat, err := json.Marshal(events[i])
+		if err != nil {
+			return nil, err
+		}
+		l.ret.add(events[i], int64(len(dat)+1))
+	}
+	seq, err := readSeq(seqFile(filename))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if seq > l.lastID {
+		l.lastID = seq
+	}
+	l.events = events
+	l.lines = len(events)
+	l.expire(time.Now())
+
+	if created {
+		// Write the file in one go, including any imported events
+		err = l.compact()
+	} else {
+		l.f, err = os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0644)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if policy == SyncInterval {
+		go l.syncLoop()
+	}
+	for _, n := range notes {
+		err = l.Event(Event{Type: TypeStorage, Msg: n})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// readJSONL reads the events in a JSON Lines file.  It returns the size of the
+// part of the file that holds whole events; a last line that was only
+// partially written is left out.
+func readJSONL(filename string) ([]Event, int64, error) {
+	dat, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	events := []Event{}
+	var size int64
+	for n := 1; ; n++ {
+		i := bytes.IndexByte(dat, '\n')
+		if i < 0 {
+			// No newline, so the line was never finished
+			break
+		}
+		line := bytes.TrimSpace(dat[:i])
+		if len(line) > 0 {
+			var e Event
+			err := json.Unmarshal(line, &e)
+			if err != nil {
+				if bytes.IndexByte(dat[i+1:], '\n') < 0 {
+					// The last line can hold garbage if the write was torn
+					break
+				}
+				return nil, 0, fmt.Errorf("%v:%v: %v", filename, n, err)
+			}
+			events = append(events, e)
+		}
+		size += int64(i + 1)
+		dat = dat[i+1:]
+	}
+	return events, size, nil
+}
+
+// seqFile names the file that keeps the last ID handed out by the event log
+// in filename
+func seqFile(filename string) string {
+	return filename + ".seq"
+}
+
+func readSeq(filename string) (uint64, error) {
+	dat, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	seq, err := strconv.ParseUint(string(bytes.TrimSpace(dat)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%v: %v", filename, err)
+	}
+	return seq, nil
+}
+
+// ReadFile reads the events in an event log file, either JSON Lines or, if
+// its name ends in .csv, the CSV format of older releases
+func ReadFile(filename string) ([]Event, error) {
+	if strings.EqualFold(filepath.Ext(filename), ".csv") {
+		return readCSV(filename)
+	}
+	events, _, err := readJSONL(filename)
+	return events, err
+}
+
+// expire drops the events beyond retention from memory
+func (l *JSONLEventer) expire(now time.Time) {
+	var expired []Event
+	l.events, expired = removeEvents(l.events, l.ret.expire(now))
+	if l.ret.r.ArchiveDir != "" {
+		l.pending = append(l.pending, expired...)
+	}
+}
+
+func (l *JSONLEventer) Event(e Event) error {
+	e = e.Fill(time.Now())
+	l.m.Lock()
+	defer l.m.Unlock()
+	e.ID = l.lastID + 1
+	dat, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	l.lastID = e.ID
+	l.events = append(l.events, e)
+	l.ret.add(e, int64(len(dat)+1))
+	l.expire(time.Now())
+	err = l.write(dat)
+	if err != nil {
+		return err
+	}
+	l.h.Publish(hub.TopicEvent, e)
+	return nil
+}
+
+// write appends an encoded event to the file, or compacts the file if it has
+// grown enough, which writes the event along with the others
+func (l *JSONLEventer) write(dat []byte) error {
+	if l.lines >= 2*len(l.events) {
+		return l.compact()
+	}
+	_, err := l.f.Write(append(dat, '\n'))
+	if err != nil {
+		return err
+	}
+	l.lines++
+	switch l.policy {
+	case SyncAlways:
+		return l.f.Sync()
+	case SyncInterval:
+		l.dirty = true
+	}
+	return nil
+}
+
+// compact archives the expired events, then replaces the file with the events
+// kept in memory.  The new file is written alongside and renamed over the old
+// one, so a crash leaves one or the other.
+func (l *JSONLEventer) compact() error {
+	if len(l.pending) > 0 {
+		err := archive(l.ret.r.ArchiveDir, l.pending)
+		if err != nil {
+			return err
+		}
+		l.pending = nil
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range l.events {
+		err := enc.Encode(e)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The last ID goes first, so it is never behind the events that were
+	// dropped
+	err := replaceFile(seqFile(l.filename), []byte(strconv.FormatUint(l.lastID, 10)+"\n"))
+	if err != nil {
+		return err
+	}
+	err = replaceFile(l.filename, buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	if l.f != nil {
+		l.f.Close()
+	}
+	l.f, err = os.OpenFile(l.filename, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.lines = len(l.events)
+	l.dirty = false
+	return nil
+}
+
+// replaceFile writes dat to a file alongside filename and renames it over
+// filename, so a crash leaves one or the other
+func replaceFile(filename string, dat []byte) error {
+	dir := filepath.Dir(filename)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(dat)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		return err
+	}
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+func (l *JSONLEventer) syncLoop() {
+	t := time.NewTicker(syncInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-t.C:
+			l.m.Lock()
+			if l.dirty {
+				l.f.Sync()
+				l.dirty = false
+			}
+			l.m.Unlock()
+		}
+	}
+}
+
+// Close flushes the log to disk and closes it
+func (l *JSONLEventer) Close() error {
+	close(l.done)
+	l.m.Lock()
+	defer l.m.Unlock()
+	err := l.f.Sync()
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (l *JSONLEventer) ListAll() ([]Event, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	ret := make([]Event, len(l.events))
+	copy(ret, l.events)
+	return ret, nil
+}
+
+func (l *JSONLEventer) Query(q Query) (Page, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return QuerySlice(l.events, q), nil
+}
@@ -0,0 +1,131 @@
+package eventer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestJSONLEventerKeepsLastIDWhenEmptied(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "events.jsonl")
+	// Every event expires as soon as it is recorded, so each one empties the
+	// log
+	r := Retention{MaxAge: time.Nanosecond}
+
+	l, err := WithJSONLEventer(filename, r, SyncNever, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		err = l.Event(Event{Type: TypeBoot})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Close()
+
+	l, err = WithJSONLEventer(filename, Retention{}, SyncNever, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	err = l.Event(Event{Type: TypeBoot})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, _ := l.ListAll()
+	if len(events) != 1 || events[0].ID != 4 {
+		t.Errorf("got %+v, want a single event with ID 4", events)
+	}
+}
+
+func TestReadJSONL(t *testing.T) {
+	const (
+		one = `{"type":"boot"}` + "\n"
+		two = `{"type":"shutdown"}` + "\n"
+	)
+	tests := []struct {
+		name      string
+		dat       string
+		wantTypes []Type
+		wantSize  int64
+		wantErr   bool
+	}{
+		{
+			name:      "empty",
+			wantTypes: []Type{},
+		},
+		{
+			name:      "complete",
+			dat:       one + two,
+			wantTypes: []Type{TypeBoot, TypeShutdown},
+			wantSize:  int64(len(one + two)),
+		},
+		{
+			name:      "blank lines",
+			dat:       one + "\n  \n" + two,
+			wantTypes: []Type{TypeBoot, TypeShutdown},
+			wantSize:  int64(len(one + "\n  \n" + two)),
+		},
+		{
+			name:      "unfinished last line",
+			dat:       one + `{"type":"shut`,
+			wantTypes: []Type{TypeBoot},
+			wantSize:  int64(len(one)),
+		},
+		{
+			name:      "whole last line without a newline",
+			dat:       one + `{"type":"shutdown"}`,
+			wantTypes: []Type{TypeBoot},
+			wantSize:  int64(len(one)),
+		},
+		{
+			name:      "garbage last line",
+			dat:       one + "\x00\x00\x00\n",
+			wantTypes: []Type{TypeBoot},
+			wantSize:  int64(len(one)),
+		},
+		{
+			name:    "garbage in the middle",
+			dat:     one + "\x00\x00\x00\n" + two,
+			wantErr: true,
+		},
+	}
+	dir, err := ioutil.TempDir("", "jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(dir, fmt.Sprintf("%v.jsonl", i))
+			err := ioutil.WriteFile(filename, []byte(tt.dat), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			events, size, err := readJSONL(filename)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			types := []Type{}
+			for _, e := range events {
+				types = append(types, e.Type)
+			}
+			if !reflect.DeepEqual(types, tt.wantTypes) || size != tt.wantSize {
+				t.Errorf("got %v size %v, want %v size %v", types, size, tt.wantTypes, tt.wantSize)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package eventer
+
+import (
+	"strings"
+	"time"
+)
+
+// Query selects events, newest first.  Zero fields match every event.
+type Query struct {
+	// Since and Until bound the event stamps; Since is inclusive and Until
+	// exclusive
+	Since time.Time
+	Until time.Time
+	Relay uint8
+	// Types matches events of any of the given types
+	Types []Type
+	Actor string
+	// Search matches events whose message contains it, ignoring case
+	Search string
+	// Limit caps the number of events returned, if positive
+	Limit int
+	// Before only matches events older than the one with this ID.  It is the
+	// Next of the previous page.
+	Before uint64
+}
+
+// Page is the result of a Query
+type Page struct {
+	Events []Event
+	// Next is the cursor of the following page, or zero if there are no more
+	// events
+	Next uint64
+}
+
+// Matches reports whether e satisfies every filter of q, apart from Before
+// and Limit
+func (q Query) Matches(e Event) bool {
+	if !q.Since.IsZero() && e.Stamp.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !e.Stamp.Before(q.Until) {
+		return false
+	}
+	if q.Relay != 0 && e.Relay != q.Relay {
+		return false
+	}
+	if len(q.Types) > 0 {
+		found := false
+		for _, t := range q.Types {
+			if t == e.Type {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.Actor != "" && e.Actor != q.Actor {
+		return false
+	}
+	if q.Search != "" && !strings.Contains(strings.ToLower(e.Msg), strings.ToLower(q.Search)) {
+		return false
+	}
+	return true
+}
+
+// add appends a matching event to the page.  Once the page is full it sets
+// Next instead and returns false.
+func (p *Page) add(q Query, e Event) bool {
+	if q.Limit > 0 && len(p.Events) == q.Limit {
+		p.Next = p.Events[len(p.Events)-1].ID
+		return false
+	}
+	p.Events = append(p.Events, e)
+	return true
+}
+
+// QuerySlice answers q from events held in memory, oldest first
+func QuerySlice(events []Event, q Query) Page {
+	p := Page{Events: []Event{}}
+	for i := len(events) - 1; i >= 0; i-- {
+		e := events[i]
+		if q.Before != 0 && e.ID >= q.Before {
+			continue
+		}
+		if q.Matches(e) && !p.add(q, e) {
+			break
+		}
+	}
+	return p
+}
@@ -0,0 +1,100 @@
+package eventer
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQuerySlice(t *testing.T) {
+	t0 := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	at := func(h int) time.Time { return t0.Add(time.Duration(h) * time.Hour) }
+	events := []Event{
+		{ID: 1, Stamp: at(0), Type: TypeBoot, Msg: "Service started"},
+		{ID: 2, Stamp: at(1), Type: TypeRelayOn, Relay: 1, Actor: "alice", Msg: "Switched 'Pump' (relay 1) on"},
+		{ID: 3, Stamp: at(2), Type: TypeRelayOff, Relay: 1, Actor: "scheduler", Msg: "Switched 'Pump' (relay 1) off"},
+		{ID: 4, Stamp: at(3), Type: TypeRelayOn, Relay: 2, Actor: "alice", Msg: "Switched 'Lights' (relay 2) on"},
+		{ID: 5, Stamp: at(4), Type: TypeScheduleFired, Relay: 2, Actor: "scheduler", Msg: "Schedule fired 'b' (relay 2) on"},
+		{ID: 6, Stamp: at(5), Type: TypeShutdown, Msg: "Service stopped"},
+	}
+	tests := []struct {
+		name     string
+		q        Query
+		wantIDs  []uint64
+		wantNext uint64
+	}{
+		{
+			name:    "everything, newest first",
+			wantIDs: []uint64{6, 5, 4, 3, 2, 1},
+		},
+		{
+			name:    "since is inclusive, until exclusive",
+			q:       Query{Since: at(1), Until: at(3)},
+			wantIDs: []uint64{3, 2},
+		},
+		{
+			name:    "relay",
+			q:       Query{Relay: 2},
+			wantIDs: []uint64{5, 4},
+		},
+		{
+			name:    "any of the types",
+			q:       Query{Types: []Type{TypeRelayOn, TypeBoot}},
+			wantIDs: []uint64{4, 2, 1},
+		},
+		{
+			name:    "actor",
+			q:       Query{Actor: "scheduler"},
+			wantIDs: []uint64{5, 3},
+		},
+		{
+			name:    "search ignores case",
+			q:       Query{Search: "PUMP"},
+			wantIDs: []uint64{3, 2},
+		},
+		{
+			name:    "filters combine",
+			q:       Query{Relay: 1, Actor: "alice"},
+			wantIDs: []uint64{2},
+		},
+		{
+			name:     "first page",
+			q:        Query{Limit: 2},
+			wantIDs:  []uint64{6, 5},
+			wantNext: 5,
+		},
+		{
+			name:     "following page",
+			q:        Query{Limit: 2, Before: 5},
+			wantIDs:  []uint64{4, 3},
+			wantNext: 3,
+		},
+		{
+			name:    "last page",
+			q:       Query{Limit: 2, Before: 3},
+			wantIDs: []uint64{2, 1},
+		},
+		{
+			name:    "page exactly filled by the last matches",
+			q:       Query{Relay: 1, Limit: 2},
+			wantIDs: []uint64{3, 2},
+		},
+		{
+			name:    "no matches",
+			q:       Query{Relay: 9},
+			wantIDs: []uint64{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := QuerySlice(events, tt.q)
+			ids := []uint64{}
+			for _, e := range p.Events {
+				ids = append(ids, e.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.wantIDs) || p.Next != tt.wantNext {
+				t.Errorf("got %v next %v, want %v next %v", ids, p.Next, tt.wantIDs, tt.wantNext)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package eventer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Retention decides how long events are kept.  Zero fields don't limit.
+// Events are expired oldest first, as new events are recorded.
+type Retention struct {
+	// MaxCount is the most events kept
+	MaxCount int
+	// MaxAge expires events older than this
+	MaxAge time.Duration
+	// MaxPerType is the most events kept of each of the given types
+	MaxPerType map[Type]int
+	// MaxBytes is the most space the encoded events may take
+	MaxBytes int64
+	// ArchiveDir, if set, is where expired events are kept instead of being
+	// discarded, in a compressed file per month such as
+	// events-2026-09.jsonl.gz
+	ArchiveDir string
+}
+
+// ParseTypeLimits parses per type limits such as "relay_on=500,relay_off=500"
+func ParseTypeLimits(s string) (map[Type]int, error) {
+	ret := make(map[Type]int)
+	if s == "" {
+		return ret, nil
+	}
+	for _, v := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(v), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid limit %q, must be type=count", v)
+		}
+		t := Type(parts[0])
+		found := false
+		for _, k := range Types {
+			if k == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown event type %q", t)
+		}
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid count %q for %v", parts[1], t)
+		}
+		ret[t] = n
+	}
+	return ret, nil
+}
+
+// heldEvent is what a retainer needs to know about an event
+type heldEvent struct {
+	id    uint64
+	stamp time.Time
+	typ   Type
+	size  int64
+}
+
+// retainer tracks the events a log holds, oldest first, so that retention
+// can be enforced as events are added without reading the log back
+type retainer struct {
+	r      Retention
+	held   []heldEvent
+	bytes  int64
+	byType map[Type]int
+}
+
+func newRetainer(r Retention) *retainer {
+	return &retainer{
+		r:      r,
+		byType: make(map[Type]int),
+	}
+}
+
+// add records an event appended to the log, taking size bytes
+func (t *retainer) add(e Event, size int64) {
+	t.held = append(t.held, heldEvent{id: e.ID, stamp: e.Stamp, typ: e.Type, size: size})
+	t.bytes += size
+	t.byType[e.Type]++
+}
+
+// expire forgets the events beyond retention and returns their IDs, oldest
+// first
+func (t *retainer) expire(now time.Time) []uint64 {
+	ids := []uint64{}
+	drop := func(i int) {
+		h := t.held[i]
+		ids = append(ids, h.id)
+		t.bytes -= h.size
+		t.byType[h.typ]--
+		t.held = append(t.held[:i], t.held[i+1:]...)
+	}
+	for len(t.held) > 0 {
+		h := t.held[0]
+		switch {
+		case t.r.MaxCount > 0 && len(t.held) > t.r.MaxCount,
+			t.r.MaxBytes > 0 && t.bytes > t.r.MaxBytes,
+			t.r.MaxAge > 0 && now.Sub(h.stamp) > t.r.MaxAge:
+			drop(0)
+			continue
+		}
+		break
+	}
+	for typ, max := range t.r.MaxPerType {
+		for i := 0; t.byType[typ] > max && i < len(t.held); {
+			if t.held[i].typ == typ {
+				drop(i)
+				continue
+			}
+			i++
+		}
+	}
+	// Per type limits can expire events out of order
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// removeEvents splits events, oldest first, into those kept and those whose
+// IDs are given, oldest first
+func removeEvents(events []Event, ids []uint64) ([]Event, []Event) {
+	if len(ids) == 0 {
+		return events, nil
+	}
+	// Usually the oldest events are the ones expiring
+	prefix := len(ids) <= len(events)
+	for i := 0; prefix && i < len(ids); i++ {
+		prefix = events[i].ID == ids[i]
+	}
+	if prefix {
+		return events[len(ids):], events[:len(ids):len(ids)]
+	}
+	drop := make(map[uint64]bool)
+	for _, id := range ids {
+		drop[id] = true
+	}
+	kept, removed := []Event{}, []Event{}
+	for _, e := range events {
+		if drop[e.ID] {
+			removed = append(removed, e)
+		} else {
+			kept = append(kept, e)
+		}
+	}
+	return kept, removed
+}
+
+// archive appends events to the monthly archive files in dir.  Each call adds
+// a gzip member to the end of the file, which gzip readers treat as one
+// stream, so nothing already archived is rewritten.
+func archive(dir string, events []Event) error {
+	months := []string{}
+	byMonth := make(map[string][]Event)
+	for _, e := range events {
+		m := e.Stamp.Format("2006-01")
+		if _, ok := byMonth[m]; !ok {
+			months = append(months, m)
+		}
+		byMonth[m] = append(byMonth[m], e)
+	}
+	for _, m := range months {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		enc := json.NewEncoder(zw)
+		for _, e := range byMonth[m] {
+			err := enc.Encode(e)
+			if err != nil {
+				return err
+			}
+		}
+		err := zw.Close()
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("events-%v.jsonl.gz", m)), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(buf.Bytes())
+		if err == nil {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
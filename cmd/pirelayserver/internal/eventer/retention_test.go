@@ -0,0 +1,113 @@
+package eventer
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetainerExpire(t *testing.T) {
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	// held describes an event by its type and age, each taking 100 bytes
+	type held struct {
+		typ Type
+		age time.Duration
+	}
+	fourHours := []held{
+		{TypeRelayOn, 3 * time.Hour},
+		{TypeRelayOff, 2 * time.Hour},
+		{TypeRelayOn, time.Hour},
+		{TypeRelayOff, 0},
+	}
+	tests := []struct {
+		name     string
+		r        Retention
+		events   []held
+		want     []uint64
+		wantKept []uint64
+	}{
+		{
+			name:     "no limits",
+			events:   fourHours,
+			want:     []uint64{},
+			wantKept: []uint64{1, 2, 3, 4},
+		},
+		{
+			name:     "max count",
+			r:        Retention{MaxCount: 2},
+			events:   fourHours,
+			want:     []uint64{1, 2},
+			wantKept: []uint64{3, 4},
+		},
+		{
+			name:     "max age",
+			r:        Retention{MaxAge: 90 * time.Minute},
+			events:   fourHours,
+			want:     []uint64{1, 2},
+			wantKept: []uint64{3, 4},
+		},
+		{
+			name:     "max bytes",
+			r:        Retention{MaxBytes: 250},
+			events:   fourHours,
+			want:     []uint64{1, 2},
+			wantKept: []uint64{3, 4},
+		},
+		{
+			name:     "max bytes exactly reached",
+			r:        Retention{MaxBytes: 400},
+			events:   fourHours,
+			want:     []uint64{},
+			wantKept: []uint64{1, 2, 3, 4},
+		},
+		{
+			name:     "max per type skips other types",
+			r:        Retention{MaxPerType: map[Type]int{TypeRelayOff: 1}},
+			events:   fourHours,
+			want:     []uint64{2},
+			wantKept: []uint64{1, 3, 4},
+		},
+		{
+			name:     "several types come back in order",
+			r:        Retention{MaxPerType: map[Type]int{TypeRelayOn: 1, TypeRelayOff: 1}},
+			events:   fourHours,
+			want:     []uint64{1, 2},
+			wantKept: []uint64{3, 4},
+		},
+		{
+			name: "limits combine",
+			r:    Retention{MaxCount: 3, MaxPerType: map[Type]int{TypeRelayOn: 1}},
+			events: []held{
+				{TypeRelayOn, 0},
+				{TypeRelayOff, 0},
+				{TypeRelayOn, 0},
+				{TypeRelayOff, 0},
+				{TypeRelayOn, 0},
+			},
+			want:     []uint64{1, 2, 3},
+			wantKept: []uint64{4, 5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := newRetainer(tt.r)
+			for i, h := range tt.events {
+				rt.add(Event{ID: uint64(i + 1), Stamp: now.Add(-h.age), Type: h.typ}, 100)
+			}
+			got := rt.expire(now)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			kept := []uint64{}
+			for _, h := range rt.held {
+				kept = append(kept, h.id)
+			}
+			if !reflect.DeepEqual(kept, tt.wantKept) {
+				t.Errorf("got kept %v, want %v", kept, tt.wantKept)
+			}
+			if got := rt.expire(now); len(got) != 0 {
+				t.Errorf("got %v expired again, want none", got)
+			}
+		})
+	}
+}
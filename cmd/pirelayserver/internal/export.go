@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ConfigSection names a part of the config that can be exported or imported
+// on its own
+type ConfigSection string
+
+const (
+	SectionSchedules  ConfigSection = "schedules"
+	SectionRelayNames ConfigSection = "relayNames"
+	// SectionProfiles includes the active profile override
+	SectionProfiles   ConfigSection = "profiles"
+	SectionAway       ConfigSection = "away"
+	SectionScenes     ConfigSection = "scenes"
+	SectionRules      ConfigSection = "rules"
+	SectionJitterSeed ConfigSection = "jitterSeed"
+	// SectionAPIKeys holds secrets, so it is only ever exported on request
+	SectionAPIKeys ConfigSection = "apiKeys"
+)
+
+// ConfigSections lists every section of the config
+var ConfigSections = []ConfigSection{
+	SectionSchedules,
+	SectionRelayNames,
+	SectionProfiles,
+	SectionAway,
+	SectionScenes,
+	SectionRules,
+	SectionJitterSeed,
+	SectionAPIKeys,
+}
+
+// ParseSections checks a list of section names.  An empty list means every
+// section.
+func ParseSections(names []string) ([]ConfigSection, error) {
+	if len(names) == 0 {
+		return ConfigSections, nil
+	}
+	ret := []ConfigSection{}
+	for _, v := range names {
+		sec := ConfigSection(strings.TrimSpace(v))
+		found := false
+		for _, k := range ConfigSections {
+			if k == sec {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown config section %q", sec)
+		}
+		ret = append(ret, sec)
+	}
+	return ret, nil
+}
+
+// copySection copies a single section of src into dst
+func copySection(dst *Config, src Config, sec ConfigSection) {
+	switch sec {
+	case SectionSchedules:
+		dst.Schedules = src.Schedules
+	case SectionRelayNames:
+		dst.RelayNames = src.RelayNames
+	case SectionProfiles:
+		dst.Profiles = src.Profiles
+		dst.ProfileOverride = src.ProfileOverride
+	case SectionAway:
+		dst.Away = src.Away
+	case SectionScenes:
+		dst.Scenes = src.Scenes
+	case SectionRules:
+		dst.Rules = src.Rules
+	case SectionJitterSeed:
+		dst.JitterSeed = src.JitterSeed
+	case SectionAPIKeys:
+		dst.APIKeys = src.APIKeys
+	}
+}
+
+// Export returns the given sections of the config, ready to be imported
+// elsewhere.  API keys are left out unless secrets is set.
+func (c Config) Export(sections []ConfigSection, secrets bool) Config {
+	ret := Config{Version: ConfigVersion}
+	for _, sec := range sections {
+		if sec == SectionAPIKeys && !secrets {
+			continue
+		}
+		copySection(&ret, c, sec)
+	}
+	return ret
+}
+
+// Import replaces the given sections of the config with those of in.  API
+// keys are only replaced when in has them, so that importing an export made
+// without secrets keeps the current keys.
+func (c Config) Import(in Config, sections []ConfigSection) (Config, error) {
+	ret, err := c.Clone()
+	if err != nil {
+		return ret, err
+	}
+	for _, sec := range sections {
+		if sec == SectionAPIKeys {
+			if in.APIKeys == nil {
+				continue
+			}
+			for sub, keys := range in.APIKeys {
+				for id, k := range keys {
+					if k.Key == "" {
+						return ret, fmt.Errorf("api key %v of %v has no secret, export with secrets to import api keys", id, sub)
+					}
+				}
+			}
+		}
+		copySection(&ret, in, sec)
+	}
+	return ret, nil
+}
@@ -0,0 +1,308 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// configFormat converts a config file to and from JSON, which is what the
+// rest of the configurer works with.  Field names are the same in every
+// format.
+type configFormat interface {
+	toJSON(dat []byte) ([]byte, error)
+	// fromJSON converts a JSON config to the format.  prev is the file being
+	// replaced, if any, so that its comments and layout can be kept.
+	fromJSON(dat, prev []byte) ([]byte, error)
+}
+
+// formatFor picks the format of a config file by its extension: .yaml or .yml
+// for YAML, .toml for TOML, and JSON otherwise
+func formatFor(filename string) configFormat {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		return yamlFormat{}
+	case ".toml":
+		return tomlFormat{}
+	}
+	return jsonFormat{}
+}
+
+// ReadConfigFile reads a config file in any format and returns it as JSON
+func ReadConfigFile(filename string) ([]byte, error) {
+	dat, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return formatFor(filename).toJSON(dat)
+}
+
+type jsonFormat struct{}
+
+func (jsonFormat) toJSON(dat []byte) ([]byte, error) {
+	return dat, nil
+}
+
+func (jsonFormat) fromJSON(dat, prev []byte) ([]byte, error) {
+	return dat, nil
+}
+
+// decodeJSON decodes JSON into plain values, keeping integers as int64 so
+// that they are written as numbers rather than strings or floats
+func decodeJSON(dat []byte) (interface{}, error) {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(dat))
+	d.UseNumber()
+	err := d.Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+	return plainNumbers(v), nil
+}
+
+func plainNumbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = plainNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = plainNumbers(e)
+		}
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			return n
+		}
+		f, _ := t.Float64()
+		return f
+	}
+	return v
+}
+
+type yamlFormat struct{}
+
+func (yamlFormat) toJSON(dat []byte) ([]byte, error) {
+	var v interface{}
+	err := yaml.Unmarshal(dat, &v)
+	if err != nil {
+		return nil, err
+	}
+	v, err = stringKeys(v)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		v = map[string]interface{}{}
+	}
+	return json.Marshal(v)
+}
+
+// stringKeys converts YAML mappings to JSON objects.  Keys like relay numbers
+// are written without quotes, so YAML reads them as numbers.
+func stringKeys(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			e, err := stringKeys(e)
+			if err != nil {
+				return nil, err
+			}
+			t[k] = e
+		}
+	case map[interface{}]interface{}:
+		ret := make(map[string]interface{})
+		for k, e := range t {
+			e, err := stringKeys(e)
+			if err != nil {
+				return nil, err
+			}
+			switch k.(type) {
+			case string, int, int64, uint64, bool:
+				ret[fmt.Sprint(k)] = e
+			default:
+				return nil, fmt.Errorf("unsupported key %v", k)
+			}
+		}
+		return ret, nil
+	case []interface{}:
+		for i, e := range t {
+			e, err := stringKeys(e)
+			if err != nil {
+				return nil, err
+			}
+			t[i] = e
+		}
+	}
+	return v, nil
+}
+
+var integerKey = regexp.MustCompile(`^(0|[1-9][0-9]*)$`)
+
+func (yamlFormat) fromJSON(dat, prev []byte) ([]byte, error) {
+	v, err := decodeJSON(dat)
+	if err != nil {
+		return nil, err
+	}
+	var n yaml.Node
+	err = n.Encode(dropNulls(v))
+	if err != nil {
+		return nil, err
+	}
+	unquoteIntegerKeys(&n)
+
+	doc := &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{&n}}
+	var old yaml.Node
+	if len(prev) > 0 && yaml.Unmarshal(prev, &old) == nil && old.Kind == yaml.DocumentNode && len(old.Content) == 1 {
+		keepComments(old.Content[0], &n)
+		doc.HeadComment = old.HeadComment
+		doc.FootComment = old.FootComment
+	}
+
+	var buf bytes.Buffer
+	e := yaml.NewEncoder(&buf)
+	e.SetIndent(2)
+	err = e.Encode(doc)
+	if err != nil {
+		return nil, err
+	}
+	err = e.Close()
+	return buf.Bytes(), err
+}
+
+// unquoteIntegerKeys writes keys such as relay numbers as plain numbers
+func unquoteIntegerKeys(n *yaml.Node) {
+	if n.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k := n.Content[i]
+			if k.Kind == yaml.ScalarNode && integerKey.MatchString(k.Value) {
+				k.Tag = "!!int"
+				k.Style = 0
+			}
+		}
+	}
+	for _, c := range n.Content {
+		unquoteIntegerKeys(c)
+	}
+}
+
+// keepComments copies the comments of old onto the matching nodes of n, and
+// puts the keys of n's mappings in the order they had in old.  List items
+// are matched by their id, if they have one, or else by position.
+func keepComments(old, n *yaml.Node) {
+	if old.Kind != n.Kind {
+		return
+	}
+	n.HeadComment = old.HeadComment
+	n.LineComment = old.LineComment
+	n.FootComment = old.FootComment
+
+	switch n.Kind {
+	case yaml.MappingNode:
+		oldPairs := make(map[string][2]*yaml.Node)
+		order := []string{}
+		for i := 0; i+1 < len(old.Content); i += 2 {
+			oldPairs[old.Content[i].Value] = [2]*yaml.Node{old.Content[i], old.Content[i+1]}
+			order = append(order, old.Content[i].Value)
+		}
+		pairs := make(map[string][2]*yaml.Node)
+		added := []string{}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			pairs[k.Value] = [2]*yaml.Node{k, v}
+			if p, ok := oldPairs[k.Value]; ok {
+				k.HeadComment = p[0].HeadComment
+				k.LineComment = p[0].LineComment
+				k.FootComment = p[0].FootComment
+				keepComments(p[1], v)
+			} else {
+				added = append(added, k.Value)
+			}
+		}
+		content := []*yaml.Node{}
+		for _, k := range append(order, added...) {
+			if p, ok := pairs[k]; ok {
+				content = append(content, p[0], p[1])
+			}
+		}
+		n.Content = content
+	case yaml.SequenceNode:
+		byID := make(map[string]*yaml.Node)
+		for _, c := range old.Content {
+			if id := nodeID(c); id != "" {
+				byID[id] = c
+			}
+		}
+		for i, c := range n.Content {
+			if o, ok := byID[nodeID(c)]; ok {
+				keepComments(o, c)
+			} else if nodeID(c) == "" && i < len(old.Content) {
+				keepComments(old.Content[i], c)
+			}
+		}
+	}
+}
+
+// nodeID returns the id field of a mapping node
+func nodeID(n *yaml.Node) string {
+	if n.Kind != yaml.MappingNode {
+		return ""
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == "id" {
+			return n.Content[i+1].Value
+		}
+	}
+	return ""
+}
+
+// tomlFormat reads and writes TOML.  Comments are not kept.
+type tomlFormat struct{}
+
+func (tomlFormat) toJSON(dat []byte) ([]byte, error) {
+	v := make(map[string]interface{})
+	err := toml.Unmarshal(dat, &v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+func (tomlFormat) fromJSON(dat, prev []byte) ([]byte, error) {
+	v, err := decodeJSON(dat)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	e := toml.NewEncoder(&buf)
+	e.Indent = ""
+	err = e.Encode(dropNulls(v))
+	return buf.Bytes(), err
+}
+
+// dropNulls leaves out empty fields, which TOML can't represent and which
+// only clutter YAML
+func dropNulls(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			if e == nil {
+				delete(t, k)
+				continue
+			}
+			t[k] = dropNulls(e)
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = dropNulls(e)
+		}
+	}
+	return v
+}
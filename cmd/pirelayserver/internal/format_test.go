@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatFor(t *testing.T) {
+	tests := []struct {
+		filename string
+		want     configFormat
+	}{
+		{filename: "config.json", want: jsonFormat{}},
+		{filename: "config.yaml", want: yamlFormat{}},
+		{filename: "config.YML", want: yamlFormat{}},
+		{filename: "config.toml", want: tomlFormat{}},
+		{filename: "config", want: jsonFormat{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filename, func(t *testing.T) {
+			if got := formatFor(tt.filename); got != tt.want {
+				t.Errorf("got %T, want %T", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	cfg := Config{
+		Version: 1,
+		Schedules: []Schedule{
+			{ID: "a", Relay: 1, Expression: "0 8 * * *", Action: On},
+			{ID: "b", Relay: 2, Expression: "0 6 * * *", Action: Pulse, Duration: Duration(30 * time.Minute)},
+		},
+		RelayNames: map[uint8]string{1: "Pump", 2: "Lights"},
+		APIKeys: map[string]APIKeyCollection{
+			"alice": {"k1": {Key: "secret", Desc: "laptop"}},
+		},
+		Scenes: map[string]Scene{
+			"spa": {Relays: map[uint8]Action{1: On, 2: Off}, Steps: []SceneStep{{Relay: 2, Delay: Duration(time.Second)}}},
+		},
+	}
+	dat, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		format configFormat
+	}{
+		{name: "json", format: jsonFormat{}},
+		{name: "yaml", format: yamlFormat{}},
+		{name: "toml", format: tomlFormat{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := tt.format.fromJSON(dat, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			back, err := tt.format.toJSON(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got Config
+			err = json.Unmarshal(back, &got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, cfg) {
+				t.Errorf("got %+v, want %+v", got, cfg)
+			}
+		})
+	}
+}
+
+func TestYAMLKeepsComments(t *testing.T) {
+	prev := []byte(`# Pool equipment
+version: 1
+schedules:
+  # Morning run
+  - id: a
+    relay: 1
+    expression: 0 8 * * * # every day
+    action: "on"
+relayNames:
+  1: Pump # the main pump
+`)
+	cfg := Config{
+		Version: 1,
+		Schedules: []Schedule{
+			{ID: "b", Relay: 2, Expression: "0 20 * * *", Action: Off},
+			{ID: "a", Relay: 1, Expression: "0 9 * * *", Action: On},
+		},
+		RelayNames: map[uint8]string{1: "Pump", 2: "Lights"},
+	}
+	dat, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := yamlFormat{}.fromJSON(dat, prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"# Pool equipment", "# Morning run\n  - id: a", "# every day", "# the main pump"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("got\n%s\nwant it to contain %q", out, want)
+		}
+	}
+	if !strings.Contains(string(out), "1: Pump") {
+		t.Errorf("got\n%s\nwant relay numbers as plain keys", out)
+	}
+	back, err := yamlFormat{}.toJSON(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Config
+	err = json.Unmarshal(back, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, cfg) {
+		t.Errorf("got %+v, want %+v", got, cfg)
+	}
+}
@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxRuns is how many runs are kept for each schedule
+const maxRuns = 50
+
+// missedLookback bounds how far back missed runs are searched for, e.g.
+// after the service has been down for a long time
+const missedLookback = 7 * 24 * time.Hour
+
+type RunOutcome string
+
+const (
+	RunSucceeded RunOutcome = "succeeded"
+	RunFailed    RunOutcome = "failed"
+	RunSkipped   RunOutcome = "skipped"
+	// RunMissed is an occurrence that never fired, because the service was
+	// down or the clock jumped past it
+	RunMissed RunOutcome = "missed"
+)
+
+// Run is a single firing of a schedule
+type Run struct {
+	At       time.Time  `json:"at"`
+	Outcome  RunOutcome `json:"outcome"`
+	Error    string     `json:"error,omitempty"`
+	Reason   string     `json:"reason,omitempty"`
+	Duration Duration   `json:"duration"`
+}
+
+// RunHistory keeps the most recent runs of each schedule, along with the
+// last time the schedules were checked for missed runs.  It is persisted to
+// a JSON file so missed runs can be detected across restarts.  Runs are
+// written as they are recorded, but the check time, which moves every minute,
+// is only kept in memory until the next write or Flush, to spare the SD card.
+type RunHistory struct {
+	filename string
+	state    runHistoryState
+	// dirty is set when the check time has moved since the last write
+	dirty bool
+	m     sync.RWMutex
+}
+
+type runHistoryState struct {
+	Checked   time.Time        `json:"checked"`
+	Schedules map[string][]Run `json:"schedules"`
+}
+
+// WithRunHistory loads the run history stored in filename, if any.  An empty
+// filename keeps the history in memory only.
+func WithRunHistory(filename string) (*RunHistory, error) {
+	h := &RunHistory{
+		filename: filename,
+		state: runHistoryState{
+			Schedules: make(map[string][]Run),
+		},
+	}
+	if filename == "" {
+		return h, nil
+	}
+	dat, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(dat, &h.state)
+	if err != nil {
+		return nil, err
+	}
+	if h.state.Schedules == nil {
+		h.state.Schedules = make(map[string][]Run)
+	}
+	return h, nil
+}
+
+// Record adds a run of the given schedule
+func (h *RunHistory) Record(id string, r Run) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	runs := append(h.state.Schedules[id], r)
+	if len(runs) > maxRuns {
+		runs = runs[len(runs)-maxRuns:]
+	}
+	h.state.Schedules[id] = runs
+	return h.save()
+}
+
+// Runs returns the recorded runs of the given schedule, oldest first
+func (h *RunHistory) Runs(id string) []Run {
+	h.m.RLock()
+	defer h.m.RUnlock()
+	return append([]Run{}, h.state.Schedules[id]...)
+}
+
+// LastRun returns the most recent run of the given schedule
+func (h *RunHistory) LastRun(id string) (Run, bool) {
+	h.m.RLock()
+	defer h.m.RUnlock()
+	runs := h.state.Schedules[id]
+	if len(runs) == 0 {
+		return Run{}, false
+	}
+	return runs[len(runs)-1], true
+}
+
+// Forget drops the history of schedules that no longer exist
+func (h *RunHistory) Forget(keep map[string]bool) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	changed := false
+	for k := range h.state.Schedules {
+		if !keep[k] {
+			delete(h.state.Schedules, k)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return h.save()
+}
+
+// Flush writes the history if the check time has moved since it was last
+// written
+func (h *RunHistory) Flush() error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if !h.dirty {
+		return nil
+	}
+	return h.save()
+}
+
+// recordedSince reports whether the given schedule has a run, including a
+// missed one, recorded in [from, to).  A missed run that was already recorded
+// isn't reported again if the check time was lost to a crash.
+func (h *RunHistory) recordedSince(id string, from, to time.Time) bool {
+	h.m.RLock()
+	defer h.m.RUnlock()
+	for _, r := range h.state.Schedules[id] {
+		if !r.At.Before(from) && r.At.Before(to) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *RunHistory) checked() time.Time {
+	h.m.RLock()
+	defer h.m.RUnlock()
+	return h.state.Checked
+}
+
+// setChecked moves the check time in memory only
+func (h *RunHistory) setChecked(t time.Time) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.state.Checked = t
+	h.dirty = true
+}
+
+func (h *RunHistory) save() error {
+	if h.filename == "" {
+		return nil
+	}
+	dat, err := json.Marshal(h.state)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(h.filename, dat, 0644)
+	if err != nil {
+		return err
+	}
+	h.dirty = false
+	return nil
+}
@@ -0,0 +1,187 @@
+package hub
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Topic classifies the messages published to a Hub
+type Topic string
+
+const (
+	// TopicRelay messages carry the new state of a relay that was switched
+	TopicRelay Topic = "relay"
+	// TopicEvent messages carry events as they are recorded
+	TopicEvent Topic = "event"
+	// TopicConfig messages carry the revisions of the config as they are made
+	TopicConfig Topic = "config"
+)
+
+// Topics lists every topic
+var Topics = []Topic{TopicRelay, TopicEvent, TopicConfig}
+
+// subscriberBuffer is how many messages a subscriber may fall behind by
+// before it is dropped
+const subscriberBuffer = 64
+
+// Message is a single publication
+type Message struct {
+	// ID orders the messages of a hub
+	ID    uint64
+	Topic Topic
+	Data  interface{}
+}
+
+// Hub fans the changes made inside the service out to subscribers, such as the
+// clients of the event stream.  It keeps the most recent messages, so that a
+// subscriber that reconnects can catch up on what it missed.  A nil Hub
+// discards what is published to it.
+type Hub struct {
+	// epoch tells the IDs of this hub apart from those of an earlier run of
+	// the service
+	epoch   int64
+	keep    int
+	backlog []Message
+	lastID  uint64
+	subs    map[*Subscription]bool
+	m       sync.Mutex
+}
+
+// New returns a hub that keeps the last keep messages, or none if keep is
+// negative
+func New(keep int) *Hub {
+	if keep < 0 {
+		keep = 0
+	}
+	return &Hub{
+		epoch: time.Now().Unix(),
+		keep:  keep,
+		subs:  make(map[*Subscription]bool),
+	}
+}
+
+// Publish sends data to the subscribers of topic.  A subscriber too far
+// behind to take it is dropped, and has to subscribe again.
+func (h *Hub) Publish(topic Topic, data interface{}) {
+	if h == nil {
+		return
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.lastID++
+	msg := Message{ID: h.lastID, Topic: topic, Data: data}
+	h.backlog = append(h.backlog, msg)
+	if len(h.backlog) > h.keep {
+		h.backlog = h.backlog[len(h.backlog)-h.keep:]
+	}
+	for s := range h.subs {
+		if !s.topics[topic] {
+			continue
+		}
+		select {
+		case s.c <- msg:
+		default:
+			h.remove(s)
+		}
+	}
+}
+
+// Subscription receives the messages of the topics it was made for
+type Subscription struct {
+	// Last is the ID of the last message published before the subscription
+	// was made
+	Last   uint64
+	h      *Hub
+	topics map[Topic]bool
+	c      chan Message
+}
+
+// Subscribe starts receiving the messages of topics
+func (h *Hub) Subscribe(topics []Topic) *Subscription {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.subscribe(topics)
+}
+
+// Resume starts receiving the messages of topics, returning the kept messages
+// published since the one with ID after as well; ok is false if some of them
+// are no longer kept.
+func (h *Hub) Resume(topics []Topic, after uint64) (s *Subscription, missed []Message, ok bool) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	s = h.subscribe(topics)
+	missed = []Message{}
+	if after > h.lastID {
+		return s, missed, false
+	}
+	ok = after == h.lastID || (len(h.backlog) > 0 && h.backlog[0].ID <= after+1)
+	for _, msg := range h.backlog {
+		if msg.ID > after && s.topics[msg.Topic] {
+			missed = append(missed, msg)
+		}
+	}
+	return s, missed, ok
+}
+
+func (h *Hub) subscribe(topics []Topic) *Subscription {
+	s := &Subscription{
+		Last:   h.lastID,
+		h:      h,
+		topics: make(map[Topic]bool),
+		c:      make(chan Message, subscriberBuffer),
+	}
+	for _, t := range topics {
+		s.topics[t] = true
+	}
+	h.subs[s] = true
+	return s
+}
+
+// Messages delivers the messages published since the subscription was made.
+// It is closed when the subscription is, or when the subscriber fell too far
+// behind.
+func (s *Subscription) Messages() <-chan Message {
+	return s.c
+}
+
+// Wants reports whether the subscription is to topic
+func (s *Subscription) Wants(topic Topic) bool {
+	return s.topics[topic]
+}
+
+// Close stops the subscription
+func (s *Subscription) Close() {
+	s.h.m.Lock()
+	defer s.h.m.Unlock()
+	s.h.remove(s)
+}
+
+func (h *Hub) remove(s *Subscription) {
+	if h.subs[s] {
+		delete(h.subs, s)
+		close(s.c)
+	}
+}
+
+// FormatID turns a message ID into the form handed to clients, which only
+// this run of the service accepts back
+func (h *Hub) FormatID(id uint64) string {
+	return fmt.Sprintf("%v-%v", h.epoch, id)
+}
+
+// ParseID reads an ID made by FormatID.  It returns false if the ID is
+// malformed or was handed out by an earlier run of the service.
+func (h *Hub) ParseID(s string) (uint64, bool) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 || parts[0] != strconv.FormatInt(h.epoch, 10) {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
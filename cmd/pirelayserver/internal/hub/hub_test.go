@@ -0,0 +1,140 @@
+package hub
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResume(t *testing.T) {
+	all := []Topic{TopicRelay, TopicEvent, TopicConfig}
+	five := []Topic{TopicRelay, TopicEvent, TopicRelay, TopicConfig, TopicRelay}
+	tests := []struct {
+		name string
+		// published is published in order to a hub that keeps keep messages
+		keep      int
+		published []Topic
+		topics    []Topic
+		after     uint64
+		wantIDs   []uint64
+		wantOK    bool
+	}{
+		{
+			name:    "nothing published",
+			keep:    3,
+			topics:  all,
+			wantIDs: []uint64{},
+			wantOK:  true,
+		},
+		{
+			name:      "up to date",
+			keep:      3,
+			published: five,
+			topics:    all,
+			after:     5,
+			wantIDs:   []uint64{},
+			wantOK:    true,
+		},
+		{
+			name:      "within the backlog",
+			keep:      3,
+			published: five,
+			topics:    all,
+			after:     2,
+			wantIDs:   []uint64{3, 4, 5},
+			wantOK:    true,
+		},
+		{
+			name:      "only the topics asked for",
+			keep:      3,
+			published: five,
+			topics:    []Topic{TopicRelay},
+			after:     2,
+			wantIDs:   []uint64{3, 5},
+			wantOK:    true,
+		},
+		{
+			name:      "gap before the backlog",
+			keep:      3,
+			published: five,
+			topics:    all,
+			after:     1,
+			wantIDs:   []uint64{3, 4, 5},
+		},
+		{
+			name:      "from the start",
+			keep:      3,
+			published: five,
+			topics:    all,
+			wantIDs:   []uint64{3, 4, 5},
+		},
+		{
+			name:      "beyond the last message",
+			keep:      3,
+			published: five,
+			topics:    all,
+			after:     9,
+			wantIDs:   []uint64{},
+		},
+		{
+			name:      "no backlog",
+			keep:      0,
+			published: five,
+			topics:    all,
+			after:     2,
+			wantIDs:   []uint64{},
+		},
+		{
+			name:      "negative backlog",
+			keep:      -1,
+			published: five,
+			topics:    all,
+			after:     2,
+			wantIDs:   []uint64{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := New(tt.keep)
+			for _, topic := range tt.published {
+				h.Publish(topic, nil)
+			}
+			s, missed, ok := h.Resume(tt.topics, tt.after)
+			defer s.Close()
+			ids := []uint64{}
+			for _, msg := range missed {
+				ids = append(ids, msg.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.wantIDs) || ok != tt.wantOK {
+				t.Errorf("got %v ok %v, want %v ok %v", ids, ok, tt.wantIDs, tt.wantOK)
+			}
+			if s.Last != uint64(len(tt.published)) {
+				t.Errorf("got last %v, want %v", s.Last, len(tt.published))
+			}
+		})
+	}
+}
+
+func TestParseID(t *testing.T) {
+	h := New(3)
+	earlier := &Hub{epoch: h.epoch - 1}
+	tests := []struct {
+		name   string
+		id     string
+		want   uint64
+		wantOK bool
+	}{
+		{name: "own", id: h.FormatID(42), want: 42, wantOK: true},
+		{name: "earlier run", id: earlier.FormatID(42)},
+		{name: "no epoch", id: "42"},
+		{name: "not a number", id: h.FormatID(0) + "x"},
+		{name: "empty", id: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := h.ParseID(tt.id)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("got %v ok %v, want %v ok %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// MaxJitter bounds the jitter window of a schedule
+const MaxJitter = 12 * time.Hour
+
+// Spec parses the schedule's cron expression.  When the schedule has a
+// jitter window each firing is offset by a random amount within it, chosen
+// from seed so that the same seed always gives the same fire times.
+func (s Schedule) Spec(seed int64) (cron.Schedule, error) {
+	spec, err := cron.ParseStandard(s.Expression)
+	if err != nil {
+		return nil, err
+	}
+	if s.Jitter <= 0 {
+		return spec, nil
+	}
+	return jittered{spec: spec, sch: s, seed: seed}, nil
+}
+
+// ValidateJitter checks the jitter window of a schedule
+func (s Schedule) ValidateJitter() error {
+	if s.Jitter < 0 {
+		return fmt.Errorf("jitter must not be negative")
+	}
+	if time.Duration(s.Jitter) > MaxJitter {
+		return fmt.Errorf("jitter may be at most %v", MaxJitter)
+	}
+	return nil
+}
+
+// jitterOffset picks the offset, to the second, of the occurrence of sch
+// nominally due at t.  It only depends on seed, the schedule and t.
+func jitterOffset(seed int64, sch Schedule, t time.Time) time.Duration {
+	w := int64(time.Duration(sch.Jitter) / time.Second)
+	if w <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%v|%v|%v", seed, sch.ID, t.Unix())
+	r := rand.New(rand.NewSource(int64(h.Sum64())))
+	return time.Duration(r.Int63n(2*w+1)-w) * time.Second
+}
+
+// jittered is a cron.Schedule that offsets each occurrence of another
+type jittered struct {
+	spec cron.Schedule
+	sch  Schedule
+	seed int64
+}
+
+func (j jittered) fireTime(nominal time.Time) time.Time {
+	return nominal.Add(jitterOffset(j.seed, j.sch, nominal))
+}
+
+// Next returns the earliest jittered fire time after t.  Offsets can reorder
+// occurrences that are closer together than the jitter window, so every
+// occurrence that could fire first is considered.
+func (j jittered) Next(t time.Time) time.Time {
+	w := time.Duration(j.sch.Jitter)
+	var best time.Time
+	n := j.spec.Next(t.Add(-w))
+	for i := 0; i < maxOccurrences && !n.IsZero(); i++ {
+		if !best.IsZero() && !n.Add(-w).Before(best) {
+			break
+		}
+		if a := j.fireTime(n); a.After(t) && (best.IsZero() || a.Before(best)) {
+			best = a
+		}
+		n = j.spec.Next(n)
+	}
+	return best
+}
+
+// nominal returns the occurrence whose jittered fire time is the latest one
+// not after t, which is the occurrence firing at t
+func (j jittered) nominal(t time.Time) time.Time {
+	w := time.Duration(j.sch.Jitter)
+	var ret, best time.Time
+	n := j.spec.Next(t.Add(-w - time.Minute))
+	for i := 0; i < maxOccurrences && !n.IsZero() && !n.After(t.Add(w)); i++ {
+		if a := j.fireTime(n); !a.After(t) && (best.IsZero() || a.After(best)) {
+			ret, best = n, a
+		}
+		n = j.spec.Next(n)
+	}
+	if ret.IsZero() {
+		return t
+	}
+	return ret
+}
+
+// nominalTime returns the unjittered time of the occurrence of spec firing at
+// t.  Priorities are resolved on nominal times so that jitter can't change
+// which of two colliding schedules wins.
+func nominalTime(spec cron.Schedule, t time.Time) time.Time {
+	if j, ok := spec.(jittered); ok {
+		return j.nominal(t)
+	}
+	return t
+}
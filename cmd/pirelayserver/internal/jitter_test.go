@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+func TestValidateJitter(t *testing.T) {
+	tests := []struct {
+		name    string
+		jitter  time.Duration
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "an hour", jitter: time.Hour},
+		{name: "the most", jitter: MaxJitter},
+		{name: "too much", jitter: MaxJitter + time.Second, wantErr: true},
+		{name: "negative", jitter: -time.Second, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Schedule{Jitter: Duration(tt.jitter)}.ValidateJitter()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJitteredSpec(t *testing.T) {
+	from := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		sch  Schedule
+		// span is how long fire times are collected for
+		span time.Duration
+	}{
+		{
+			name: "no jitter",
+			sch:  Schedule{ID: "a", Expression: "0 8 * * *"},
+			span: 7 * 24 * time.Hour,
+		},
+		{
+			name: "daily",
+			sch:  Schedule{ID: "a", Expression: "0 8 * * *", Jitter: Duration(time.Hour)},
+			span: 7 * 24 * time.Hour,
+		},
+		{
+			name: "window wider than the gaps",
+			sch:  Schedule{ID: "a", Expression: "* * * * *", Jitter: Duration(5 * time.Minute)},
+			span: 2 * time.Hour,
+		},
+		{
+			name: "weekly over midnight",
+			sch:  Schedule{ID: "a", Expression: "0 0 * * 1", Jitter: Duration(12 * time.Hour)},
+			span: 28 * 24 * time.Hour,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := time.Duration(tt.sch.Jitter)
+			end := from.Add(tt.span)
+			plain, err := cron.ParseStandard(tt.sch.Expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Every occurrence fires once, at its own offset within the
+			// window
+			want := []time.Time{}
+			for n := plain.Next(from.Add(-w - time.Second)); !n.After(end.Add(w)); n = plain.Next(n) {
+				at := n.Add(jitterOffset(42, tt.sch, n))
+				if d := at.Sub(n); d < -w || d > w {
+					t.Fatalf("got offset %v for %v, want at most %v", d, n, w)
+				}
+				if at.After(from) && !at.After(end) {
+					want = append(want, at)
+				}
+			}
+			sort.Slice(want, func(i, j int) bool { return want[i].Before(want[j]) })
+
+			for i := 0; i < 2; i++ {
+				spec, err := tt.sch.Spec(42)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := []time.Time{}
+				for at := spec.Next(from); !at.IsZero() && !at.After(end); at = spec.Next(at) {
+					got = append(got, at)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("got %v, want %v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestJitterSeeds(t *testing.T) {
+	sch := Schedule{ID: "a", Expression: "0 8 * * *", Jitter: Duration(time.Hour)}
+	from := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	fires := func(seed int64) []time.Time {
+		spec, err := sch.Spec(seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret := []time.Time{}
+		at := from
+		for i := 0; i < 10; i++ {
+			at = spec.Next(at)
+			ret = append(ret, at)
+		}
+		return ret
+	}
+	if a, b := fires(1), fires(1); !reflect.DeepEqual(a, b) {
+		t.Errorf("got %v and %v from the same seed, want the same times", a, b)
+	}
+	if a, b := fires(1), fires(2); reflect.DeepEqual(a, b) {
+		t.Errorf("got %v from different seeds, want different times", a)
+	}
+}
+
+func TestNominalTime(t *testing.T) {
+	from := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		sch  Schedule
+	}{
+		{name: "no jitter", sch: Schedule{ID: "a", Expression: "0 8 * * *"}},
+		{name: "daily", sch: Schedule{ID: "a", Expression: "0 8 * * *", Jitter: Duration(time.Hour)}},
+		{name: "window wider than the gaps", sch: Schedule{ID: "a", Expression: "*/2 * * * *", Jitter: Duration(5 * time.Minute)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, err := tt.sch.Spec(7)
+			if err != nil {
+				t.Fatal(err)
+			}
+			plain, _ := cron.ParseStandard(tt.sch.Expression)
+			at := from
+			for i := 0; i < 50; i++ {
+				at = spec.Next(at)
+				n := nominalTime(spec, at)
+				if !plain.Next(n.Add(-time.Second)).Equal(n) {
+					t.Fatalf("got %v for the firing at %v, which isn't an occurrence", n, at)
+				}
+				if got := n.Add(jitterOffset(7, tt.sch, n)); !got.Equal(at) {
+					t.Fatalf("got %v for the firing at %v, which fires at %v", n, at, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal/eventer"
+)
+
+// ConfigVersion is the version of the config schema written by this build.
+// There must be a migration for every version before it.
+const ConfigVersion = 1
+
+// migration upgrades a raw config from one version to the next.  Migrations
+// work on the raw JSON rather than Config, since older files needn't match
+// the current struct.
+type migration struct {
+	desc  string
+	apply func(map[string]interface{}) error
+}
+
+// migrations[n] upgrades a version n config to version n+1.  Never change or
+// remove a migration once released; add a new one instead.
+var migrations = []migration{
+	{
+		desc:  "add missing collections and schedule ids",
+		apply: migrateV0,
+	},
+}
+
+// migrateV0 upgrades the unversioned configs written before the schema had a
+// version, which relied on zero values for anything added since
+func migrateV0(raw map[string]interface{}) error {
+	for _, k := range []string{"relayNames", "apiKeys"} {
+		if raw[k] == nil {
+			raw[k] = map[string]interface{}{}
+		}
+	}
+	if raw["schedules"] == nil {
+		raw["schedules"] = []interface{}{}
+	}
+	schedules, ok := raw["schedules"].([]interface{})
+	if !ok {
+		return fmt.Errorf("schedules must be a list")
+	}
+	for _, s := range schedules {
+		sch, ok := s.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("schedules must be objects")
+		}
+		if id, _ := sch["id"].(string); id == "" {
+			sch["id"] = uuid.NewV4().String()
+		}
+	}
+	return nil
+}
+
+// configVersion reads the schema version of a raw config
+func configVersion(raw map[string]interface{}) (int, error) {
+	v, ok := raw["version"]
+	if !ok || v == nil {
+		return 0, nil
+	}
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("invalid config version %v", v)
+	}
+	ret, err := n.Int64()
+	if err != nil || ret < 0 {
+		return 0, fmt.Errorf("invalid config version %v", v)
+	}
+	if ret > int64(ConfigVersion) {
+		return 0, fmt.Errorf("config version %v is newer than this build supports (%v)", ret, ConfigVersion)
+	}
+	return int(ret), nil
+}
+
+func decodeRaw(dat []byte) (map[string]interface{}, error) {
+	raw := make(map[string]interface{})
+	d := json.NewDecoder(bytes.NewReader(dat))
+	d.UseNumber()
+	err := d.Decode(&raw)
+	if raw == nil {
+		// The config was null
+		raw = make(map[string]interface{})
+	}
+	return raw, err
+}
+
+// MigrationStep is one migration applied to a config
+type MigrationStep struct {
+	From int    `json:"from"`
+	To   int    `json:"to"`
+	Desc string `json:"desc"`
+}
+
+// migrationEvent describes a migration that was applied to the stored config
+func migrationEvent(m MigrationStep, msg string) eventer.Event {
+	return eventer.Event{
+		Type:     eventer.TypeConfigChanged,
+		OldState: fmt.Sprintf("version %v", m.From),
+		NewState: fmt.Sprintf("version %v", m.To),
+		Msg:      msg,
+	}
+}
+
+// MigrateConfig upgrades a raw config to ConfigVersion, calling step with the
+// config as it was before each migration and the config it produced.  A config
+// that is already current is returned unchanged.
+func MigrateConfig(dat []byte, step func(m MigrationStep, before, after []byte) error) ([]byte, error) {
+	raw, err := decodeRaw(dat)
+	if err != nil {
+		return nil, err
+	}
+	v, err := configVersion(raw)
+	if err != nil {
+		return nil, err
+	}
+	for ; v < ConfigVersion; v++ {
+		m := MigrationStep{From: v, To: v + 1, Desc: migrations[v].desc}
+		err = migrations[v].apply(raw)
+		if err != nil {
+			return nil, fmt.Errorf("migrating config from version %v to %v: %v", m.From, m.To, err)
+		}
+		raw["version"] = m.To
+		after, err := json.Marshal(raw)
+		if err != nil {
+			return nil, err
+		}
+		if step != nil {
+			err = step(m, dat, after)
+			if err != nil {
+				return nil, err
+			}
+		}
+		dat = after
+		// Re-decode so the next migration sees the same types it would
+		// reading the file
+		raw, err = decodeRaw(dat)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dat, nil
+}
+
+// migrationBackupName returns the name of the copy of filename kept from
+// before it was migrated away from version v
+func migrationBackupName(filename string, v int) string {
+	return fmt.Sprintf("%v.v%v", filename, v)
+}
+
+// migrate upgrades the config file to ConfigVersion one step at a time.  The
+// file is backed up as filename.vN before migrating away from version N.
+func (c *JsonConfigurer) migrate() error {
+	raw, err := ioutil.ReadFile(c.filename)
+	if err != nil {
+		return err
+	}
+	dat, err := c.format.toJSON(raw)
+	if err != nil {
+		return err
+	}
+	_, err = MigrateConfig(dat, func(m MigrationStep, before, after []byte) error {
+		before, err := c.format.fromJSON(before, raw)
+		if err != nil {
+			return err
+		}
+		after, err = c.format.fromJSON(after, raw)
+		if err != nil {
+			return err
+		}
+		err = writeFileAtomic(migrationBackupName(c.filename, m.From), before, 0644)
+		if err != nil {
+			return err
+		}
+		err = writeFileAtomic(c.filename, after, 0644)
+		if err != nil {
+			return err
+		}
+		c.el.Event(migrationEvent(m, fmt.Sprintf("Config migrated from version %v to %v (%v), previous version kept as %v", m.From, m.To, m.Desc, migrationBackupName(c.filename, m.From))))
+		return nil
+	})
+	return err
+}
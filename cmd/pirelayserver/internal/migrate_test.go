@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestMigrateConfig(t *testing.T) {
+	upgrade := []MigrationStep{{From: 0, To: 1, Desc: migrations[0].desc}}
+	tests := []struct {
+		name      string
+		in        string
+		wantSteps []MigrationStep
+		wantErr   bool
+		// check inspects the migrated config
+		check func(t *testing.T, cfg Config)
+	}{
+		{
+			name:      "unversioned",
+			in:        `{"schedules": null}`,
+			wantSteps: upgrade,
+			check: func(t *testing.T, cfg Config) {
+				if cfg.Version != 1 || cfg.Schedules == nil || cfg.RelayNames == nil || cfg.APIKeys == nil {
+					t.Errorf("got %+v, want version 1 with every collection", cfg)
+				}
+			},
+		},
+		{
+			name:      "null",
+			in:        `null`,
+			wantSteps: upgrade,
+			check: func(t *testing.T, cfg Config) {
+				if cfg.Version != 1 {
+					t.Errorf("got version %v, want 1", cfg.Version)
+				}
+			},
+		},
+		{
+			name:      "schedule ids",
+			in:        `{"schedules": [{"id": "a", "relay": 1}, {"relay": 2}]}`,
+			wantSteps: upgrade,
+			check: func(t *testing.T, cfg Config) {
+				if len(cfg.Schedules) != 2 || cfg.Schedules[0].ID != "a" || cfg.Schedules[1].ID == "" {
+					t.Errorf("got %+v, want the first id kept and the second assigned", cfg.Schedules)
+				}
+			},
+		},
+		{
+			name: "current",
+			in:   `{"version": 1, "schedules": [{"relay": 2}]}`,
+			check: func(t *testing.T, cfg Config) {
+				if cfg.Schedules[0].ID != "" {
+					t.Errorf("got id %q, want the current config left alone", cfg.Schedules[0].ID)
+				}
+			},
+		},
+		{
+			name:    "newer",
+			in:      fmt.Sprintf(`{"version": %v}`, ConfigVersion+1),
+			wantErr: true,
+		},
+		{
+			name:    "invalid version",
+			in:      `{"version": "one"}`,
+			wantErr: true,
+		},
+		{
+			name:    "negative version",
+			in:      `{"version": -1}`,
+			wantErr: true,
+		},
+		{
+			name:    "schedules not a list",
+			in:      `{"schedules": {}}`,
+			wantErr: true,
+		},
+		{
+			name:    "malformed",
+			in:      `{"schedules": [`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var steps []MigrationStep
+			out, err := MigrateConfig([]byte(tt.in), func(m MigrationStep, before, after []byte) error {
+				steps = append(steps, m)
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(steps, tt.wantSteps) {
+				t.Errorf("got steps %+v, want %+v", steps, tt.wantSteps)
+			}
+			if tt.wantSteps == nil && string(out) != tt.in {
+				t.Errorf("got %s, want the config unchanged", out)
+			}
+			var cfg Config
+			err = json.Unmarshal(out, &cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, cfg)
+		})
+	}
+}
@@ -49,6 +49,20 @@ func (mr *MockConfigurerMockRecorder) Get() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockConfigurer)(nil).Get))
 }
 
+// Revision mocks base method
+func (m *MockConfigurer) Revision() uint64 {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Revision")
+	ret0, _ := ret[0].(uint64)
+	return ret0
+}
+
+// Revision indicates an expected call of Revision
+func (mr *MockConfigurerMockRecorder) Revision() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Revision", reflect.TypeOf((*MockConfigurer)(nil).Revision))
+}
+
 // Set mocks base method
 func (m *MockConfigurer) Set(arg0 internal.Config) error {
 	m.ctrl.T.Helper()
@@ -62,3 +76,17 @@ func (mr *MockConfigurerMockRecorder) Set(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Set", reflect.TypeOf((*MockConfigurer)(nil).Set), arg0)
 }
+
+// Update mocks base method
+func (m *MockConfigurer) Update(arg0 string, arg1 func(*internal.Config) error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Update", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Update indicates an expected call of Update
+func (mr *MockConfigurerMockRecorder) Update(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Update", reflect.TypeOf((*MockConfigurer)(nil).Update), arg0, arg1)
+}
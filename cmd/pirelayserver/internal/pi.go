@@ -2,30 +2,41 @@ package internal
 
 import (
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/go-kit/kit/log"
-	"github.com/robfig/cron/v3"
 	"github.com/stianeikeland/go-rpio/v4"
 
 	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal/eventer"
+	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal/hub"
 )
 
 type PiRelayController struct {
 	relayPins []uint8
-	scheduler *cron.Cron
+	scheduler *scheduler
+	sequencer *sequencer
+	rules     *ruleEngine
 	logger    log.Logger
 	cfger     Configurer
 	el        eventer.Eventer
+	h         *hub.Hub
+	// m serializes access to the GPIO memory opened and closed by rpio
+	m sync.Mutex
 }
 
-func NewPiRelayController(l log.Logger, relayPins []uint8, cfger Configurer, el eventer.Eventer) (*PiRelayController, error) {
+func NewPiRelayController(l log.Logger, relayPins []uint8, cfger Configurer, el eventer.Eventer, sensors SensorReader, history *RunHistory, h *hub.Hub) (*PiRelayController, error) {
 	c := PiRelayController{
 		relayPins: relayPins,
 		logger:    l,
-		scheduler: cron.New(),
 		cfger:     cfger,
 		el:        el,
+		h:         h,
 	}
+	clock := systemClock{}
+	c.rules = newRuleEngine(l, clock, &c, cfger, el, sensors)
+	c.scheduler = newScheduler(l, clock, &c, cfger, el, sensors, c.rules, history)
+	c.sequencer = newSequencer(l, clock, &c, el)
 	cfg, err := cfger.Get()
 	if err != nil {
 		return nil, err
@@ -38,46 +49,26 @@ func NewPiRelayController(l log.Logger, relayPins []uint8, cfger Configurer, el
 }
 
 func (c *PiRelayController) ApplyConfig(cfg Config) error {
-	// Handle schedules
-	c.scheduler.Stop()
-	c.clearScheduler()
-	for _, s := range cfg.Schedules {
-		f := c.createToggleFunction(s.Relay, s.Action, "scheduled action")
-		_, err := c.scheduler.AddFunc(s.Expression, f)
-		if err != nil {
-			return err
-		}
-	}
-	c.scheduler.Start()
-	return nil
+	return c.scheduler.apply(cfg)
 }
 
-func (c *PiRelayController) clearScheduler() {
-	for _, e := range c.scheduler.Entries() {
-		c.scheduler.Remove(e.ID)
-	}
+func (c *PiRelayController) RunSequence(relay uint8, steps []SequenceStep, cause Cause) error {
+	return c.sequencer.run(relay, steps, cause)
 }
 
-func (c *PiRelayController) createToggleFunction(relay uint8, action Action, cause string) func() {
-	ret := func() {}
-	switch action {
-	case On:
-		ret = func() {
-			c.logger.Log("msg", "Switching relay to On", "relay", relay, "cause", cause)
-			c.On(relay, cause)
-		}
-	case Off:
-		ret = func() {
-			c.logger.Log("msg", "Switching relay to Off", "relay", relay, "cause", cause)
-			c.Off(relay, cause)
-		}
-	}
-	return ret
+func (c *PiRelayController) CancelSequence(relay uint8) bool {
+	return c.sequencer.stop(relay)
+}
+
+func (c *PiRelayController) NextRun(id string) (time.Time, bool) {
+	return c.scheduler.next(id)
 }
 
 func (c *PiRelayController) Status() (Status, error) {
 	r := Status{}
 	states := []State{}
+	c.m.Lock()
+	defer c.m.Unlock()
 	if err := rpio.Open(); err != nil {
 		return r, err
 	}
@@ -111,13 +102,15 @@ func (c *PiRelayController) relayName(relay uint8) (string, error) {
 }
 
 func (c *PiRelayController) IsValidRelay(relay uint8) bool {
-	return int(relay) <= len(c.relayPins)
+	return relay >= 1 && int(relay) <= len(c.relayPins)
 }
 
-func (c *PiRelayController) Toggle(relay uint8) error {
+func (c *PiRelayController) Toggle(relay uint8, cause Cause) error {
 	if !c.IsValidRelay(relay) {
 		return fmt.Errorf("invalid relay. must be uint between 1 and %v", len(c.relayPins))
 	}
+	c.m.Lock()
+	defer c.m.Unlock()
 	if err := rpio.Open(); err != nil {
 		return err
 	}
@@ -126,43 +119,55 @@ func (c *PiRelayController) Toggle(relay uint8) error {
 	pin.Output()
 	pin.Toggle()
 	s := pin.Read()
-	ss := "off"
-	if int(s) == 1 {
-		ss = "on"
-	}
 	n, _ := c.relayName(relay)
-	c.el.Event(fmt.Sprintf("Toggled '%v' (relay %v), new state is %v", n, relay, ss))
+	c.el.Event(relayEvent(relay, n, s != rpio.High, s == rpio.High, cause))
+	c.h.Publish(hub.TopicRelay, relayState(relay, n, s == rpio.High))
+	c.rules.relayChanged(relay, s == rpio.High, cause)
 	return nil
 }
 
-func (c *PiRelayController) On(relay uint8, cause string) error {
+func (c *PiRelayController) On(relay uint8, cause Cause) error {
 	if !c.IsValidRelay(relay) {
 		return fmt.Errorf("invalid relay. must be uint between 1 and %v", len(c.relayPins))
 	}
+	c.m.Lock()
+	defer c.m.Unlock()
 	if err := rpio.Open(); err != nil {
 		return err
 	}
 	defer rpio.Close()
 	pin := rpio.Pin(c.relayPins[relay-1])
 	pin.Output()
+	prev := pin.Read()
 	pin.High()
 	n, _ := c.relayName(relay)
-	c.el.Event(fmt.Sprintf("Switching '%v' (relay %v) on, cause: %v", n, relay, cause))
+	c.el.Event(relayEvent(relay, n, prev == rpio.High, true, cause))
+	c.h.Publish(hub.TopicRelay, relayState(relay, n, true))
+	if prev != rpio.High {
+		c.rules.relayChanged(relay, true, cause)
+	}
 	return nil
 }
 
-func (c *PiRelayController) Off(relay uint8, cause string) error {
+func (c *PiRelayController) Off(relay uint8, cause Cause) error {
 	if !c.IsValidRelay(relay) {
 		return fmt.Errorf("invalid relay. must be uint between 1 and %v", len(c.relayPins))
 	}
+	c.m.Lock()
+	defer c.m.Unlock()
 	if err := rpio.Open(); err != nil {
 		return err
 	}
 	defer rpio.Close()
 	pin := rpio.Pin(c.relayPins[relay-1])
 	pin.Output()
+	prev := pin.Read()
 	pin.Low()
 	n, _ := c.relayName(relay)
-	c.el.Event(fmt.Sprintf("Switching '%v' (relay %v) off, cause: %v", n, relay, cause))
+	c.el.Event(relayEvent(relay, n, prev == rpio.High, false, cause))
+	c.h.Publish(hub.TopicRelay, relayState(relay, n, false))
+	if prev != rpio.Low {
+		c.rules.relayChanged(relay, false, cause)
+	}
 	return nil
 }
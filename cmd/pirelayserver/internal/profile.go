@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Profile is a named set of schedules, such as "summer" or "winter", that runs
+// alongside the base schedules while it is active
+type Profile struct {
+	Schedules []Schedule  `json:"schedules"`
+	Activate  []DateRange `json:"activate,omitempty"`
+}
+
+// DateRange is a yearly recurring range of days written as MM-DD, inclusive on
+// both ends.  A range whose From falls after its To wraps around the new year.
+type DateRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Validate checks that both ends of the range are parseable
+func (r DateRange) Validate() error {
+	if _, err := parseMonthDay(r.From); err != nil {
+		return err
+	}
+	_, err := parseMonthDay(r.To)
+	return err
+}
+
+// Contains reports whether the day of t falls within the range
+func (r DateRange) Contains(t time.Time) bool {
+	from, err := parseMonthDay(r.From)
+	if err != nil {
+		return false
+	}
+	to, err := parseMonthDay(r.To)
+	if err != nil {
+		return false
+	}
+	day := int(t.Month())*100 + t.Day()
+	if from <= to {
+		return day >= from && day <= to
+	}
+	return day >= from || day <= to
+}
+
+// parseMonthDay converts MM-DD into a sortable MMDD integer
+func parseMonthDay(s string) (int, error) {
+	t, err := time.Parse("01-02", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid date %q, expected MM-DD", s)
+	}
+	return int(t.Month())*100 + t.Day(), nil
+}
+
+// ResolveProfile returns the name of the profile in effect at t.  A manual
+// override wins; otherwise the first profile (by name) with a date range
+// covering t is used.  An empty string means only base schedules apply.
+func (c Config) ResolveProfile(t time.Time) string {
+	if _, ok := c.Profiles[c.ProfileOverride]; ok {
+		return c.ProfileOverride
+	}
+	names := []string{}
+	for k := range c.Profiles {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		for _, r := range c.Profiles[n].Activate {
+			if r.Contains(t) {
+				return n
+			}
+		}
+	}
+	return ""
+}
+
+// ActiveSchedules returns the base schedules along with those of the profile
+// in effect at t
+func (c Config) ActiveSchedules(t time.Time) []Schedule {
+	ret := append([]Schedule{}, c.Schedules...)
+	if p, ok := c.Profiles[c.ResolveProfile(t)]; ok {
+		ret = append(ret, p.Schedules...)
+	}
+	return ret
+}
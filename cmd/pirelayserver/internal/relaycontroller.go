@@ -1,12 +1,73 @@
 package internal
 
+import (
+	"time"
+
+	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal/eventer"
+)
+
+// Cause describes why a relay is being switched, and who asked for it
+type Cause struct {
+	Reason string
+	// Actor is the JWT subject of the user, or one of the Actor constants
+	Actor string
+}
+
+func (c Cause) String() string {
+	if c.Actor == "" {
+		return c.Reason
+	}
+	return c.Reason + " by " + c.Actor
+}
+
+// relayEvent describes relay being switched from prev to on
+func relayEvent(relay uint8, name string, prev, on bool, cause Cause) eventer.Event {
+	e := eventer.Event{
+		Type:     eventer.TypeRelayOff,
+		Relay:    relay,
+		Name:     name,
+		Actor:    cause.Actor,
+		Cause:    cause.Reason,
+		OldState: string(stateAction(prev)),
+		NewState: string(stateAction(on)),
+	}
+	if on {
+		e.Type = eventer.TypeRelayOn
+	}
+	return e
+}
+
+// relayState is the state of relay once switched, as published to the hub
+func relayState(relay uint8, name string, on bool) State {
+	s := State{Relay: relay, Name: name}
+	if on {
+		s.State = 1
+	}
+	return s
+}
+
+func stateAction(on bool) Action {
+	if on {
+		return On
+	}
+	return Off
+}
+
 // RelayController represents the control surface that relay controller must
 // implement to be used by the service
 type RelayController interface {
 	ApplyConfig(cfg Config) error
 	IsValidRelay(relay uint8) bool
 	Status() (Status, error)
-	Toggle(relay uint8) error
-	On(relay uint8, cause string) error
-	Off(relay uint8, cause string) error
+	Toggle(relay uint8, cause Cause) error
+	On(relay uint8, cause Cause) error
+	Off(relay uint8, cause Cause) error
+	// RunSequence runs steps against relay in the background, replacing any
+	// sequence already running on it
+	RunSequence(relay uint8, steps []SequenceStep, cause Cause) error
+	// CancelSequence stops the sequence running on relay, if any
+	CancelSequence(relay uint8) bool
+	// NextRun returns when the given schedule will next fire, including any
+	// jitter
+	NextRun(id string) (time.Time, bool)
 }
@@ -0,0 +1,305 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal/eventer"
+)
+
+type TriggerType string
+
+const (
+	// RelayTrigger fires when a relay changes state
+	RelayTrigger TriggerType = "relay"
+	// ScheduleTrigger fires when a schedule performs its action
+	ScheduleTrigger TriggerType = "schedule"
+)
+
+// Notify records the rule's message in the event log
+const Notify Action = "notify"
+
+// ruleCausePrefix marks relay changes made by rules.  Those changes never
+// trigger other rules, which keeps rules from looping.
+const ruleCausePrefix = "rule "
+
+// Rule runs an action in reaction to a relay change or schedule firing.  The
+// condition, if any, is evaluated just before the action runs.
+type Rule struct {
+	ID        string      `json:"id"`
+	Name      string      `json:"name"`
+	Disabled  bool        `json:"disabled,omitempty"`
+	Trigger   RuleTrigger `json:"trigger"`
+	Condition string      `json:"condition,omitempty"`
+	Action    RuleAction  `json:"action"`
+}
+
+// RuleTrigger describes what a rule reacts to.  Empty fields match anything.
+type RuleTrigger struct {
+	Type     TriggerType `json:"type"`
+	Relay    uint8       `json:"relay,omitempty"`
+	State    Action      `json:"state,omitempty"`
+	Cause    string      `json:"cause,omitempty"`
+	Schedule string      `json:"schedule,omitempty"`
+}
+
+// RuleAction is what a rule does once triggered, after waiting for Delay
+type RuleAction struct {
+	Action   Action         `json:"action"`
+	Relay    uint8          `json:"relay,omitempty"`
+	Delay    Duration       `json:"delay,omitempty"`
+	Duration Duration       `json:"duration,omitempty"`
+	Steps    []SequenceStep `json:"steps,omitempty"`
+	Scene    string         `json:"scene,omitempty"`
+	Message  string         `json:"message,omitempty"`
+}
+
+// Validate checks the rule is internally consistent
+func (r Rule) Validate() error {
+	switch r.Trigger.Type {
+	case RelayTrigger:
+		if r.Trigger.State != "" && r.Trigger.State != On && r.Trigger.State != Off {
+			return fmt.Errorf("invalid trigger state %q", r.Trigger.State)
+		}
+	case ScheduleTrigger:
+	default:
+		return fmt.Errorf("invalid trigger type %q", r.Trigger.Type)
+	}
+	if r.Condition != "" {
+		if _, err := ParseCondition(r.Condition); err != nil {
+			return err
+		}
+	}
+	a := r.Action
+	if a.Delay < 0 {
+		return fmt.Errorf("action delay must not be negative")
+	}
+	relayAction := a.Action == On || a.Action == Off || a.Action == Pulse || a.Action == Sequence
+	if relayAction && a.Relay == 0 {
+		return fmt.Errorf("%v action requires a relay", a.Action)
+	}
+	switch a.Action {
+	case On, Off:
+	case Pulse:
+		if a.Duration <= 0 {
+			return fmt.Errorf("pulse duration must be positive")
+		}
+	case Sequence:
+		if err := ValidateSteps(a.Steps); err != nil {
+			return err
+		}
+	case SceneAction:
+		if a.Scene == "" {
+			return fmt.Errorf("scene action requires a scene")
+		}
+	case Notify:
+		if a.Message == "" {
+			return fmt.Errorf("notify action requires a message")
+		}
+	default:
+		return fmt.Errorf("invalid action %q", a.Action)
+	}
+	return nil
+}
+
+func (r Rule) displayName() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.ID
+}
+
+// trigger is a single occurrence that rules are matched against
+type trigger struct {
+	kind     TriggerType
+	relay    uint8
+	state    Action
+	cause    Cause
+	schedule string
+}
+
+func (t trigger) String() string {
+	if t.kind == ScheduleTrigger {
+		return fmt.Sprintf("schedule %v", t.schedule)
+	}
+	return fmt.Sprintf("relay %v switching %v (%v)", t.relay, t.state, t.cause)
+}
+
+func (rt RuleTrigger) matches(t trigger) bool {
+	if rt.Type != t.kind {
+		return false
+	}
+	if t.kind == ScheduleTrigger {
+		return rt.Schedule == "" || rt.Schedule == t.schedule
+	}
+	return (rt.Relay == 0 || rt.Relay == t.relay) &&
+		(rt.State == "" || rt.State == t.state) &&
+		(rt.Cause == "" || strings.Contains(t.cause.String(), rt.Cause))
+}
+
+// ruleEngine matches relay changes and schedule firings against the rules in
+// the config and runs their actions
+type ruleEngine struct {
+	logger  log.Logger
+	clock   Clock
+	ctrl    RelayController
+	cfger   Configurer
+	el      eventer.Eventer
+	sensors SensorReader
+	pending map[string]Timer
+	m       sync.Mutex
+}
+
+func newRuleEngine(l log.Logger, clock Clock, ctrl RelayController, cfger Configurer, el eventer.Eventer, sensors SensorReader) *ruleEngine {
+	return &ruleEngine{
+		logger:  l,
+		clock:   clock,
+		ctrl:    ctrl,
+		cfger:   cfger,
+		el:      el,
+		sensors: sensors,
+		pending: make(map[string]Timer),
+	}
+}
+
+// relayChanged is called by the relay controllers whenever a relay changes
+// state.  Changes made by rules are ignored.
+func (e *ruleEngine) relayChanged(relay uint8, on bool, cause Cause) {
+	if strings.HasPrefix(cause.Reason, ruleCausePrefix) {
+		return
+	}
+	state := Off
+	if on {
+		state = On
+	}
+	e.fire(trigger{kind: RelayTrigger, relay: relay, state: state, cause: cause})
+}
+
+// scheduleFired is called by the scheduler whenever a schedule performs its
+// action
+func (e *ruleEngine) scheduleFired(sch Schedule) {
+	e.fire(trigger{kind: ScheduleTrigger, schedule: sch.ID})
+}
+
+func (e *ruleEngine) fire(t trigger) {
+	cfg, err := e.cfger.Get()
+	if err != nil {
+		e.logger.Log("err", err)
+		return
+	}
+	for _, r := range cfg.Rules {
+		if r.Disabled || !r.Trigger.matches(t) {
+			continue
+		}
+		e.schedule(r, t)
+	}
+}
+
+// schedule runs the rule once its delay has passed.  Triggering a rule that
+// is still waiting restarts the wait.
+func (e *ruleEngine) schedule(r Rule, t trigger) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	if p, ok := e.pending[r.ID]; ok {
+		p.Stop()
+	}
+	var timer Timer
+	timer = e.clock.AfterFunc(time.Duration(r.Action.Delay), func() {
+		e.m.Lock()
+		if e.pending[r.ID] == timer {
+			delete(e.pending, r.ID)
+		}
+		e.m.Unlock()
+		e.execute(r.ID, t)
+	})
+	e.pending[r.ID] = timer
+}
+
+// execute looks the rule up again, so rules that were removed or disabled
+// while waiting don't run, then checks its condition and runs its action
+func (e *ruleEngine) execute(id string, t trigger) {
+	cfg, err := e.cfger.Get()
+	if err != nil {
+		e.logger.Log("err", err)
+		return
+	}
+	var r Rule
+	found := false
+	for _, v := range cfg.Rules {
+		if v.ID == id {
+			r, found = v, true
+		}
+	}
+	if !found || r.Disabled {
+		return
+	}
+
+	if r.Condition != "" {
+		ok, err := EvalCondition(r.Condition, e.ctrl, e.sensors)
+		if err != nil {
+			e.el.Event(ruleEvent(eventer.TypeRuleSkipped, r, t, fmt.Sprintf("%v: %v", conditionError, err)))
+			return
+		}
+		if !ok {
+			e.el.Event(ruleEvent(eventer.TypeRuleSkipped, r, t, fmt.Sprintf("condition false: %v", r.Condition)))
+			return
+		}
+	}
+
+	e.logger.Log("msg", "Running rule", "rule", r.ID, "trigger", t)
+	err = e.run(r, cfg)
+	if err != nil {
+		e.logger.Log("err", err, "rule", r.ID)
+		e.el.Event(ruleEvent(eventer.TypeRuleFailed, r, t, err.Error()))
+		return
+	}
+	e.el.Event(ruleEvent(eventer.TypeRuleFired, r, t, ""))
+}
+
+// ruleEvent describes something that happened to rule r after trigger t,
+// along with why if there's more to it than the trigger
+func ruleEvent(typ eventer.Type, r Rule, t trigger, reason string) eventer.Event {
+	cause := t.String()
+	if reason != "" {
+		cause = fmt.Sprintf("%v, triggered by %v", reason, t)
+	}
+	return eventer.Event{
+		Type:     typ,
+		Relay:    r.Action.Relay,
+		Name:     r.displayName(),
+		Actor:    ActorRules,
+		Cause:    cause,
+		NewState: string(r.Action.Action),
+	}
+}
+
+func (e *ruleEngine) run(r Rule, cfg Config) error {
+	a := r.Action
+	cause := Cause{Reason: ruleCausePrefix + fmt.Sprintf("'%v'", r.displayName()), Actor: ActorRules}
+	switch a.Action {
+	case On, Off:
+		return setRelay(e.ctrl, a.Relay, a.Action, cause)
+	case Pulse:
+		return e.ctrl.RunSequence(a.Relay, PulseSteps(a.Duration), cause)
+	case Sequence:
+		return e.ctrl.RunSequence(a.Relay, a.Steps, cause)
+	case SceneAction:
+		sc, ok := cfg.Scenes[a.Scene]
+		if !ok {
+			return fmt.Errorf("scene %v not found", a.Scene)
+		}
+		return activateScene(e.clock, e.ctrl, e.el, a.Scene, sc, cause)
+	case Notify:
+		return e.el.Event(eventer.Event{
+			Type:  eventer.TypeNotification,
+			Name:  r.displayName(),
+			Actor: ActorRules,
+			Msg:   fmt.Sprintf("Notification from rule '%v': %v", r.displayName(), a.Message),
+		})
+	}
+	return fmt.Errorf("invalid action %q", a.Action)
+}
@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRuleValidate(t *testing.T) {
+	onRelay1 := RuleTrigger{Type: RelayTrigger, Relay: 1, State: On}
+	tests := []struct {
+		name    string
+		rule    Rule
+		wantErr bool
+	}{
+		{
+			name: "switch a relay",
+			rule: Rule{ID: "r", Trigger: onRelay1, Action: RuleAction{Action: Off, Relay: 2, Delay: Duration(time.Minute)}},
+		},
+		{
+			name: "notify after a schedule",
+			rule: Rule{ID: "r", Trigger: RuleTrigger{Type: ScheduleTrigger, Schedule: "a"}, Condition: "relay.1 == on", Action: RuleAction{Action: Notify, Message: "hi"}},
+		},
+		{
+			name:    "invalid trigger type",
+			rule:    Rule{ID: "r", Trigger: RuleTrigger{Type: "sensor"}, Action: RuleAction{Action: Off, Relay: 2}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid trigger state",
+			rule:    Rule{ID: "r", Trigger: RuleTrigger{Type: RelayTrigger, State: Pulse}, Action: RuleAction{Action: Off, Relay: 2}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid condition",
+			rule:    Rule{ID: "r", Trigger: onRelay1, Condition: "relay.1 ==", Action: RuleAction{Action: Off, Relay: 2}},
+			wantErr: true,
+		},
+		{
+			name:    "negative delay",
+			rule:    Rule{ID: "r", Trigger: onRelay1, Action: RuleAction{Action: Off, Relay: 2, Delay: Duration(-time.Minute)}},
+			wantErr: true,
+		},
+		{
+			name:    "relay action without a relay",
+			rule:    Rule{ID: "r", Trigger: onRelay1, Action: RuleAction{Action: On}},
+			wantErr: true,
+		},
+		{
+			name:    "pulse without a duration",
+			rule:    Rule{ID: "r", Trigger: onRelay1, Action: RuleAction{Action: Pulse, Relay: 2}},
+			wantErr: true,
+		},
+		{
+			name:    "sequence without steps",
+			rule:    Rule{ID: "r", Trigger: onRelay1, Action: RuleAction{Action: Sequence, Relay: 2}},
+			wantErr: true,
+		},
+		{
+			name:    "scene without a scene",
+			rule:    Rule{ID: "r", Trigger: onRelay1, Action: RuleAction{Action: SceneAction}},
+			wantErr: true,
+		},
+		{
+			name:    "notify without a message",
+			rule:    Rule{ID: "r", Trigger: onRelay1, Action: RuleAction{Action: Notify}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid action",
+			rule:    Rule{ID: "r", Trigger: onRelay1, Action: RuleAction{Action: "dim", Relay: 2}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rule.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRuleTriggering(t *testing.T) {
+	// The rules wait an hour before running, so the ones triggered are still
+	// pending when checked
+	wait := Duration(time.Hour)
+	rules := []Rule{
+		{ID: "any", Trigger: RuleTrigger{Type: RelayTrigger}, Action: RuleAction{Action: Notify, Message: "hi", Delay: wait}},
+		{ID: "relay1-on", Trigger: RuleTrigger{Type: RelayTrigger, Relay: 1, State: On}, Action: RuleAction{Action: Notify, Message: "hi", Delay: wait}},
+		{ID: "by-api", Trigger: RuleTrigger{Type: RelayTrigger, Cause: "api"}, Action: RuleAction{Action: Notify, Message: "hi", Delay: wait}},
+		{ID: "schedule-a", Trigger: RuleTrigger{Type: ScheduleTrigger, Schedule: "a"}, Action: RuleAction{Action: Notify, Message: "hi", Delay: wait}},
+		{ID: "disabled", Disabled: true, Trigger: RuleTrigger{Type: RelayTrigger}, Action: RuleAction{Action: Notify, Message: "hi", Delay: wait}},
+	}
+	tests := []struct {
+		name string
+		do   func(c *StubRelayController)
+		want []string
+	}{
+		{
+			name: "relay 1 on",
+			do:   func(c *StubRelayController) { c.On(1, testCause) },
+			want: []string{"any", "relay1-on"},
+		},
+		{
+			name: "relay 2 on by the api",
+			do:   func(c *StubRelayController) { c.On(2, Cause{Reason: "api request", Actor: "alice"}) },
+			want: []string{"any", "by-api"},
+		},
+		{
+			name: "relay already off",
+			do:   func(c *StubRelayController) { c.Off(1, testCause) },
+			want: []string{},
+		},
+		{
+			name: "switched by a rule",
+			do:   func(c *StubRelayController) { c.On(1, Cause{Reason: ruleCausePrefix + "'other'", Actor: ActorRules}) },
+			want: []string{},
+		},
+		{
+			name: "schedule fired",
+			do:   func(c *StubRelayController) { c.rules.scheduleFired(Schedule{ID: "a"}) },
+			want: []string{"schedule-a"},
+		},
+		{
+			name: "other schedule fired",
+			do:   func(c *StubRelayController) { c.rules.scheduleFired(Schedule{ID: "b"}) },
+			want: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newTestController(t, 2, Config{Rules: rules})
+			tt.do(c)
+			if got := pendingRules(c.rules); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleExecute(t *testing.T) {
+	relay1On := trigger{kind: RelayTrigger, relay: 1, state: On, cause: testCause}
+	tests := []struct {
+		name string
+		rule Rule
+		want []uint8
+	}{
+		{
+			name: "switch a relay",
+			rule: Rule{ID: "r", Action: RuleAction{Action: On, Relay: 2}},
+			want: []uint8{1, 1, 0},
+		},
+		{
+			name: "condition true",
+			rule: Rule{ID: "r", Condition: "relay.1 == on", Action: RuleAction{Action: On, Relay: 2}},
+			want: []uint8{1, 1, 0},
+		},
+		{
+			name: "condition false",
+			rule: Rule{ID: "r", Condition: "relay.3 == on", Action: RuleAction{Action: On, Relay: 2}},
+			want: []uint8{1, 0, 0},
+		},
+		{
+			name: "condition can't be evaluated",
+			rule: Rule{ID: "r", Condition: "sensor.water_temp > 20", Action: RuleAction{Action: On, Relay: 2}},
+			want: []uint8{1, 0, 0},
+		},
+		{
+			name: "disabled",
+			rule: Rule{ID: "r", Disabled: true, Action: RuleAction{Action: On, Relay: 2}},
+			want: []uint8{1, 0, 0},
+		},
+		{
+			name: "scene",
+			rule: Rule{ID: "r", Action: RuleAction{Action: SceneAction, Scene: "spa"}},
+			want: []uint8{0, 1, 1},
+		},
+		{
+			name: "missing scene",
+			rule: Rule{ID: "r", Action: RuleAction{Action: SceneAction, Scene: "nope"}},
+			want: []uint8{1, 0, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{
+				Rules: []Rule{
+					tt.rule,
+					// Would run if the changes rules make triggered rules
+					{ID: "loop", Trigger: RuleTrigger{Type: RelayTrigger}, Action: RuleAction{Action: Notify, Message: "hi", Delay: Duration(time.Hour)}},
+				},
+				Scenes: map[string]Scene{"spa": {Relays: map[uint8]Action{1: Off, 2: On, 3: On}}},
+			}
+			c, _ := newTestController(t, 3, cfg)
+			c.relayStates[0] = true
+			c.rules.execute(tt.rule.ID, relay1On)
+			if got := relayStates(t, c); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if got := pendingRules(c.rules); len(got) != 0 {
+				t.Errorf("got %v triggered by the rule, want none", got)
+			}
+		})
+	}
+}
+
+// pendingRules returns the IDs of the rules waiting to run, in order
+func pendingRules(e *ruleEngine) []string {
+	e.m.Lock()
+	defer e.m.Unlock()
+	ret := []string{}
+	for k := range e.pending {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
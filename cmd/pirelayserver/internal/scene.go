@@ -0,0 +1,187 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal/eventer"
+)
+
+// Scene is a named preset of relay states, such as "spa mode", that is applied
+// as a unit.  Steps optionally fix the order relays are switched in and how
+// long to wait before each one; relays without a step follow in relay order.
+type Scene struct {
+	Name   string           `json:"name"`
+	Relays map[uint8]Action `json:"relays"`
+	Steps  []SceneStep      `json:"steps,omitempty"`
+}
+
+// SceneStep switches a single relay of a scene after waiting for Delay
+type SceneStep struct {
+	Relay uint8    `json:"relay"`
+	Delay Duration `json:"delay,omitempty"`
+}
+
+// ErrSceneActive is returned when a scene is activated on a controller that
+// is still part way through activating one
+var ErrSceneActive = errors.New("another scene is being activated")
+
+// activeScenes holds the controllers with a scene activation in progress.  A
+// controller runs one activation at a time, rollback included, so the steps
+// of two scenes never interleave.  Later activations are turned away rather
+// than queued, as the first may be waiting out long delays.
+var (
+	activeScenes = make(map[RelayController]bool)
+	sceneLock    sync.Mutex
+)
+
+// SceneActive reports whether a scene is being activated on ctrl
+func SceneActive(ctrl RelayController) bool {
+	sceneLock.Lock()
+	defer sceneLock.Unlock()
+	return activeScenes[ctrl]
+}
+
+// Validate checks the scene is internally consistent
+func (s Scene) Validate() error {
+	if len(s.Relays) == 0 {
+		return fmt.Errorf("scene must set at least one relay")
+	}
+	for k, v := range s.Relays {
+		if v != On && v != Off {
+			return fmt.Errorf("invalid action %q for relay %v", v, k)
+		}
+	}
+	seen := make(map[uint8]bool)
+	for _, v := range s.Steps {
+		if _, ok := s.Relays[v.Relay]; !ok {
+			return fmt.Errorf("step for relay %v has no desired state", v.Relay)
+		}
+		if seen[v.Relay] {
+			return fmt.Errorf("relay %v appears in more than one step", v.Relay)
+		}
+		if v.Delay < 0 {
+			return fmt.Errorf("step for relay %v has a negative delay", v.Relay)
+		}
+		seen[v.Relay] = true
+	}
+	return nil
+}
+
+// HasDelays reports whether activating the scene waits between steps
+func (s Scene) HasDelays() bool {
+	for _, v := range s.Steps {
+		if v.Delay > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// plan returns every relay of the scene in the order it should be switched
+func (s Scene) plan() []SceneStep {
+	ret := append([]SceneStep{}, s.Steps...)
+	seen := make(map[uint8]bool)
+	for _, v := range s.Steps {
+		seen[v.Relay] = true
+	}
+	rest := []int{}
+	for k := range s.Relays {
+		if !seen[k] {
+			rest = append(rest, int(k))
+		}
+	}
+	sort.Ints(rest)
+	for _, v := range rest {
+		ret = append(ret, SceneStep{Relay: uint8(v)})
+	}
+	return ret
+}
+
+func (s Scene) displayName(id string) string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return id
+}
+
+// ActivateScene switches each relay of the scene in turn.  If any step fails,
+// the relays already switched are returned to the states they had before
+// their step.  It fails with ErrSceneActive if ctrl is already activating a
+// scene.
+func ActivateScene(ctrl RelayController, el eventer.Eventer, id string, s Scene, cause Cause) error {
+	return activateScene(systemClock{}, ctrl, el, id, s, cause)
+}
+
+// activateScene waits out the delays of the scene on clock
+func activateScene(clock Clock, ctrl RelayController, el eventer.Eventer, id string, s Scene, cause Cause) error {
+	sceneLock.Lock()
+	if activeScenes[ctrl] {
+		sceneLock.Unlock()
+		return ErrSceneActive
+	}
+	activeScenes[ctrl] = true
+	sceneLock.Unlock()
+	defer func() {
+		sceneLock.Lock()
+		delete(activeScenes, ctrl)
+		sceneLock.Unlock()
+	}()
+
+	prev := make(map[uint8]uint8)
+	done := []uint8{}
+	for _, step := range s.plan() {
+		clock.Sleep(time.Duration(step.Delay))
+		status, err := ctrl.Status()
+		if err == nil {
+			for _, v := range status.States {
+				if v.Relay == step.Relay {
+					prev[v.Relay] = v.State
+				}
+			}
+			err = setRelay(ctrl, step.Relay, s.Relays[step.Relay], cause)
+		}
+		if err != nil {
+			// Put everything back the way we found it
+			for i := len(done) - 1; i >= 0; i-- {
+				action := Off
+				if prev[done[i]] == 1 {
+					action = On
+				}
+				setRelay(ctrl, done[i], action, Cause{Reason: "scene rollback", Actor: cause.Actor})
+			}
+			el.Event(eventer.Event{
+				Type:     eventer.TypeScene,
+				Relay:    step.Relay,
+				Name:     s.displayName(id),
+				Actor:    cause.Actor,
+				Cause:    err.Error(),
+				NewState: "rolled back",
+			})
+			return err
+		}
+		done = append(done, step.Relay)
+	}
+	el.Event(eventer.Event{
+		Type:     eventer.TypeScene,
+		Name:     s.displayName(id),
+		Actor:    cause.Actor,
+		Cause:    cause.Reason,
+		NewState: "activated",
+	})
+	return nil
+}
+
+// setRelay performs a single on/off action against a relay
+func setRelay(ctrl RelayController, relay uint8, action Action, cause Cause) error {
+	switch action {
+	case On:
+		return ctrl.On(relay, cause)
+	case Off:
+		return ctrl.Off(relay, cause)
+	}
+	return fmt.Errorf("invalid action %q", action)
+}
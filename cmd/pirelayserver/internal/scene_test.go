@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSceneValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		scene   Scene
+		wantErr bool
+	}{
+		{
+			name:  "valid",
+			scene: Scene{Relays: map[uint8]Action{1: On, 2: Off}, Steps: []SceneStep{{Relay: 2, Delay: Duration(time.Second)}}},
+		},
+		{
+			name:    "no relays",
+			scene:   Scene{},
+			wantErr: true,
+		},
+		{
+			name:    "invalid action",
+			scene:   Scene{Relays: map[uint8]Action{1: SceneAction}},
+			wantErr: true,
+		},
+		{
+			name:    "step without a state",
+			scene:   Scene{Relays: map[uint8]Action{1: On}, Steps: []SceneStep{{Relay: 2}}},
+			wantErr: true,
+		},
+		{
+			name:    "relay in two steps",
+			scene:   Scene{Relays: map[uint8]Action{1: On}, Steps: []SceneStep{{Relay: 1}, {Relay: 1}}},
+			wantErr: true,
+		},
+		{
+			name:    "negative delay",
+			scene:   Scene{Relays: map[uint8]Action{1: On}, Steps: []SceneStep{{Relay: 1, Delay: Duration(-time.Second)}}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.scene.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestScenePlan(t *testing.T) {
+	s := Scene{
+		Relays: map[uint8]Action{1: On, 2: On, 3: On, 4: Off},
+		Steps:  []SceneStep{{Relay: 3}, {Relay: 1, Delay: Duration(time.Second)}},
+	}
+	want := []SceneStep{{Relay: 3}, {Relay: 1, Delay: Duration(time.Second)}, {Relay: 2}, {Relay: 4}}
+	if got := s.plan(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestActivateScene(t *testing.T) {
+	tests := []struct {
+		name string
+		// on lists the relays switched on before the scene is activated
+		on      []uint8
+		scene   Scene
+		want    []uint8
+		wantErr bool
+	}{
+		{
+			name:  "every relay",
+			on:    []uint8{3},
+			scene: Scene{Relays: map[uint8]Action{1: On, 2: On, 3: Off}},
+			want:  []uint8{1, 1, 0},
+		},
+		{
+			name:  "relays left out are untouched",
+			on:    []uint8{3},
+			scene: Scene{Relays: map[uint8]Action{1: On}},
+			want:  []uint8{1, 0, 1},
+		},
+		{
+			name:  "with steps",
+			scene: Scene{Relays: map[uint8]Action{1: On, 2: On}, Steps: []SceneStep{{Relay: 2, Delay: Duration(time.Millisecond)}}},
+			want:  []uint8{1, 1, 0},
+		},
+		{
+			name:    "rolled back when a relay fails",
+			on:      []uint8{2},
+			scene:   Scene{Relays: map[uint8]Action{1: On, 2: Off, 9: On}},
+			want:    []uint8{0, 1, 0},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, el := newTestController(t, 3, Config{})
+			for _, v := range tt.on {
+				err := c.On(v, testCause)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := ActivateScene(c, el, "s", tt.scene, testCause)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got := relayStates(t, c); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// gateClock is a Clock whose sleeps last until the test opens the gate
+type gateClock struct {
+	systemClock
+	gate chan struct{}
+}
+
+func (c gateClock) Sleep(d time.Duration) {
+	if d > 0 {
+		<-c.gate
+	}
+}
+
+func TestActivateSceneConcurrently(t *testing.T) {
+	tests := []struct {
+		name string
+		// first is activated first, and is still waiting out its delay when
+		// second is activated
+		first   Scene
+		second  Scene
+		want    []uint8
+		wantErr bool
+	}{
+		{
+			name:   "second rejected",
+			first:  Scene{Relays: map[uint8]Action{1: On, 2: On}, Steps: []SceneStep{{Relay: 1}, {Relay: 2, Delay: Duration(time.Hour)}}},
+			second: Scene{Relays: map[uint8]Action{1: Off, 2: Off, 3: On}},
+			want:   []uint8{1, 1, 0},
+		},
+		{
+			name:    "first rolled back",
+			first:   Scene{Relays: map[uint8]Action{1: On, 9: On}, Steps: []SceneStep{{Relay: 1}, {Relay: 9, Delay: Duration(time.Hour)}}},
+			second:  Scene{Relays: map[uint8]Action{1: On, 3: On}},
+			want:    []uint8{0, 0, 0},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, el := newTestController(t, 3, Config{})
+			clock := gateClock{gate: make(chan struct{})}
+			done := make(chan error)
+			go func() {
+				done <- activateScene(clock, c, el, "first", tt.first, testCause)
+			}()
+			waitFor(t, "the first step", func() bool { return relayStates(t, c)[0] == 1 })
+
+			err := ActivateScene(c, el, "second", tt.second, testCause)
+			if err != ErrSceneActive {
+				t.Errorf("got error %v, want %v", err, ErrSceneActive)
+			}
+			// Scenes on other controllers aren't held up
+			other, _ := newTestController(t, 3, Config{})
+			err = ActivateScene(other, el, "second", tt.second, testCause)
+			if err != nil {
+				t.Errorf("got error %v on another controller, want none", err)
+			}
+
+			close(clock.gate)
+			err = <-done
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got := relayStates(t, c); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			err = ActivateScene(c, el, "second", tt.second, testCause)
+			if err != nil {
+				t.Errorf("got error %v once the first finished, want none", err)
+			}
+		})
+	}
+}
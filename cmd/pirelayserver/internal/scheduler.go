@@ -0,0 +1,500 @@
+package internal
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/robfig/cron/v3"
+
+	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal/eventer"
+)
+
+// profileCheck is when the active profile is re-evaluated each day
+const profileCheck = "0 0 * * *"
+
+// missedCheck is how often the schedules are checked for missed runs
+const missedCheck = "* * * * *"
+
+// historyFlush is how often the time of the last missed run check is written
+// to the run history, if nothing else has written it since
+const historyFlush = "@hourly"
+
+// scheduler owns the cron entries for a relay controller.  Both the pi and
+// stub controllers share it so schedule handling only lives in one place.
+type scheduler struct {
+	cron    *cronLoop
+	clock   Clock
+	logger  log.Logger
+	ctrl    RelayController
+	cfger   Configurer
+	el      eventer.Eventer
+	sensors SensorReader
+	rules   *ruleEngine
+	history *RunHistory
+	entries map[string]cron.EntryID
+	// scheduled holds the schedules currently in the cron, along with when
+	// each was added so occurrences before that aren't reported missed
+	scheduled []Schedule
+	added     map[string]time.Time
+	seed      int64
+	profile   string
+	away      bool
+	applied   bool
+	m         sync.Mutex
+}
+
+func newScheduler(l log.Logger, clock Clock, ctrl RelayController, cfger Configurer, el eventer.Eventer, sensors SensorReader, rules *ruleEngine, history *RunHistory) *scheduler {
+	return &scheduler{
+		cron:    newCronLoop(clock),
+		clock:   clock,
+		logger:  l,
+		ctrl:    ctrl,
+		cfger:   cfger,
+		el:      el,
+		sensors: sensors,
+		rules:   rules,
+		history: history,
+		entries: make(map[string]cron.EntryID),
+		added:   make(map[string]time.Time),
+	}
+}
+
+// apply replaces every cron entry with the schedules active under cfg.  While
+// away mode is in effect the normal schedules are suspended in favor of the
+// away schedules.  If any schedule can't be parsed the entries already in
+// the cron are kept.
+func (s *scheduler) apply(cfg Config) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	now := s.clock.Now()
+	profile := cfg.ResolveProfile(now)
+	normal := cfg.ActiveSchedules(now)
+	away := cfg.Away.Active(now)
+	schedules, cause := normal, Cause{Reason: "scheduled action", Actor: ActorScheduler}
+	if away {
+		schedules, cause.Reason = cfg.Away.Schedules, "away mode schedule"
+	}
+
+	// Work out every spec before touching the cron, so a bad schedule leaves
+	// the ones already running in place
+	specs := make([]cron.Schedule, len(schedules))
+	for i, sch := range schedules {
+		spec, err := sch.Spec(cfg.JitterSeed)
+		if err != nil {
+			return err
+		}
+		specs[i] = spec
+	}
+
+	s.cron.Stop()
+	s.clear()
+	for i, sch := range schedules {
+		f := s.createToggleFunction(sch, specs[i], schedules, cause)
+		s.entries[sch.ID] = s.cron.Schedule(specs[i], f)
+	}
+	s.track(schedules, now)
+	s.seed = cfg.JitterSeed
+	s.forget(cfg)
+	_, err := s.cron.AddFunc(profileCheck, s.checkProfile)
+	if err != nil {
+		return err
+	}
+	if s.history != nil {
+		_, err = s.cron.AddFunc(missedCheck, s.checkMissed)
+		if err != nil {
+			return err
+		}
+		_, err = s.cron.AddFunc(historyFlush, s.flushHistory)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.Away != nil {
+		// Wake up again when away mode starts or ends
+		for _, t := range []time.Time{cfg.Away.Start, cfg.Away.End} {
+			if now.Before(t) {
+				s.cron.Schedule(once(t), s.reconcile)
+			}
+		}
+	}
+	s.cron.Start()
+
+	if profile != s.profile {
+		// The profile in effect at startup isn't a switch
+		if s.applied {
+			s.logger.Log("msg", "Switching schedule profile", "from", s.profile, "to", profile)
+			s.el.Event(eventer.Event{
+				Type:     eventer.TypeProfile,
+				Actor:    ActorScheduler,
+				OldState: profileName(s.profile),
+				NewState: profileName(profile),
+			})
+		}
+		s.profile = profile
+	}
+
+	switch {
+	case away && !s.away:
+		s.startAway(cfg.Away)
+	case !away && s.away:
+		s.endAway(normal, now)
+	case cfg.Away.Expired(now) && !s.applied:
+		// Away mode ended while the service was down
+		s.endAway(normal, now)
+	}
+	if cfg.Away.Expired(now) {
+		// apply may run inside a config update, so clear away mode once that
+		// has been stored
+		s.clock.AfterFunc(0, func() { s.clearAway(now) })
+	}
+	s.away = away
+	if !s.applied {
+		// Catch up on anything that should have run while the service was down
+		s.findMissed(now)
+	}
+	s.applied = true
+	return nil
+}
+
+// clearAway removes away mode from the stored config if it has expired
+func (s *scheduler) clearAway(now time.Time) {
+	err := s.cfger.Update(ActorScheduler, func(cfg *Config) error {
+		if !cfg.Away.Expired(now) {
+			return ErrUnchanged
+		}
+		cfg.Away = nil
+		return nil
+	})
+	if err != nil {
+		s.logger.Log("err", err)
+	}
+}
+
+// track notes when each of the scheduled entries was first added.  Entries
+// present when the service starts are treated as always having existed, so
+// occurrences while the service was down are reported missed.
+func (s *scheduler) track(schedules []Schedule, now time.Time) {
+	added := make(map[string]time.Time)
+	for _, sch := range schedules {
+		k := sch.ID + "|" + sch.Expression
+		t, ok := s.added[k]
+		if !ok && s.applied {
+			t = now
+		}
+		added[k] = t
+	}
+	s.added = added
+	s.scheduled = schedules
+}
+
+// checkMissed looks for runs missed since the last check
+func (s *scheduler) checkMissed() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.findMissed(s.clock.Now())
+}
+
+// findMissed records a missed run for every occurrence of the scheduled
+// entries between the last check and a minute ago that has no run recorded.
+// The minute's grace leaves time for the entries themselves to fire.
+func (s *scheduler) findMissed(now time.Time) {
+	if s.history == nil {
+		return
+	}
+	to := now.Add(-time.Minute)
+	from := s.history.checked()
+	if !to.After(from) {
+		return
+	}
+	if from.IsZero() {
+		// Nothing to compare against on the very first run
+		s.setChecked(to)
+		return
+	}
+	if from.Before(to.Add(-missedLookback)) {
+		from = to.Add(-missedLookback)
+	}
+	for _, sch := range s.scheduled {
+		spec, err := sch.Spec(s.seed)
+		if err != nil {
+			continue
+		}
+		start := from
+		if added := s.added[sch.ID+"|"+sch.Expression]; added.After(start) {
+			start = added
+		}
+		missed := 0
+		first := time.Time{}
+		n := spec.Next(start)
+		for i := 0; i < maxOccurrences && !n.IsZero() && !n.After(to); i++ {
+			following := spec.Next(n)
+			if following.IsZero() {
+				following = n.Add(missedLookback)
+			}
+			if !s.history.recordedSince(sch.ID, n, following) {
+				s.record(sch, Run{At: n, Outcome: RunMissed})
+				if missed == 0 {
+					first = n
+				}
+				missed++
+			}
+			n = following
+		}
+		if missed > 0 {
+			s.logger.Log("msg", "Missed schedule runs", "schedule", sch.ID, "count", missed, "first", first)
+			s.el.Event(scheduleEvent(eventer.TypeScheduleMissed, sch, fmt.Sprintf("missed %v time(s) since %v", missed, first.Format(time.RFC1123))))
+		}
+	}
+	s.setChecked(to)
+}
+
+// forget drops the run history of schedules that have been removed
+func (s *scheduler) forget(cfg Config) {
+	if s.history == nil {
+		return
+	}
+	keep := make(map[string]bool)
+	for _, sch := range cfg.AllSchedules() {
+		keep[sch.ID] = true
+	}
+	err := s.history.Forget(keep)
+	if err != nil {
+		s.logger.Log("err", err)
+	}
+}
+
+func (s *scheduler) setChecked(t time.Time) {
+	s.history.setChecked(t)
+}
+
+func (s *scheduler) flushHistory() {
+	err := s.history.Flush()
+	if err != nil {
+		s.logger.Log("err", err)
+	}
+}
+
+func (s *scheduler) record(sch Schedule, r Run) {
+	if s.history == nil {
+		return
+	}
+	err := s.history.Record(sch.ID, r)
+	if err != nil {
+		s.logger.Log("err", err)
+	}
+}
+
+// startAway forces relays into the states requested by away mode
+func (s *scheduler) startAway(a *AwayMode) {
+	s.logger.Log("msg", "Starting away mode", "end", a.End)
+	s.el.Event(eventer.Event{
+		Type:     eventer.TypeAway,
+		Actor:    ActorScheduler,
+		NewState: "started",
+		Cause:    fmt.Sprintf("normal schedules suspended until %v", a.End.Format(time.RFC1123)),
+	})
+	for k, v := range a.Relays {
+		s.act(k, v, Cause{Reason: "away mode", Actor: ActorScheduler})
+	}
+}
+
+// endAway returns each relay to the state the normal schedules last asked for
+func (s *scheduler) endAway(normal []Schedule, now time.Time) {
+	s.logger.Log("msg", "Ending away mode")
+	s.el.Event(eventer.Event{
+		Type:     eventer.TypeAway,
+		Actor:    ActorScheduler,
+		NewState: "ended",
+		Cause:    "normal schedules restored",
+	})
+	for k, v := range impliedStates(normal, s.seed, now, restoreLookback) {
+		s.act(k, v, Cause{Reason: "away mode ended", Actor: ActorScheduler})
+	}
+}
+
+func (s *scheduler) act(relay uint8, action Action, cause Cause) {
+	err := setRelay(s.ctrl, relay, action, cause)
+	if err != nil {
+		s.logger.Log("err", err, "relay", relay)
+	}
+}
+
+// reconcile reapplies the stored config, e.g. when away mode starts or ends
+func (s *scheduler) reconcile() {
+	cfg, err := s.cfger.Get()
+	if err != nil {
+		s.logger.Log("err", err)
+		return
+	}
+	err = s.ctrl.ApplyConfig(cfg)
+	if err != nil {
+		s.logger.Log("err", err)
+	}
+}
+
+// checkProfile reapplies the stored config when the date rules select a
+// different profile than the one currently scheduled
+func (s *scheduler) checkProfile() {
+	cfg, err := s.cfger.Get()
+	if err != nil {
+		s.logger.Log("err", err)
+		return
+	}
+	s.m.Lock()
+	current := s.profile
+	s.m.Unlock()
+	if cfg.ResolveProfile(s.clock.Now()) == current {
+		return
+	}
+	err = s.ctrl.ApplyConfig(cfg)
+	if err != nil {
+		s.logger.Log("err", err)
+	}
+}
+
+func profileName(p string) string {
+	if p == "" {
+		return "'none'"
+	}
+	return fmt.Sprintf("'%v'", p)
+}
+
+func (s *scheduler) clear() {
+	s.cron.RemoveAll()
+	s.entries = make(map[string]cron.EntryID)
+}
+
+// next returns when the given schedule next fires, if it is scheduled
+func (s *scheduler) next(id string) (time.Time, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	e, ok := s.entries[id]
+	if !ok {
+		return time.Time{}, false
+	}
+	return s.cron.Next(e)
+}
+
+func (s *scheduler) createToggleFunction(sch Schedule, spec cron.Schedule, peers []Schedule, cause Cause) func() {
+	relay := sch.Relay
+	var act func() error
+	switch sch.Action {
+	case On:
+		act = func() error {
+			s.logger.Log("msg", "Switching relay to On", "relay", relay, "cause", cause)
+			return s.ctrl.On(relay, cause)
+		}
+	case Off:
+		act = func() error {
+			s.logger.Log("msg", "Switching relay to Off", "relay", relay, "cause", cause)
+			return s.ctrl.Off(relay, cause)
+		}
+	case Pulse, Sequence:
+		act = func() error {
+			s.logger.Log("msg", "Starting relay sequence", "relay", relay, "action", sch.Action, "cause", cause)
+			return s.ctrl.RunSequence(relay, sch.SequenceSteps(), cause)
+		}
+	case SceneAction:
+		act = func() error {
+			s.logger.Log("msg", "Activating scene", "scene", sch.Scene, "cause", cause)
+			return s.activateScene(sch.Scene, cause)
+		}
+	default:
+		return func() {}
+	}
+	return func() {
+		start := s.clock.Now()
+		if winner, ok := s.outranked(sch, spec, peers); ok {
+			s.record(sch, Run{At: start, Outcome: RunSkipped, Reason: fmt.Sprintf("outranked by schedule %v", winner.ID)})
+			return
+		}
+		if reason := s.conditionFails(sch); reason != "" {
+			s.record(sch, Run{At: start, Outcome: RunSkipped, Reason: reason})
+			return
+		}
+		err := act()
+		run := Run{At: start, Outcome: RunSucceeded, Duration: Duration(s.clock.Now().Sub(start))}
+		if err != nil {
+			s.logger.Log("err", err, "schedule", sch.ID)
+			s.el.Event(scheduleEvent(eventer.TypeScheduleFailed, sch, err.Error()))
+			run.Outcome, run.Error = RunFailed, err.Error()
+		}
+		s.record(sch, run)
+		if err == nil {
+			s.el.Event(scheduleEvent(eventer.TypeScheduleFired, sch, cause.Reason))
+			s.rules.scheduleFired(sch)
+		}
+	}
+}
+
+// conditionFails evaluates the condition of a schedule at fire time and
+// returns why the schedule should be skipped, if it should.  A schedule whose
+// condition is false, or can't be evaluated, is skipped and the skip is
+// recorded as an event.
+func (s *scheduler) conditionFails(sch Schedule) string {
+	if sch.Condition == "" {
+		return ""
+	}
+	var reason string
+	ok, err := EvalCondition(sch.Condition, s.ctrl, s.sensors)
+	switch {
+	case err != nil:
+		s.logger.Log("err", err, "schedule", sch.ID)
+		reason = fmt.Sprintf("%v: %v", conditionError, err)
+	case !ok:
+		s.logger.Log("msg", "Skipping schedule, condition false", "schedule", sch.ID)
+		reason = fmt.Sprintf("condition false: %v", sch.Condition)
+	default:
+		return ""
+	}
+	s.el.Event(scheduleEvent(eventer.TypeScheduleSkipped, sch, reason))
+	return reason
+}
+
+// scheduleEvent describes something that happened to sch, and why.  Schedules
+// are named by their id.
+func scheduleEvent(t eventer.Type, sch Schedule, cause string) eventer.Event {
+	state := string(sch.Action)
+	if sch.Action == SceneAction {
+		state = fmt.Sprintf("scene '%v'", sch.Scene)
+	}
+	return eventer.Event{
+		Type:     t,
+		Relay:    sch.Relay,
+		Name:     sch.ID,
+		Actor:    ActorScheduler,
+		Cause:    cause,
+		NewState: state,
+	}
+}
+
+// activateScene looks the scene up at fire time so edits to a scene don't
+// require the schedules to be reapplied
+func (s *scheduler) activateScene(id string, cause Cause) error {
+	cfg, err := s.cfger.Get()
+	if err != nil {
+		return err
+	}
+	sc, ok := cfg.Scenes[id]
+	if !ok {
+		return fmt.Errorf("scene %v not found", id)
+	}
+	return activateScene(s.clock, s.ctrl, s.el, id, sc, cause)
+}
+
+// outranked reports whether a higher priority schedule with a different action
+// fires on the same relay during the current minute, in which case sch yields
+func (s *scheduler) outranked(sch Schedule, spec cron.Schedule, peers []Schedule) (Schedule, bool) {
+	now := s.clock.Now()
+	var scenes map[string]Scene
+	if cfg, err := s.cfger.Get(); err == nil {
+		scenes = cfg.Scenes
+	}
+	winner, ok := OutrankedBy(sch, peers, scenes, nominalTime(spec, now))
+	if ok {
+		s.logger.Log("msg", "Skipping outranked schedule", "schedule", sch.ID, "winner", winner.ID, "relay", sch.Relay)
+	}
+	return winner, ok
+}
@@ -0,0 +1,45 @@
+package internal
+
+import "testing"
+
+func TestApplyConfig(t *testing.T) {
+	a := Schedule{ID: "a", Relay: 1, Expression: "0 8 * * *", Action: On}
+	b := Schedule{ID: "b", Relay: 2, Expression: "0 20 * * *", Action: Off}
+	tests := []struct {
+		name      string
+		schedules []Schedule
+		// want lists whether each schedule is scheduled afterwards
+		want    map[string]bool
+		wantErr bool
+	}{
+		{
+			name:      "replaced",
+			schedules: []Schedule{b},
+			want:      map[string]bool{"a": false, "b": true},
+		},
+		{
+			name:      "invalid expression",
+			schedules: []Schedule{b, {ID: "c", Relay: 1, Expression: "bad", Action: On}},
+			want:      map[string]bool{"a": true, "b": false, "c": false},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newTestController(t, 2, Config{})
+			err := c.ApplyConfig(Config{Schedules: []Schedule{a}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = c.ApplyConfig(Config{Schedules: tt.schedules})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			for id, want := range tt.want {
+				if _, got := c.NextRun(id); got != want {
+					t.Errorf("got %v scheduled %v, want %v", id, got, want)
+				}
+			}
+		})
+	}
+}
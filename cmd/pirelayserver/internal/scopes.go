@@ -5,7 +5,9 @@ const (
 	ReadEvents       = "read:events"
 	ReadMe           = "read:me"
 	ReadRelays       = "read:relays"
+	ReadSensors      = "read:sensors"
 	WriteConfig      = "write:config"
 	WriteRelayName   = "write:relay.name"
 	WriteRelayToggle = "write:relay.toggle"
+	WriteSensors     = "write:sensors"
 )
@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// Reading is a single sensor value
+type Reading struct {
+	Value float64   `json:"value"`
+	Stamp time.Time `json:"stamp"`
+}
+
+// SensorReader provides the latest reading of each sensor
+type SensorReader interface {
+	Readings() map[string]Reading
+}
+
+// SensorStore keeps the latest reading reported for each sensor in memory.
+// Readings older than maxAge are treated as missing so that conditions never
+// act on stale data.
+type SensorStore struct {
+	readings map[string]Reading
+	maxAge   time.Duration
+	m        sync.RWMutex
+}
+
+func NewSensorStore(maxAge time.Duration) *SensorStore {
+	return &SensorStore{
+		readings: make(map[string]Reading),
+		maxAge:   maxAge,
+	}
+}
+
+// Set records a reading for the named sensor
+func (s *SensorStore) Set(name string, r Reading) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.readings[name] = r
+}
+
+// Readings returns every reading that hasn't gone stale
+func (s *SensorStore) Readings() map[string]Reading {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	ret := make(map[string]Reading)
+	for k, v := range s.readings {
+		if s.maxAge > 0 && time.Since(v.Stamp) > s.maxAge {
+			continue
+		}
+		ret[k] = v
+	}
+	return ret
+}
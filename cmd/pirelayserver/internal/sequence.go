@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal/eventer"
+)
+
+// SequenceStep switches a relay on or off after waiting for Delay
+type SequenceStep struct {
+	Action Action   `json:"action"`
+	Delay  Duration `json:"delay,omitempty"`
+}
+
+// PulseSteps returns the sequence for switching a relay on for d, then off
+func PulseSteps(d Duration) []SequenceStep {
+	return []SequenceStep{
+		{Action: On},
+		{Action: Off, Delay: d},
+	}
+}
+
+// ValidateSteps checks that a sequence can be run
+func ValidateSteps(steps []SequenceStep) error {
+	if len(steps) == 0 {
+		return fmt.Errorf("sequence must have at least one step")
+	}
+	for k, v := range steps {
+		if v.Action != On && v.Action != Off {
+			return fmt.Errorf("step %v has invalid action %q", k, v.Action)
+		}
+		if v.Delay < 0 {
+			return fmt.Errorf("step %v has a negative delay", k)
+		}
+	}
+	return nil
+}
+
+// sequence is a running sequence that can be cancelled
+type sequence struct {
+	cancel context.CancelFunc
+}
+
+// sequencer runs relay sequences in the background, at most one per relay, so
+// a long sequence never holds up the other relays
+type sequencer struct {
+	ctrl    RelayController
+	clock   Clock
+	logger  log.Logger
+	el      eventer.Eventer
+	running map[uint8]*sequence
+	m       sync.Mutex
+}
+
+func newSequencer(l log.Logger, clock Clock, ctrl RelayController, el eventer.Eventer) *sequencer {
+	return &sequencer{
+		ctrl:    ctrl,
+		clock:   clock,
+		logger:  l,
+		el:      el,
+		running: make(map[uint8]*sequence),
+	}
+}
+
+// run starts the sequence on relay, replacing any sequence already running
+// on it
+func (q *sequencer) run(relay uint8, steps []SequenceStep, cause Cause) error {
+	if !q.ctrl.IsValidRelay(relay) {
+		return fmt.Errorf("%v is an invalid relay", relay)
+	}
+	if err := ValidateSteps(steps); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	seq := &sequence{cancel: cancel}
+	q.m.Lock()
+	if prev, ok := q.running[relay]; ok {
+		prev.cancel()
+	}
+	q.running[relay] = seq
+	q.m.Unlock()
+
+	q.next(ctx, relay, seq, steps, cause)
+	return nil
+}
+
+// next waits for the first of steps, performs it and goes on to the rest,
+// unless the sequence is cancelled in the meantime
+func (q *sequencer) next(ctx context.Context, relay uint8, seq *sequence, steps []SequenceStep, cause Cause) {
+	if len(steps) == 0 {
+		q.finish(relay, seq)
+		return
+	}
+	st := steps[0]
+	q.clock.AfterFunc(time.Duration(st.Delay), func() {
+		if ctx.Err() != nil {
+			return
+		}
+		err := setRelay(q.ctrl, relay, st.Action, cause)
+		if err != nil {
+			q.logger.Log("err", err, "relay", relay)
+			q.finish(relay, seq)
+			return
+		}
+		q.next(ctx, relay, seq, steps[1:], cause)
+	})
+}
+
+// finish forgets seq unless it has already been replaced
+func (q *sequencer) finish(relay uint8, seq *sequence) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	if q.running[relay] == seq {
+		delete(q.running, relay)
+	}
+	seq.cancel()
+}
+
+// stop cancels the sequence running on relay, leaving the relay in whatever
+// state the sequence last set.  It reports whether a sequence was running.
+func (q *sequencer) stop(relay uint8) bool {
+	q.m.Lock()
+	seq, ok := q.running[relay]
+	delete(q.running, relay)
+	q.m.Unlock()
+	if !ok {
+		return false
+	}
+	seq.cancel()
+	q.el.Event(eventer.Event{
+		Type:     eventer.TypeSequence,
+		Relay:    relay,
+		NewState: "cancelled",
+	})
+	return true
+}
@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestValidateSteps(t *testing.T) {
+	tests := []struct {
+		name    string
+		steps   []SequenceStep
+		wantErr bool
+	}{
+		{
+			name:  "pulse",
+			steps: PulseSteps(Duration(time.Second)),
+		},
+		{
+			name:    "no steps",
+			steps:   []SequenceStep{},
+			wantErr: true,
+		},
+		{
+			name:    "invalid action",
+			steps:   []SequenceStep{{Action: Pulse}},
+			wantErr: true,
+		},
+		{
+			name:    "negative delay",
+			steps:   []SequenceStep{{Action: On, Delay: Duration(-time.Second)}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateSteps(tt.steps)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunSequence(t *testing.T) {
+	tests := []struct {
+		name    string
+		relay   uint8
+		steps   []SequenceStep
+		want    []uint8
+		wantErr bool
+		// wantSwitches is how many times the relay is switched
+		wantSwitches int
+	}{
+		{
+			name:         "pulse",
+			relay:        2,
+			steps:        PulseSteps(Duration(time.Millisecond)),
+			want:         []uint8{0, 0, 0},
+			wantSwitches: 2,
+		},
+		{
+			name:  "sequence",
+			relay: 1,
+			steps: []SequenceStep{
+				{Action: On},
+				{Action: Off, Delay: Duration(time.Millisecond)},
+				{Action: On, Delay: Duration(time.Millisecond)},
+			},
+			want:         []uint8{1, 0, 0},
+			wantSwitches: 3,
+		},
+		{
+			name:    "relay 0",
+			relay:   0,
+			steps:   PulseSteps(Duration(time.Millisecond)),
+			want:    []uint8{0, 0, 0},
+			wantErr: true,
+		},
+		{
+			name:    "relay out of range",
+			relay:   4,
+			steps:   PulseSteps(Duration(time.Millisecond)),
+			want:    []uint8{0, 0, 0},
+			wantErr: true,
+		},
+		{
+			name:    "invalid steps",
+			relay:   1,
+			steps:   []SequenceStep{},
+			want:    []uint8{0, 0, 0},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, el := newTestController(t, 3, Config{})
+			err := c.RunSequence(tt.relay, tt.steps, testCause)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			waitFor(t, "the sequence to finish", func() bool {
+				c.sequencer.m.Lock()
+				defer c.sequencer.m.Unlock()
+				return len(c.sequencer.running) == 0
+			})
+			if got := relayStates(t, c); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if events, _ := el.ListAll(); len(events) != tt.wantSwitches {
+				t.Errorf("got %v switches, want %v", len(events), tt.wantSwitches)
+			}
+		})
+	}
+}
+
+func TestCancelSequence(t *testing.T) {
+	c, _ := newTestController(t, 3, Config{})
+	err := c.RunSequence(1, PulseSteps(Duration(time.Hour)), testCause)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the relay to switch on", func() bool {
+		return relayStates(t, c)[0] == 1
+	})
+	if !c.CancelSequence(1) {
+		t.Errorf("got no sequence cancelled, want the pulse cancelled")
+	}
+	if c.CancelSequence(1) {
+		t.Errorf("got a sequence cancelled twice")
+	}
+	if got, want := relayStates(t, c), []uint8{1, 0, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
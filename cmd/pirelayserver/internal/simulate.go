@@ -0,0 +1,453 @@
+package internal
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal/eventer"
+)
+
+const (
+	// MaxSimulationRange bounds how much virtual time a single simulation
+	// may cover
+	MaxSimulationRange = 400 * 24 * time.Hour
+	// maxSimulationSteps bounds how many timers a simulation runs so that
+	// runaway expressions like `@every 1s` can't stall the service
+	maxSimulationSteps = 1000000
+)
+
+// virtualClock is a Clock whose time only moves when the simulation moves it.
+// It runs one call at a time, and only starts the next once everything the
+// last one set going has finished or gone to sleep, so a simulation always
+// plays out the same way.
+type virtualClock struct {
+	now    time.Time
+	timers virtualTimers
+	order  int
+	// busy counts the calls running, less those asleep
+	busy int
+	idle *sync.Cond
+	// work hands calls to the workers waiting for one
+	work chan func()
+	// A stopped clock runs nothing more and lets sleepers straight through
+	stopped bool
+	m       sync.Mutex
+}
+
+// virtualTimer is a call, or a sleeper, waiting on a virtualClock
+type virtualTimer struct {
+	c     *virtualClock
+	at    time.Time
+	order int
+	f     func()
+	wake  chan struct{}
+	done  bool
+}
+
+func newVirtualClock(now time.Time) *virtualClock {
+	c := &virtualClock{now: now, work: make(chan func())}
+	c.idle = sync.NewCond(&c.m)
+	return c
+}
+
+func (c *virtualClock) Now() time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.now
+}
+
+func (c *virtualClock) Sleep(d time.Duration) {
+	c.m.Lock()
+	if c.stopped {
+		c.m.Unlock()
+		return
+	}
+	t := &virtualTimer{c: c, wake: make(chan struct{})}
+	c.add(d, t)
+	c.busy--
+	c.idle.Broadcast()
+	c.m.Unlock()
+	<-t.wake
+}
+
+func (c *virtualClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.m.Lock()
+	defer c.m.Unlock()
+	t := &virtualTimer{c: c, f: f, done: c.stopped}
+	if !c.stopped {
+		c.add(d, t)
+	}
+	return t
+}
+
+func (c *virtualClock) add(d time.Duration, t *virtualTimer) {
+	c.order++
+	t.at, t.order = c.now.Add(d), c.order
+	heap.Push(&c.timers, t)
+}
+
+func (t *virtualTimer) Stop() bool {
+	t.c.m.Lock()
+	defer t.c.m.Unlock()
+	stopped := !t.done
+	t.done = true
+	return stopped
+}
+
+// step waits for the calls in progress, then moves the clock on to the next
+// timer due by end and starts it.  It reports false once nothing more is due.
+func (c *virtualClock) step(end time.Time) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.wait()
+	for c.timers.Len() > 0 {
+		t := c.timers[0]
+		if t.at.After(end) {
+			return false
+		}
+		heap.Pop(&c.timers)
+		if t.done {
+			continue
+		}
+		t.done = true
+		if t.at.After(c.now) {
+			c.now = t.at
+		}
+		c.busy++
+		if t.wake != nil {
+			close(t.wake)
+			return true
+		}
+		select {
+		case c.work <- t.f:
+		default:
+			// Every worker is busy or asleep
+			go c.worker(t.f)
+		}
+		return true
+	}
+	return false
+}
+
+// worker runs f, then any calls it is handed until the clock stops
+func (c *virtualClock) worker(f func()) {
+	for ok := true; ok; f, ok = <-c.work {
+		f()
+		c.m.Lock()
+		c.busy--
+		c.idle.Broadcast()
+		c.m.Unlock()
+	}
+}
+
+// settle waits for the calls in progress
+func (c *virtualClock) settle() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.wait()
+}
+
+// stop drops the timers still waiting, and wakes the sleepers so that they
+// can finish
+func (c *virtualClock) stop() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.wait()
+	c.stopped = true
+	for _, t := range c.timers {
+		if !t.done && t.wake != nil {
+			t.done = true
+			c.busy++
+			close(t.wake)
+		}
+	}
+	c.timers = nil
+	c.wait()
+	close(c.work)
+}
+
+func (c *virtualClock) wait() {
+	for c.busy > 0 {
+		c.idle.Wait()
+	}
+}
+
+// virtualTimers orders timers by when they are due, then by when they were
+// set
+type virtualTimers []*virtualTimer
+
+func (a virtualTimers) Len() int { return len(a) }
+func (a virtualTimers) Less(i, j int) bool {
+	if !a[i].at.Equal(a[j].at) {
+		return a[i].at.Before(a[j].at)
+	}
+	return a[i].order < a[j].order
+}
+func (a virtualTimers) Swap(i, j int)       { a[i], a[j] = a[j], a[i] }
+func (a *virtualTimers) Push(x interface{}) { *a = append(*a, x.(*virtualTimer)) }
+func (a *virtualTimers) Pop() interface{} {
+	old := *a
+	n := len(old)
+	t := old[n-1]
+	*a = old[:n-1]
+	return t
+}
+
+// clockEventer is an in-memory Eventer that stamps events using a Clock
+type clockEventer struct {
+	clock  Clock
+	events []eventer.Event
+	m      sync.RWMutex
+}
+
+func (l *clockEventer) Event(e eventer.Event) error {
+	l.m.Lock()
+	defer l.m.Unlock()
+	e.ID = uint64(len(l.events)) + 1
+	l.events = append(l.events, e.Fill(l.clock.Now()))
+	return nil
+}
+
+func (l *clockEventer) ListAll() ([]eventer.Event, error) {
+	l.m.RLock()
+	defer l.m.RUnlock()
+	ret := make([]eventer.Event, len(l.events))
+	copy(ret, l.events)
+	return ret, nil
+}
+
+func (l *clockEventer) Query(q eventer.Query) (eventer.Page, error) {
+	l.m.RLock()
+	defer l.m.RUnlock()
+	return eventer.QuerySlice(l.events, q), nil
+}
+
+// staticConfigurer is a Configurer that only keeps a config in memory
+type staticConfigurer struct {
+	cfg Config
+	m   sync.RWMutex
+}
+
+func (c *staticConfigurer) Get() (Config, error) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.cfg, nil
+}
+
+func (c *staticConfigurer) Set(cfg Config) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.cfg = cfg
+	return nil
+}
+
+func (c *staticConfigurer) Update(actor string, fn func(*Config) error) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	cfg, err := c.cfg.Clone()
+	if err != nil {
+		return err
+	}
+	err = fn(&cfg)
+	if err == ErrUnchanged {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.cfg = cfg
+	return nil
+}
+
+func (c *staticConfigurer) Revision() uint64 {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.cfg.Revision
+}
+
+// SimulationRequest describes a dry run of a config over a range of time
+type SimulationRequest struct {
+	Config  Config             `json:"config"`
+	From    time.Time          `json:"from"`
+	To      time.Time          `json:"to"`
+	Relays  uint8              `json:"relays"`
+	Initial map[uint8]Action   `json:"initial,omitempty"`
+	Sensors map[string]float64 `json:"sensors,omitempty"`
+}
+
+// Transition is a relay changing state during a simulation
+type Transition struct {
+	At    time.Time `json:"at"`
+	Relay uint8     `json:"relay"`
+	State Action    `json:"state"`
+	Cause string    `json:"cause"`
+}
+
+type ViolationKind string
+
+const (
+	ConflictViolation  ViolationKind = "conflict"
+	FailedViolation    ViolationKind = "failed"
+	ConditionViolation ViolationKind = "condition_error"
+)
+
+// Violation is something a simulation found that would go wrong for real
+type Violation struct {
+	At       time.Time     `json:"at"`
+	Kind     ViolationKind `json:"kind"`
+	Relay    uint8         `json:"relay,omitempty"`
+	Schedule string        `json:"schedule,omitempty"`
+	Rule     string        `json:"rule,omitempty"`
+	Msg      string        `json:"msg"`
+}
+
+// SimulationResult is the outcome of a simulation
+type SimulationResult struct {
+	From        time.Time          `json:"from"`
+	To          time.Time          `json:"to"`
+	Transitions []Transition       `json:"transitions"`
+	OnTime      map[uint8]Duration `json:"onTime"`
+	Violations  []Violation        `json:"violations"`
+	Events      []eventer.Event    `json:"events"`
+	Truncated   bool               `json:"truncated,omitempty"`
+}
+
+// Simulate runs req.Config on a StubRelayController driven by a virtual clock
+// from req.From to req.To, using the same scheduler, rules and sequences as
+// the service, and reports the relay transitions it would cause.  Nothing
+// touches real relays.  The config should have been validated against
+// req.Relays; anything that fails at run time is reported as a violation.
+func Simulate(req SimulationRequest) (SimulationResult, error) {
+	if !req.To.After(req.From) {
+		return SimulationResult{}, fmt.Errorf("simulation must end after it starts")
+	}
+	if req.To.Sub(req.From) > MaxSimulationRange {
+		return SimulationResult{}, fmt.Errorf("simulation may cover at most %v", MaxSimulationRange)
+	}
+	if req.Relays == 0 {
+		return SimulationResult{}, fmt.Errorf("simulation needs at least one relay")
+	}
+
+	clock := newVirtualClock(req.From)
+	el := &clockEventer{clock: clock}
+	sensors := NewSensorStore(0)
+	for k, v := range req.Sensors {
+		sensors.Set(k, Reading{Value: v, Stamp: req.From})
+	}
+	stub := newStubRelayController(log.NewNopLogger(), clock, req.Relays, &staticConfigurer{cfg: req.Config}, el, sensors, nil, nil)
+	for k, v := range req.Initial {
+		if k >= 1 && k <= req.Relays {
+			stub.relayStates[k-1] = v == On
+		}
+	}
+	initial, err := stub.Status()
+	if err != nil {
+		return SimulationResult{}, err
+	}
+	err = stub.ApplyConfig(req.Config)
+	if err != nil {
+		return SimulationResult{}, err
+	}
+
+	res := SimulationResult{
+		From:        req.From,
+		To:          req.To,
+		Transitions: []Transition{},
+		OnTime:      make(map[uint8]Duration),
+		Violations:  []Violation{},
+	}
+	for steps := 0; ; steps++ {
+		if steps == maxSimulationSteps {
+			res.Truncated = true
+			break
+		}
+		if !clock.step(req.To) {
+			break
+		}
+	}
+	clock.settle()
+	res.Events, _ = el.ListAll()
+	clock.stop()
+
+	onSince := make(map[uint8]time.Time)
+	for _, v := range initial.States {
+		res.OnTime[v.Relay] = 0
+		if v.State == 1 {
+			onSince[v.Relay] = req.From
+		}
+	}
+	report(&res, onSince)
+	return res, nil
+}
+
+// report works out the transitions, on time and violations of a simulation
+// from the events it recorded.  onSince holds the relays that started on.
+func report(res *SimulationResult, onSince map[uint8]time.Time) {
+	// fired holds the schedules that switched each relay, by minute
+	fired := make(map[string][]eventer.Event)
+	for _, e := range res.Events {
+		switch e.Type {
+		case eventer.TypeRelayOn, eventer.TypeRelayOff:
+			if e.OldState == e.NewState {
+				continue
+			}
+			state := Action(e.NewState)
+			res.Transitions = append(res.Transitions, Transition{
+				At:    e.Stamp,
+				Relay: e.Relay,
+				State: state,
+				Cause: Cause{Reason: e.Cause, Actor: e.Actor}.String(),
+			})
+			if state == On {
+				onSince[e.Relay] = e.Stamp
+			} else if t, ok := onSince[e.Relay]; ok {
+				res.OnTime[e.Relay] += Duration(e.Stamp.Sub(t))
+				delete(onSince, e.Relay)
+			}
+		case eventer.TypeScheduleFired:
+			if e.Relay == 0 {
+				continue
+			}
+			k := fmt.Sprintf("%v|%v", e.Relay, e.Stamp.Truncate(time.Minute).Unix())
+			for _, p := range fired[k] {
+				if p.NewState == e.NewState || p.Name == e.Name {
+					continue
+				}
+				ids := []string{p.Name, e.Name}
+				sort.Strings(ids)
+				res.Violations = append(res.Violations, Violation{
+					At:       e.Stamp,
+					Kind:     ConflictViolation,
+					Relay:    e.Relay,
+					Schedule: e.Name,
+					Msg:      fmt.Sprintf("schedules %v and %v ask for different actions with equal priority", ids[0], ids[1]),
+				})
+			}
+			fired[k] = append(fired[k], e)
+		case eventer.TypeScheduleFailed, eventer.TypeScheduleSkipped, eventer.TypeRuleFailed, eventer.TypeRuleSkipped:
+			kind := FailedViolation
+			if e.Type == eventer.TypeScheduleSkipped || e.Type == eventer.TypeRuleSkipped {
+				if !strings.HasPrefix(e.Cause, conditionError) {
+					continue
+				}
+				kind = ConditionViolation
+			}
+			v := Violation{At: e.Stamp, Kind: kind, Relay: e.Relay, Msg: e.Cause}
+			if e.Actor == ActorRules {
+				v.Rule = e.Name
+			} else {
+				v.Schedule = e.Name
+			}
+			res.Violations = append(res.Violations, v)
+		}
+	}
+	for k, v := range onSince {
+		res.OnTime[k] += Duration(res.To.Sub(v))
+	}
+}
@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSimulate(t *testing.T) {
+	from := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	onAt8 := Schedule{ID: "a", Relay: 1, Expression: "0 8 * * *", Action: On}
+	offAt20 := Schedule{ID: "b", Relay: 1, Expression: "0 20 * * *", Action: Off}
+	tests := []struct {
+		name    string
+		cfg     Config
+		initial map[uint8]Action
+		sensors map[string]float64
+		// wantTransitions lists when each relay changed state, if checked
+		wantTransitions []string
+		wantOnTime      map[uint8]Duration
+		// wantViolations lists the kinds of violation found
+		wantViolations []ViolationKind
+	}{
+		{
+			name:            "on and off",
+			cfg:             Config{Schedules: []Schedule{onAt8, offAt20}},
+			wantTransitions: []string{"Jun 1 08:00 relay 1 on", "Jun 1 20:00 relay 1 off", "Jun 2 08:00 relay 1 on"},
+			wantOnTime:      map[uint8]Duration{1: Duration(20 * time.Hour), 2: 0},
+			wantViolations:  []ViolationKind{},
+		},
+		{
+			name:            "initially on",
+			cfg:             Config{Schedules: []Schedule{offAt20}},
+			initial:         map[uint8]Action{1: On},
+			wantTransitions: []string{"Jun 1 20:00 relay 1 off"},
+			wantOnTime:      map[uint8]Duration{1: Duration(20 * time.Hour), 2: 0},
+			wantViolations:  []ViolationKind{},
+		},
+		{
+			name: "pulse",
+			cfg: Config{Schedules: []Schedule{
+				{ID: "a", Relay: 2, Expression: "0 6 1 * *", Action: Pulse, Duration: Duration(30 * time.Minute)},
+			}},
+			wantTransitions: []string{"Jun 1 06:00 relay 2 on", "Jun 1 06:30 relay 2 off"},
+			wantOnTime:      map[uint8]Duration{1: 0, 2: Duration(30 * time.Minute)},
+			wantViolations:  []ViolationKind{},
+		},
+		{
+			name: "rule",
+			cfg: Config{
+				Schedules: []Schedule{{ID: "a", Relay: 1, Expression: "0 8 1 * *", Action: On}},
+				Rules: []Rule{
+					{ID: "r", Trigger: RuleTrigger{Type: RelayTrigger, Relay: 1, State: On}, Action: RuleAction{Action: On, Relay: 2, Delay: Duration(5 * time.Minute)}},
+				},
+			},
+			wantTransitions: []string{"Jun 1 08:00 relay 1 on", "Jun 1 08:05 relay 2 on"},
+			wantOnTime:      map[uint8]Duration{1: Duration(32 * time.Hour), 2: Duration(31*time.Hour + 55*time.Minute)},
+			wantViolations:  []ViolationKind{},
+		},
+		{
+			name: "scene",
+			cfg: Config{
+				Schedules: []Schedule{{ID: "a", Expression: "0 8 1 * *", Action: SceneAction, Scene: "spa"}},
+				Scenes: map[string]Scene{
+					"spa": {Relays: map[uint8]Action{1: On, 2: On}, Steps: []SceneStep{{Relay: 2}, {Relay: 1, Delay: Duration(time.Minute)}}},
+				},
+			},
+			wantTransitions: []string{"Jun 1 08:00 relay 2 on", "Jun 1 08:01 relay 1 on"},
+			wantOnTime:      map[uint8]Duration{1: Duration(31*time.Hour + 59*time.Minute), 2: Duration(32 * time.Hour)},
+			wantViolations:  []ViolationKind{},
+		},
+		{
+			name: "condition true",
+			cfg: Config{Schedules: []Schedule{
+				{ID: "a", Relay: 1, Expression: "0 8 1 * *", Action: On, Condition: "sensor.water_temp > 20"},
+			}},
+			sensors:         map[string]float64{"water_temp": 25},
+			wantTransitions: []string{"Jun 1 08:00 relay 1 on"},
+			wantOnTime:      map[uint8]Duration{1: Duration(32 * time.Hour), 2: 0},
+			wantViolations:  []ViolationKind{},
+		},
+		{
+			name: "condition can't be evaluated",
+			cfg: Config{Schedules: []Schedule{
+				{ID: "a", Relay: 1, Expression: "0 8 1 * *", Action: On, Condition: "sensor.water_temp > 20"},
+			}},
+			wantTransitions: []string{},
+			wantOnTime:      map[uint8]Duration{1: 0, 2: 0},
+			wantViolations:  []ViolationKind{ConditionViolation},
+		},
+		{
+			name: "conflict",
+			cfg: Config{Schedules: []Schedule{
+				onAt8,
+				{ID: "c", Relay: 1, Expression: "0 8 * * *", Action: Off},
+			}},
+			wantViolations: []ViolationKind{ConflictViolation},
+		},
+		{
+			name: "conflict resolved by priority",
+			cfg: Config{Schedules: []Schedule{
+				onAt8,
+				{ID: "c", Relay: 1, Expression: "0 8 * * *", Action: Off, Priority: 1},
+			}},
+			wantTransitions: []string{},
+			wantOnTime:      map[uint8]Duration{1: 0, 2: 0},
+			wantViolations:  []ViolationKind{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := Simulate(SimulationRequest{
+				Config:  tt.cfg,
+				From:    from,
+				To:      from.Add(40 * time.Hour),
+				Relays:  2,
+				Initial: tt.initial,
+				Sensors: tt.sensors,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantTransitions != nil {
+				got := []string{}
+				for _, v := range res.Transitions {
+					got = append(got, fmt.Sprintf("%v relay %v %v", v.At.Format("Jan 2 15:04"), v.Relay, v.State))
+				}
+				if !reflect.DeepEqual(got, tt.wantTransitions) {
+					t.Errorf("got transitions %q, want %q", got, tt.wantTransitions)
+				}
+			}
+			if tt.wantOnTime != nil && !reflect.DeepEqual(res.OnTime, tt.wantOnTime) {
+				t.Errorf("got on time %v, want %v", res.OnTime, tt.wantOnTime)
+			}
+			kinds := []ViolationKind{}
+			seen := make(map[ViolationKind]bool)
+			for _, v := range res.Violations {
+				if !seen[v.Kind] {
+					kinds = append(kinds, v.Kind)
+					seen[v.Kind] = true
+				}
+			}
+			sort.Slice(kinds, func(i, j int) bool { return kinds[i] < kinds[j] })
+			if !reflect.DeepEqual(kinds, tt.wantViolations) {
+				t.Errorf("got violations %+v, want kinds %v", res.Violations, tt.wantViolations)
+			}
+		})
+	}
+}
+
+func TestSimulateRejectsRequest(t *testing.T) {
+	from := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		req  SimulationRequest
+	}{
+		{
+			name: "ends before it starts",
+			req:  SimulationRequest{From: from, To: from.Add(-time.Hour), Relays: 1},
+		},
+		{
+			name: "too long",
+			req:  SimulationRequest{From: from, To: from.Add(MaxSimulationRange + time.Hour), Relays: 1},
+		},
+		{
+			name: "no relays",
+			req:  SimulationRequest{From: from, To: from.Add(time.Hour)},
+		},
+		{
+			name: "invalid expression",
+			req: SimulationRequest{
+				Config: Config{Schedules: []Schedule{{ID: "a", Relay: 1, Expression: "bad", Action: On}}},
+				From:   from,
+				To:     from.Add(time.Hour),
+				Relays: 1,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Simulate(tt.req)
+			if err == nil {
+				t.Errorf("got no error, want the request rejected")
+			}
+		})
+	}
+}
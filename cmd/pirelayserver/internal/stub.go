@@ -4,84 +4,76 @@ import (
 	"fmt"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/go-kit/kit/log"
-	"github.com/robfig/cron/v3"
 
 	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal/eventer"
+	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal/hub"
 )
 
 type StubRelayController struct {
 	logger      log.Logger
 	cfger       Configurer
 	el          eventer.Eventer
-	scheduler   *cron.Cron
+	h           *hub.Hub
+	scheduler   *scheduler
+	sequencer   *sequencer
+	rules       *ruleEngine
 	relayStates map[uint8]bool
 	m           sync.RWMutex
 }
 
-func NewStubRelayController(l log.Logger, numRelays uint8, cfger Configurer, el eventer.Eventer) (*StubRelayController, error) {
+func NewStubRelayController(l log.Logger, numRelays uint8, cfger Configurer, el eventer.Eventer, sensors SensorReader, history *RunHistory, h *hub.Hub) (*StubRelayController, error) {
+	c := newStubRelayController(l, systemClock{}, numRelays, cfger, el, sensors, history, h)
+	cfg, err := cfger.Get()
+	if err != nil {
+		return nil, err
+	}
+	err = c.ApplyConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// newStubRelayController makes a stub controller running on clock, with every
+// relay off and no config applied yet
+func newStubRelayController(l log.Logger, clock Clock, numRelays uint8, cfger Configurer, el eventer.Eventer, sensors SensorReader, history *RunHistory, h *hub.Hub) *StubRelayController {
 	// Init stub controller
 	c := StubRelayController{
-		logger:    l,
-		cfger:     cfger,
-		el:        el,
-		scheduler: cron.New(),
-		m:         sync.RWMutex{},
+		logger: l,
+		cfger:  cfger,
+		el:     el,
+		h:      h,
+		m:      sync.RWMutex{},
 	}
+	c.rules = newRuleEngine(l, clock, &c, cfger, el, sensors)
+	c.scheduler = newScheduler(l, clock, &c, cfger, el, sensors, c.rules, history)
+	c.sequencer = newSequencer(l, clock, &c, el)
 	// Create relay states map
 	rs := make(map[uint8]bool)
 	for i := uint8(0); i < numRelays; i++ {
 		rs[i] = false
 	}
 	c.relayStates = rs
-	cfg, err := cfger.Get()
-	if err != nil {
-		return nil, err
-	}
-	err = c.ApplyConfig(cfg)
-	if err != nil {
-		return nil, err
-	}
-	return &c, nil
+	return &c
 }
 
 func (c *StubRelayController) ApplyConfig(cfg Config) error {
-	// Handle schedules
-	c.scheduler.Stop()
-	c.clearScheduler()
-	for _, s := range cfg.Schedules {
-		f := c.createToggleFunction(s.Relay, s.Action, "scheduled action")
-		_, err := c.scheduler.AddFunc(s.Expression, f)
-		if err != nil {
-			return err
-		}
-	}
-	c.scheduler.Start()
-	return nil
+	return c.scheduler.apply(cfg)
 }
 
-func (c *StubRelayController) clearScheduler() {
-	for _, e := range c.scheduler.Entries() {
-		c.scheduler.Remove(e.ID)
-	}
+func (c *StubRelayController) RunSequence(relay uint8, steps []SequenceStep, cause Cause) error {
+	return c.sequencer.run(relay, steps, cause)
 }
 
-func (c *StubRelayController) createToggleFunction(relay uint8, action Action, cause string) func() {
-	ret := func() {}
-	switch action {
-	case On:
-		ret = func() {
-			c.logger.Log("msg", "Switching relay to On", "relay", relay, "cause", cause)
-			c.On(relay, cause)
-		}
-	case Off:
-		ret = func() {
-			c.logger.Log("msg", "Switching relay to Off", "relay", relay, "cause", cause)
-			c.Off(relay, cause)
-		}
-	}
-	return ret
+func (c *StubRelayController) CancelSequence(relay uint8) bool {
+	return c.sequencer.stop(relay)
+}
+
+func (c *StubRelayController) NextRun(id string) (time.Time, bool) {
+	return c.scheduler.next(id)
 }
 
 func (c *StubRelayController) Status() (Status, error) {
@@ -128,10 +120,12 @@ func (c *StubRelayController) relayName(relay uint8) (string, error) {
 }
 
 func (c *StubRelayController) IsValidRelay(relay uint8) bool {
-	return int(relay) <= len(c.relayStates)
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return relay >= 1 && int(relay) <= len(c.relayStates)
 }
 
-func (c *StubRelayController) Toggle(relay uint8) error {
+func (c *StubRelayController) Toggle(relay uint8, cause Cause) error {
 	if !c.IsValidRelay(relay) {
 		return fmt.Errorf("invalid relay. must be uint between 1 and %v", len(c.relayStates))
 	}
@@ -139,35 +133,43 @@ func (c *StubRelayController) Toggle(relay uint8) error {
 	v := !c.relayStates[relay-1]
 	c.relayStates[relay-1] = v
 	c.m.Unlock()
-	ss := "off"
-	if v {
-		ss = "on"
-	}
 	n, _ := c.relayName(relay)
-	c.el.Event(fmt.Sprintf("Toggled '%v' (relay %v), new state is %v", n, relay, ss))
+	c.el.Event(relayEvent(relay, n, !v, v, cause))
+	c.h.Publish(hub.TopicRelay, relayState(relay, n, v))
+	c.rules.relayChanged(relay, v, cause)
 	return nil
 }
 
-func (c *StubRelayController) On(relay uint8, cause string) error {
+func (c *StubRelayController) On(relay uint8, cause Cause) error {
 	if !c.IsValidRelay(relay) {
 		return fmt.Errorf("invalid relay. must be uint between 1 and %v", len(c.relayStates))
 	}
 	c.m.Lock()
+	prev := c.relayStates[relay-1]
 	c.relayStates[relay-1] = true
 	c.m.Unlock()
 	n, _ := c.relayName(relay)
-	c.el.Event(fmt.Sprintf("Switching '%v' (relay %v) on, cause: %v", n, relay, cause))
+	c.el.Event(relayEvent(relay, n, prev, true, cause))
+	c.h.Publish(hub.TopicRelay, relayState(relay, n, true))
+	if !prev {
+		c.rules.relayChanged(relay, true, cause)
+	}
 	return nil
 }
 
-func (c *StubRelayController) Off(relay uint8, cause string) error {
+func (c *StubRelayController) Off(relay uint8, cause Cause) error {
 	if !c.IsValidRelay(relay) {
 		return fmt.Errorf("invalid relay. must be uint between 1 and %v", len(c.relayStates))
 	}
 	c.m.Lock()
+	prev := c.relayStates[relay-1]
 	c.relayStates[relay-1] = false
 	c.m.Unlock()
 	n, _ := c.relayName(relay)
-	c.el.Event(fmt.Sprintf("Switching '%v' (relay %v) off, cause: %v", n, relay, cause))
+	c.el.Event(relayEvent(relay, n, prev, false, cause))
+	c.h.Publish(hub.TopicRelay, relayState(relay, n, false))
+	if prev {
+		c.rules.relayChanged(relay, false, cause)
+	}
 	return nil
 }
@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal/eventer"
+)
+
+// testConfigurer keeps a config in memory
+type testConfigurer struct {
+	cfg Config
+	m   sync.Mutex
+}
+
+func (c *testConfigurer) Get() (Config, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.cfg, nil
+}
+
+func (c *testConfigurer) Set(cfg Config) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	cfg.Revision = c.cfg.Revision + 1
+	c.cfg = cfg
+	return nil
+}
+
+func (c *testConfigurer) Update(actor string, fn func(*Config) error) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	cfg, err := c.cfg.Clone()
+	if err != nil {
+		return err
+	}
+	err = fn(&cfg)
+	if err == ErrUnchanged {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	cfg.Revision = c.cfg.Revision + 1
+	c.cfg = cfg
+	return nil
+}
+
+func (c *testConfigurer) Revision() uint64 {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.cfg.Revision
+}
+
+// testEventer keeps events in memory
+type testEventer struct {
+	events []eventer.Event
+	m      sync.Mutex
+}
+
+func (l *testEventer) Event(e eventer.Event) error {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if e.Stamp.IsZero() {
+		e.Stamp = time.Now()
+	}
+	e.ID = uint64(len(l.events) + 1)
+	l.events = append(l.events, e)
+	return nil
+}
+
+func (l *testEventer) Query(q eventer.Query) (eventer.Page, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return eventer.QuerySlice(l.events, q), nil
+}
+
+func (l *testEventer) ListAll() ([]eventer.Event, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return append([]eventer.Event{}, l.events...), nil
+}
+
+// testCause is the cause of the changes tests make
+var testCause = Cause{Reason: "test"}
+
+// newTestController returns a stub controller with every relay off, running
+// cfg
+func newTestController(t *testing.T, relays uint8, cfg Config) (*StubRelayController, *testEventer) {
+	el := &testEventer{}
+	c, err := NewStubRelayController(log.NewNopLogger(), relays, &testConfigurer{cfg: cfg}, el, NewSensorStore(0), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, el
+}
+
+// relayStates returns the state of each relay, in relay order
+func relayStates(t *testing.T, c RelayController) []uint8 {
+	status, err := c.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret := []uint8{}
+	for _, v := range status.States {
+		ret = append(ret, v.State)
+	}
+	return ret
+}
+
+// waitFor fails the test unless cond becomes true within a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
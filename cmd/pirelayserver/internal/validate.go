@@ -0,0 +1,207 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/robfig/cron/v3"
+)
+
+// FieldError is a problem with a single field of a config, located by its
+// JSON path, e.g. `schedules[2].expression`
+type FieldError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every problem found with a config
+type ValidationError struct {
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := []string{}
+	for _, v := range e.Errors {
+		msgs = append(msgs, fmt.Sprintf("%v: %v", v.Path, v.Message))
+	}
+	return "invalid config: " + strings.Join(msgs, "; ")
+}
+
+type validator struct {
+	cfg    Config
+	relays uint8
+	ids    map[string]string
+	errs   []FieldError
+}
+
+func (v *validator) add(path string, format string, args ...interface{}) {
+	v.errs = append(v.errs, FieldError{
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *validator) relay(path string, relay uint8) {
+	if relay == 0 || relay > v.relays {
+		v.add(path, "relay %v does not exist, must be between 1 and %v", relay, v.relays)
+	}
+}
+
+func (v *validator) scene(path string, id string) {
+	if _, ok := v.cfg.Scenes[id]; !ok {
+		v.add(path, "scene %q not found", id)
+	}
+}
+
+// Validate checks every part of the config against a controller with the
+// given number of relays, and returns a *ValidationError listing all of the
+// problems found, if any
+func (c Config) Validate(relayCount uint8) error {
+	v := &validator{
+		cfg:    c,
+		relays: relayCount,
+		ids:    make(map[string]string),
+	}
+	for i, s := range c.Schedules {
+		v.schedule(fmt.Sprintf("schedules[%v]", i), s)
+	}
+	names := []uint8{}
+	for k := range c.RelayNames {
+		names = append(names, k)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	for _, k := range names {
+		v.relay(fmt.Sprintf("relayNames.%v", k), k)
+	}
+
+	profiles := []string{}
+	for k := range c.Profiles {
+		profiles = append(profiles, k)
+	}
+	sort.Strings(profiles)
+	for _, n := range profiles {
+		p := c.Profiles[n]
+		path := fmt.Sprintf("profiles.%v", n)
+		for i, r := range p.Activate {
+			if err := r.Validate(); err != nil {
+				v.add(fmt.Sprintf("%v.activate[%v]", path, i), "%v", err)
+			}
+		}
+		for i, s := range p.Schedules {
+			v.schedule(fmt.Sprintf("%v.schedules[%v]", path, i), s)
+		}
+	}
+	if _, ok := c.Profiles[c.ProfileOverride]; c.ProfileOverride != "" && !ok {
+		v.add("profileOverride", "profile %q not found", c.ProfileOverride)
+	}
+
+	if a := c.Away; a != nil {
+		if !a.End.After(a.Start) {
+			v.add("away.end", "away mode must end after it starts")
+		}
+		for _, k := range relayKeys(a.Relays) {
+			path := fmt.Sprintf("away.relays.%v", k)
+			v.relay(path, k)
+			if a.Relays[k] != On && a.Relays[k] != Off {
+				v.add(path, "invalid action %q", a.Relays[k])
+			}
+		}
+		for i, s := range a.Schedules {
+			v.schedule(fmt.Sprintf("away.schedules[%v]", i), s)
+		}
+	}
+
+	scenes := []string{}
+	for k := range c.Scenes {
+		scenes = append(scenes, k)
+	}
+	sort.Strings(scenes)
+	for _, id := range scenes {
+		sc := c.Scenes[id]
+		path := fmt.Sprintf("scenes.%v", id)
+		if err := sc.Validate(); err != nil {
+			v.add(path, "%v", err)
+		}
+		for _, k := range relayKeys(sc.Relays) {
+			v.relay(fmt.Sprintf("%v.relays.%v", path, k), k)
+		}
+	}
+
+	rules := make(map[string]bool)
+	for i, r := range c.Rules {
+		path := fmt.Sprintf("rules[%v]", i)
+		if r.ID == "" {
+			v.add(path+".id", "rule must have an id")
+		} else if rules[r.ID] {
+			v.add(path+".id", "duplicate rule id %q", r.ID)
+		}
+		rules[r.ID] = true
+		if err := r.Validate(); err != nil {
+			v.add(path, "%v", err)
+		}
+		if r.Trigger.Relay != 0 {
+			v.relay(path+".trigger.relay", r.Trigger.Relay)
+		}
+		if r.Action.Relay != 0 {
+			v.relay(path+".action.relay", r.Action.Relay)
+		}
+		if r.Action.Action == SceneAction {
+			v.scene(path+".action.scene", r.Action.Scene)
+		}
+	}
+
+	if len(v.errs) > 0 {
+		return &ValidationError{Errors: v.errs}
+	}
+	return nil
+}
+
+func (v *validator) schedule(path string, s Schedule) {
+	if s.ID == "" {
+		v.add(path+".id", "schedule must have an id")
+	} else if prev, ok := v.ids[s.ID]; ok {
+		v.add(path+".id", "duplicate schedule id %q, also used by %v", s.ID, prev)
+	} else {
+		v.ids[s.ID] = path
+	}
+	if _, err := cron.ParseStandard(s.Expression); err != nil {
+		v.add(path+".expression", "%v", err)
+	}
+	switch s.Action {
+	case On, Off:
+		v.relay(path+".relay", s.Relay)
+	case Pulse:
+		v.relay(path+".relay", s.Relay)
+		if s.Duration <= 0 {
+			v.add(path+".duration", "pulse duration must be positive")
+		}
+	case Sequence:
+		v.relay(path+".relay", s.Relay)
+		if err := ValidateSteps(s.Steps); err != nil {
+			v.add(path+".steps", "%v", err)
+		}
+	case SceneAction:
+		v.scene(path+".scene", s.Scene)
+	default:
+		v.add(path+".action", "invalid action %q", s.Action)
+	}
+	if s.Condition != "" {
+		if _, err := ParseCondition(s.Condition); err != nil {
+			v.add(path+".condition", "%v", err)
+		}
+	}
+	if err := s.ValidateJitter(); err != nil {
+		v.add(path+".jitter", "%v", err)
+	}
+}
+
+// relayKeys returns the relays of an action map in order
+func relayKeys(m map[uint8]Action) []uint8 {
+	ret := []uint8{}
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		// want lists the paths of the expected errors, in order
+		want []string
+	}{
+		{
+			name: "valid",
+			cfg: Config{
+				Schedules: []Schedule{
+					{ID: "a", Relay: 1, Expression: "0 8 * * *", Action: On},
+					{ID: "b", Expression: "0 9 * * *", Action: SceneAction, Scene: "spa"},
+				},
+				RelayNames: map[uint8]string{3: "Pump"},
+				Scenes:     map[string]Scene{"spa": {Relays: map[uint8]Action{1: On, 2: Off}}},
+				Rules: []Rule{
+					{ID: "r", Trigger: RuleTrigger{Type: RelayTrigger, Relay: 1}, Action: RuleAction{Action: Off, Relay: 2}},
+				},
+			},
+		},
+		{
+			name: "relay out of range",
+			cfg: Config{
+				Schedules:  []Schedule{{ID: "a", Relay: 4, Expression: "0 8 * * *", Action: On}},
+				RelayNames: map[uint8]string{0: "None", 9: "Nine"},
+			},
+			want: []string{"schedules[0].relay", "relayNames.0", "relayNames.9"},
+		},
+		{
+			name: "every problem with a schedule",
+			cfg: Config{
+				Schedules: []Schedule{
+					{ID: "a", Relay: 1, Expression: "0 8 * * *", Action: On},
+					{ID: "a", Relay: 1, Expression: "bad", Action: Pulse, Condition: "relay.1 ==", Jitter: Duration(-time.Second)},
+				},
+			},
+			want: []string{"schedules[1].id", "schedules[1].expression", "schedules[1].duration", "schedules[1].condition", "schedules[1].jitter"},
+		},
+		{
+			name: "ids are unique across profiles",
+			cfg: Config{
+				Schedules: []Schedule{{ID: "a", Relay: 1, Expression: "0 8 * * *", Action: On}},
+				Profiles: map[string]Profile{
+					"summer": {Schedules: []Schedule{{ID: "a", Relay: 1, Expression: "0 9 * * *", Action: Off}}},
+				},
+				ProfileOverride: "winter",
+			},
+			want: []string{"profiles.summer.schedules[0].id", "profileOverride"},
+		},
+		{
+			name: "missing scenes",
+			cfg: Config{
+				Schedules: []Schedule{{ID: "a", Expression: "0 8 * * *", Action: SceneAction, Scene: "nope"}},
+				Rules: []Rule{
+					{ID: "r", Trigger: RuleTrigger{Type: ScheduleTrigger}, Action: RuleAction{Action: SceneAction, Scene: "nope"}},
+				},
+			},
+			want: []string{"schedules[0].scene", "rules[0].action.scene"},
+		},
+		{
+			name: "scenes and away mode",
+			cfg: Config{
+				Scenes: map[string]Scene{"spa": {Relays: map[uint8]Action{1: "dim", 5: On}}},
+				Away: &AwayMode{
+					Start:  time.Date(2026, 6, 2, 0, 0, 0, 0, time.UTC),
+					End:    time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC),
+					Relays: map[uint8]Action{1: "dim"},
+				},
+			},
+			want: []string{"away.end", "away.relays.1", "scenes.spa", "scenes.spa.relays.5"},
+		},
+		{
+			name: "rules",
+			cfg: Config{
+				Rules: []Rule{
+					{Trigger: RuleTrigger{Type: ScheduleTrigger}, Action: RuleAction{Action: Notify, Message: "hi"}},
+					{ID: "r", Trigger: RuleTrigger{Type: ScheduleTrigger}, Action: RuleAction{Action: Notify, Message: "hi"}},
+					{ID: "r", Trigger: RuleTrigger{Type: "nope"}, Action: RuleAction{Action: On, Relay: 7}},
+				},
+			},
+			want: []string{"rules[0].id", "rules[2].id", "rules[2]", "rules[2].action.relay"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate(3)
+			var got []string
+			if err != nil {
+				ve, ok := err.(*ValidationError)
+				if !ok {
+					t.Fatalf("got %T, want *ValidationError", err)
+				}
+				for _, v := range ve.Errors {
+					got = append(got, v.Path)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
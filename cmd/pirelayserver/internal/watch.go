@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-kit/kit/log"
+
+	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal/eventer"
+)
+
+// watchSettle is how long the config file must be left alone before an edit
+// is reloaded, so that a file written in several steps is read whole
+const watchSettle = 500 * time.Millisecond
+
+// Watch reloads the config file whenever it is changed by something other
+// than the configurer, e.g. an editor or a deployment.  An edited config is
+// validated and passed to apply before it is accepted; an edit that can't be
+// loaded, isn't valid or can't be applied is rolled back and kept as
+// filename.rejected.  Changes are noticed with inotify where available, and
+// by polling every interval otherwise.  Call the returned function to stop
+// watching.
+func (c *JsonConfigurer) Watch(l log.Logger, interval time.Duration, apply func(Config) error) func() {
+	done := make(chan struct{})
+	changed := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err == nil {
+		// Watch the directory rather than the file, since atomic writes
+		// replace the file rather than changing it
+		err = w.Add(filepath.Dir(c.filename))
+		if err != nil {
+			w.Close()
+		}
+	}
+	if err == nil {
+		go func() {
+			defer w.Close()
+			for {
+				select {
+				case <-done:
+					return
+				case ev, ok := <-w.Events:
+					if !ok {
+						return
+					}
+					if filepath.Clean(ev.Name) == filepath.Clean(c.filename) {
+						notify()
+					}
+				case err, ok := <-w.Errors:
+					if !ok {
+						return
+					}
+					l.Log("msg", "config watcher error", "err", err)
+				}
+			}
+		}()
+	} else {
+		l.Log("msg", "inotify unavailable, polling config file for changes", "err", err, "interval", interval)
+		go c.poll(done, interval, notify)
+	}
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-changed:
+			}
+			// Wait for the file to settle
+			t := time.NewTimer(watchSettle)
+		settle:
+			for {
+				select {
+				case <-done:
+					t.Stop()
+					return
+				case <-changed:
+					t.Reset(watchSettle)
+				case <-t.C:
+					break settle
+				}
+			}
+			err := c.Reload(apply)
+			if err != nil {
+				l.Log("msg", "config reload failed", "err", err)
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// poll checks the config file for changes every interval
+func (c *JsonConfigurer) poll(done chan struct{}, interval time.Duration, notify func()) {
+	var mod time.Time
+	var size int64
+	if fi, err := os.Stat(c.filename); err == nil {
+		mod, size = fi.ModTime(), fi.Size()
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		fi, err := os.Stat(c.filename)
+		if err != nil {
+			continue
+		}
+		if !fi.ModTime().Equal(mod) || fi.Size() != size {
+			mod, size = fi.ModTime(), fi.Size()
+			notify()
+		}
+	}
+}
+
+// Reload reads the config file if it has been changed by something other than
+// the configurer.  A valid config is passed to apply and, if that succeeds,
+// stored as the next revision.  Otherwise the file is rolled back to the
+// current config.  Either way an event is recorded.
+func (c *JsonConfigurer) Reload(apply func(Config) error) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	dat, err := ioutil.ReadFile(c.filename)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(dat, c.dat) {
+		return nil
+	}
+
+	var cfg Config
+	js, err := c.format.toJSON(dat)
+	if err == nil {
+		cfg, err = ParseConfig(js)
+	}
+	if err == nil {
+		err = cfg.Validate(c.relays)
+	}
+	if err == nil {
+		cfg.Revision = c.Revision() + 1
+		cfg.Version = ConfigVersion
+		err = apply(cfg)
+	}
+	if err != nil {
+		rerr := c.rollback(dat)
+		if rerr != nil {
+			return rerr
+		}
+		c.el.Event(eventer.Event{
+			Type:  eventer.TypeConfigError,
+			Actor: ActorFile,
+			Msg:   fmt.Sprintf("Config file %v was edited, but the edit was rejected and rolled back to revision %v (kept as %v.rejected): %v", c.filename, c.Revision(), c.filename, err),
+		})
+		return nil
+	}
+
+	// Keep the config being replaced as the newest backup, as set would
+	prev := c.dat
+	err = shiftBackups(c.filename, configBackups)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(backupName(c.filename, 1), prev, 0644)
+	if err != nil {
+		return err
+	}
+	js, err = json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	// The edited file is the one whose comments are kept
+	dat, err = c.format.fromJSON(js, dat)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(c.filename, dat, 0644)
+	if err != nil {
+		return err
+	}
+	c.dat = dat
+	c.cm.Lock()
+	old := c.cfg
+	c.cfg = cfg
+	c.cm.Unlock()
+	recordChange(c.changes, c.el, old, cfg, ActorFile)
+	c.el.Event(eventer.Event{
+		Type:     eventer.TypeConfigChanged,
+		Actor:    ActorFile,
+		OldState: fmt.Sprint(old.Revision),
+		NewState: fmt.Sprint(cfg.Revision),
+		Msg:      fmt.Sprintf("Config file %v was edited, reloaded as revision %v", c.filename, cfg.Revision),
+	})
+	return nil
+}
+
+// rollback keeps a rejected edit as filename.rejected and puts back the
+// current config
+func (c *JsonConfigurer) rollback(rejected []byte) error {
+	err := writeFileAtomic(c.filename+".rejected", rejected, 0644)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.filename, c.dat, 0644)
+}
@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// newTestConfigurer returns a configurer for a config file in a new temporary
+// directory, with relay 1 named Pump
+func newTestConfigurer(t *testing.T) (*JsonConfigurer, string) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	filename := filepath.Join(dir, "config.json")
+	cfger, err := WithJsonConfigurer(filename, &testEventer{}, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfger.Update("test", func(cfg *Config) error {
+		cfg.RelayNames[1] = "Pump"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfger.(*JsonConfigurer), filename
+}
+
+func TestReload(t *testing.T) {
+	tests := []struct {
+		name string
+		// edit is written over the config file, unless empty
+		edit     string
+		applyErr error
+		// want is the name of relay 1 afterwards
+		want         string
+		wantApplied  bool
+		wantRejected bool
+	}{
+		{
+			name: "unchanged",
+			want: "Pump",
+		},
+		{
+			name:        "edited",
+			edit:        `{"version": 1, "schedules": [], "relayNames": {"1": "Lights"}}`,
+			want:        "Lights",
+			wantApplied: true,
+		},
+		{
+			name:        "older version",
+			edit:        `{"schedules": [{"relay": 1, "expression": "0 8 * * *", "action": "on"}], "relayNames": {"1": "Lights"}}`,
+			want:        "Lights",
+			wantApplied: true,
+		},
+		{
+			name:         "malformed",
+			edit:         `{"schedules": [`,
+			want:         "Pump",
+			wantRejected: true,
+		},
+		{
+			name:         "invalid",
+			edit:         `{"version": 1, "schedules": [], "relayNames": {"9": "Lights"}}`,
+			want:         "Pump",
+			wantRejected: true,
+		},
+		{
+			name:         "can't be applied",
+			edit:         `{"version": 1, "schedules": [], "relayNames": {"1": "Lights"}}`,
+			applyErr:     fmt.Errorf("no"),
+			want:         "Pump",
+			wantApplied:  true,
+			wantRejected: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, filename := newTestConfigurer(t)
+			before, err := ioutil.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rev := c.Revision()
+			if tt.edit != "" {
+				err = ioutil.WriteFile(filename, []byte(tt.edit), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			applied := false
+			err = c.Reload(func(cfg Config) error {
+				applied = true
+				return tt.applyErr
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg, _ := c.Get()
+			if cfg.RelayNames[1] != tt.want || applied != tt.wantApplied {
+				t.Errorf("got %q applied %v, want %q applied %v", cfg.RelayNames[1], applied, tt.want, tt.wantApplied)
+			}
+			wantRev := rev
+			if tt.wantApplied && !tt.wantRejected {
+				wantRev++
+			}
+			if c.Revision() != wantRev {
+				t.Errorf("got revision %v, want %v", c.Revision(), wantRev)
+			}
+			after, err := ioutil.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rejected, err := ioutil.ReadFile(filename + ".rejected")
+			if tt.wantRejected {
+				if !bytes.Equal(after, before) || string(rejected) != tt.edit {
+					t.Errorf("got %s kept as rejected and %s in the file, want the edit kept and the file rolled back", rejected, after)
+				}
+			} else if !os.IsNotExist(err) {
+				t.Errorf("got %s kept as rejected, want nothing", rejected)
+			}
+		})
+	}
+}
+
+func TestWatch(t *testing.T) {
+	c, filename := newTestConfigurer(t)
+	applied := make(chan Config, 1)
+	stop := c.Watch(log.NewNopLogger(), 10*time.Millisecond, func(cfg Config) error {
+		applied <- cfg
+		return nil
+	})
+	defer stop()
+	err := ioutil.WriteFile(filename, []byte(`{"version": 1, "schedules": [], "relayNames": {"1": "Lights"}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case cfg := <-applied:
+		if cfg.RelayNames[1] != "Lights" {
+			t.Errorf("got %q applied, want Lights", cfg.RelayNames[1])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the edit to be reloaded")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	gosyslog "log/syslog"
 	"net/http"
 	"os"
@@ -12,11 +13,14 @@ import (
 	"time"
 
 	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal"
+	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal/auth"
 	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal/eventer"
+	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal/hub"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/syslog"
 	"github.com/joho/godotenv"
+	bolt "go.etcd.io/bbolt"
 )
 
 const (
@@ -30,18 +34,89 @@ type errResponse struct {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		os.Exit(runSimulate(os.Args[2:]))
+	}
 
-	// Config.
+	// Config.  Every flag can also be set with a POOLCTL_ environment
+	// variable or in the settings file, see loadSettings.
 	var (
 		httpAddr       = flag.String("http.addr", ":3000", "HTTP listen address")
+		relayPins      = flag.String("relay.pins", fmt.Sprintf("%v,%v,%v", pinRelay1, pinRelay2, pinRelay3), "GPIO pins of the relays, in relay order")
+		auth0Domain    = flag.String("auth0.domain", "", "Auth0 tenant domain, e.g. example.auth0.com")
+		auth0Audience  = flag.String("auth0.audience", "", "Identifier of the Auth0 API tokens must be issued for")
+		auth0ClientID  = flag.String("auth0.client-id", "", "Client ID of the Auth0 app")
+		auth0Secret    = flag.String("auth0.client-secret", "", "Client secret of the Auth0 app")
+		auth0Callback  = flag.String("auth0.callback-url", "", "Callback URL of the Auth0 app")
 		configFile     = flag.String("config.file", "config.json", "Configuration file")
-		eventsFile     = flag.String("events.file", "events.csv", "Events log")
+		eventsFile     = flag.String("events.file", "events.jsonl", "Events log, one JSON event per line")
+		eventsCSVFile  = flag.String("events.csv-file", "events.csv", "CSV events log of older releases, imported when events.file is created")
+		eventsFsync    = flag.String("events.fsync", "interval", "When events are flushed to disk: always, interval (once a second) or never")
+		store          = flag.String("store", "files", "Where config and events are kept: files (config.file and events.file) or bolt (store.file)")
+		storeFile      = flag.String("store.file", "pirelayserver.db", "Database used by the bolt store; config.file and events.file are imported into it when it is new")
 		devMode        = flag.Bool("dev", false, "When enabled, a stub relay implementation is used")
 		sysLog         = flag.Bool("syslog", false, "When enabled, logging is routed to syslog")
-		eventsCapacity = flag.Int("events.capacity", 100, "Number of events to keep in events file")
+		eventsCapacity = flag.Int("events.capacity", 100, "Most events to keep, 0 for no limit")
+		eventsMaxAge   = flag.Duration("events.max-age", 0, "Expire events older than this, e.g. 720h; 0 for no limit")
+		eventsPerType  = flag.String("events.max-per-type", "", "Most events to keep of the given types, e.g. relay_on=500,relay_off=500")
+		eventsMaxSize  = flag.Int64("events.max-size", 0, "Most bytes the events may take, 0 for no limit")
+		eventsArchive  = flag.String("events.archive-dir", "", "Directory to archive expired events to, in a gzipped file per month; expired events are discarded if empty")
+		horizon        = flag.Duration("schedules.horizon", 7*24*time.Hour, "How far ahead new schedules are checked for conflicts (0 disables)")
+		rejectConflict = flag.Bool("schedules.reject-conflicts", false, "When enabled, unresolved contradictory schedules are rejected with a 409")
+		sensorsMaxAge  = flag.Duration("sensors.max-age", 30*time.Minute, "Sensor readings older than this are ignored by conditions (0 keeps them forever)")
+		historyFile    = flag.String("history.file", "history.json", "Schedule run history")
+		revisionsFile  = flag.String("config.history-file", "config-history.json", "Config change history")
+		revisionsKeep  = flag.Int("config.history-size", 100, "Number of config revisions to keep in the history")
+		configWatch    = flag.Bool("config.watch", true, "When enabled, edits to the config file are reloaded without a restart")
+		configPoll     = flag.Duration("config.poll-interval", 5*time.Second, "How often the config file is checked for edits when inotify is unavailable")
+		streamBeat     = flag.Duration("stream.heartbeat", 15*time.Second, "How often a heartbeat is sent on idle event streams")
+		streamBacklog  = flag.Int("stream.backlog", 256, "Number of recent messages kept for event stream clients resuming with Last-Event-ID")
+		migrateDryRun  = flag.Bool("config.migrate-dry-run", false, "Print the migrations the config file needs, without writing anything, and exit")
+		_              = flag.String("settings.file", "settings.yaml", "Settings file (JSON, YAML or TOML) providing defaults for any of these flags")
+		printConfig    = flag.Bool("print-config", false, "Print the effective settings, with secrets redacted, and exit")
 	)
 	flag.Parse()
 
+	// .env may set POOLCTL_ variables, so it is loaded before the settings
+	envErr := godotenv.Load()
+	if envErr != nil && !os.IsNotExist(envErr) {
+		fmt.Fprintln(os.Stderr, envErr)
+		os.Exit(1)
+	}
+	sources, err := loadSettings(flag.CommandLine)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *printConfig {
+		printSettings(os.Stdout, flag.CommandLine, sources)
+		os.Exit(0)
+	}
+	pins, err := parsePins(*relayPins)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *streamBeat <= 0 {
+		fmt.Fprintln(os.Stderr, "stream.heartbeat must be positive")
+		os.Exit(2)
+	}
+	if *streamBacklog < 0 {
+		fmt.Fprintln(os.Stderr, "stream.backlog must not be negative")
+		os.Exit(2)
+	}
+	authSettings := auth.Settings{
+		Domain:       *auth0Domain,
+		Audience:     *auth0Audience,
+		ClientID:     *auth0ClientID,
+		ClientSecret: *auth0Secret,
+		CallbackURL:  *auth0Callback,
+	}
+
+	if *migrateDryRun {
+		os.Exit(runMigrateDryRun(*configFile))
+	}
+
 	// Logging.
 	var logger log.Logger
 	w, err := gosyslog.New(gosyslog.LOG_INFO, "poolcontroller")
@@ -63,14 +138,8 @@ func main() {
 	logger.Log("msg", "Server starting")
 
 	// .env
-	err = godotenv.Load()
-	if os.IsNotExist(err) {
+	if os.IsNotExist(envErr) {
 		logger.Log("msg", "no .env found, skipping load")
-	} else {
-		if err != nil {
-			logger.Log("err", err)
-			os.Exit(1)
-		}
 	}
 
 	// Mechanical.
@@ -86,14 +155,66 @@ func main() {
 	}()
 	logger.Log("msg", "Set up interrupt")
 
+	// Database
+	var db *bolt.DB
+	switch *store {
+	case "files":
+	case "bolt":
+		db, err = bolt.Open(*storeFile, 0600, &bolt.Options{Timeout: 5 * time.Second})
+		if err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+		logger.Log("msg", "Opened database", "file", *storeFile)
+	default:
+		logger.Log("err", fmt.Sprintf("unknown store %q", *store))
+		os.Exit(1)
+	}
+
+	// Changes are published to the hub for the event stream
+	hb := hub.New(*streamBacklog)
+
 	// Eventer
-	el, err := eventer.WithCSVEventer(*eventsFile, uint16(*eventsCapacity))
+	perType, err := eventer.ParseTypeLimits(*eventsPerType)
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
+	}
+	retention := eventer.Retention{
+		MaxCount:   *eventsCapacity,
+		MaxAge:     *eventsMaxAge,
+		MaxPerType: perType,
+		MaxBytes:   *eventsMaxSize,
+		ArchiveDir: *eventsArchive,
+	}
+	var el eventer.Eventer
+	if db != nil {
+		importFile := *eventsFile
+		if _, err := os.Stat(importFile); os.IsNotExist(err) {
+			importFile = *eventsCSVFile
+		}
+		el, err = eventer.WithBoltEventer(db, retention, importFile, hb)
+	} else {
+		var policy eventer.SyncPolicy
+		policy, err = eventer.ParseSyncPolicy(*eventsFsync)
+		if err == nil {
+			el, err = eventer.WithJSONLEventer(*eventsFile, retention, policy, *eventsCSVFile, hb)
+		}
+	}
 	if err != nil {
-		errc <- err
-		return
+		logger.Log("err", err)
+		os.Exit(1)
 	}
 	logger.Log("msg", "Init events logger")
 
+	// Schedule run history
+	history, err := internal.WithRunHistory(*historyFile)
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
+	}
+
 	// App.
 	go func() {
 		var srv http.Server
@@ -101,33 +222,62 @@ func main() {
 
 		// Configurer
 		logger.Log("msg", "Init configurer")
-		cfger, err := internal.WithJsonConfigurer(*configFile)
+		changes, err := internal.WithConfigHistory(*revisionsFile, *revisionsKeep, hb)
+		if err != nil {
+			errc <- err
+			return
+		}
+		var cfger internal.Configurer
+		if db != nil {
+			cfger, err = internal.WithBoltConfigurer(db, el, uint8(len(pins)), *configFile, changes)
+		} else {
+			cfger, err = internal.WithJsonConfigurer(*configFile, el, uint8(len(pins)), changes)
+		}
 		if err != nil {
 			errc <- err
 			return
 		}
 
+		// Sensor readings
+		sensors := internal.NewSensorStore(*sensorsMaxAge)
+
 		// Relay controller
 		var ctrl internal.RelayController
 		if *devMode {
 			logger.Log("msg", "Dev mode, init stub relay controller")
-			ctrl, err = internal.NewStubRelayController(logger, 3, cfger, el)
+			ctrl, err = internal.NewStubRelayController(logger, uint8(len(pins)), cfger, el, sensors, history, hb)
 		} else {
 			logger.Log("msg", "Init relay controller")
-			ctrl, err = internal.NewPiRelayController(logger, []uint8{pinRelay1, pinRelay2, pinRelay3}, cfger, el)
+			ctrl, err = internal.NewPiRelayController(logger, pins, cfger, el, sensors, history, hb)
 		}
 		if err != nil {
 			errc <- err
 			return
 		}
 
+		// Config file edits
+		if jc, ok := cfger.(*internal.JsonConfigurer); ok && *configWatch {
+			logger.Log("msg", "Watching config file for edits")
+			stop := jc.Watch(logger, *configPoll, ctrl.ApplyConfig)
+			defer stop()
+		}
+
 		// Server config
 		srv.Addr = *httpAddr
-		srv.Handler = getHandler(cfger, ctrl, el, logger)
+		policy := internal.ConflictPolicy{
+			Horizon: *horizon,
+			Reject:  *rejectConflict,
+		}
 		srv.ReadTimeout = time.Second * 30
 		srv.WriteTimeout = time.Second * 30
+		stream := streamSettings{
+			Heartbeat: *streamBeat,
+			// Leave time to end the stream before the write timeout cuts it off
+			Lifetime: srv.WriteTimeout - 5*time.Second,
+		}
+		srv.Handler = getHandler(cfger, ctrl, el, sensors, history, changes, hb, policy, stream, authSettings, logger)
 
-		el.Event("Server booted up")
+		el.Event(eventer.Event{Type: eventer.TypeBoot, Msg: "Server booted up"})
 		logger.Log("msg", "Starting web app")
 
 		errc <- srv.ListenAndServe()
@@ -136,5 +286,11 @@ func main() {
 	// Run.
 	logger.Log("msg", "Transferring control to web app")
 	logger.Log("exit", <-errc)
-	el.Event("Server shutdown cleanly")
+	el.Event(eventer.Event{Type: eventer.TypeShutdown, Msg: "Server shutdown cleanly"})
+	if err := history.Flush(); err != nil {
+		logger.Log("err", err)
+	}
+	if c, ok := el.(io.Closer); ok {
+		c.Close()
+	}
 }
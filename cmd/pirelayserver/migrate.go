@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal"
+)
+
+// runMigrateDryRun prints the migrations the config file needs, and the diff
+// each makes, without writing anything
+func runMigrateDryRun(configFile string) int {
+	dat, err := internal.ReadConfigFile(configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	steps := 0
+	_, err = internal.MigrateConfig(dat, func(m internal.MigrationStep, before, after []byte) error {
+		steps++
+		diff, err := internal.JSONDiff(
+			fmt.Sprintf("%v (version %v)", configFile, m.From),
+			fmt.Sprintf("%v (version %v)", configFile, m.To),
+			before, after)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("# %v\n%v", m.Desc, diff)
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if steps == 0 {
+		fmt.Printf("%v is already at version %v\n", configFile, internal.ConfigVersion)
+	}
+	return 0
+}
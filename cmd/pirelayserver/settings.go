@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal"
+)
+
+// Where a setting's value came from, in order of precedence
+const (
+	sourceFlag    = "flag"
+	sourceEnv     = "env"
+	sourceFile    = "settings file"
+	sourceDefault = "default"
+)
+
+// envPrefix is the prefix of the environment variables settings can be read
+// from, e.g. POOLCTL_HTTP_ADDR for --http.addr
+const envPrefix = "POOLCTL_"
+
+// legacyEnv maps settings to the environment variables they were read from
+// before they became settings.  They are still read, after the POOLCTL_ ones.
+var legacyEnv = map[string]string{
+	"auth0.audience":      "AUTH0_AUDIENCE",
+	"auth0.callback-url":  "AUTH0_CALLBACK_URL",
+	"auth0.client-id":     "AUTH0_CLIENT_ID",
+	"auth0.client-secret": "AUTH0_CLIENT_SECRET",
+	"auth0.domain":        "AUTH0_DOMAIN",
+}
+
+// secretSettings are redacted by --print-config
+var secretSettings = map[string]bool{
+	"auth0.client-secret": true,
+}
+
+// modeFlags choose what the binary does rather than how the service runs, so
+// they are only read from the command line
+var modeFlags = map[string]bool{
+	"print-config":           true,
+	"config.migrate-dry-run": true,
+	"settings.file":          true,
+}
+
+// envName returns the environment variable a setting is read from
+func envName(name string) string {
+	r := strings.NewReplacer(".", "_", "-", "_")
+	return envPrefix + strings.ToUpper(r.Replace(name))
+}
+
+// loadSettings fills in every flag that wasn't given on the command line from
+// the environment, then the settings file, and otherwise leaves its default.
+// The settings file is optional unless it was named explicitly.  It returns
+// where each setting's value came from.
+func loadSettings(fs *flag.FlagSet) (map[string]string, error) {
+	sources := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		sources[f.Name] = sourceFlag
+	})
+
+	// Find the settings file first, as it is a source of the rest
+	file := fs.Lookup("settings.file")
+	required := sources[file.Name] != ""
+	if v, ok := os.LookupEnv(envName(file.Name)); ok && !required {
+		err := fs.Set(file.Name, v)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", envName(file.Name), err)
+		}
+		sources[file.Name] = sourceEnv
+		required = true
+	}
+	values, err := readSettingsFile(file.Value.String(), required)
+	if err != nil {
+		return nil, err
+	}
+	for k := range values {
+		if fs.Lookup(k) == nil || modeFlags[k] {
+			return nil, fmt.Errorf("%v: unknown setting %q", file.Value, k)
+		}
+	}
+
+	var ferr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if sources[f.Name] != "" || ferr != nil {
+			return
+		}
+		if modeFlags[f.Name] {
+			sources[f.Name] = sourceDefault
+			return
+		}
+		for _, env := range []string{envName(f.Name), legacyEnv[f.Name]} {
+			if v, ok := os.LookupEnv(env); ok && env != "" {
+				if err := fs.Set(f.Name, v); err != nil {
+					ferr = fmt.Errorf("%v: %v", env, err)
+				}
+				sources[f.Name] = sourceEnv
+				return
+			}
+		}
+		if v, ok := values[f.Name]; ok {
+			if err := fs.Set(f.Name, v); err != nil {
+				ferr = fmt.Errorf("%v: %v: %v", file.Value, f.Name, err)
+			}
+			sources[f.Name] = sourceFile
+			return
+		}
+		sources[f.Name] = sourceDefault
+	})
+	return sources, ferr
+}
+
+// readSettingsFile reads a JSON, YAML or TOML settings file.  Nested keys are
+// joined with dots, so `http: {addr: ":3000"}` sets --http.addr.
+func readSettingsFile(filename string, required bool) (map[string]string, error) {
+	ret := make(map[string]string)
+	if filename == "" {
+		return ret, nil
+	}
+	dat, err := internal.ReadConfigFile(filename)
+	if os.IsNotExist(err) && !required {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	err = json.Unmarshal(dat, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", filename, err)
+	}
+	flattenSettings("", raw, ret)
+	return ret, nil
+}
+
+func flattenSettings(prefix string, raw map[string]interface{}, ret map[string]string) {
+	for k, v := range raw {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			flattenSettings(prefix+k+".", t, ret)
+		case []interface{}:
+			parts := []string{}
+			for _, e := range t {
+				parts = append(parts, fmt.Sprint(e))
+			}
+			ret[prefix+k] = strings.Join(parts, ",")
+		case float64:
+			ret[prefix+k] = strconv.FormatFloat(t, 'f', -1, 64)
+		default:
+			ret[prefix+k] = fmt.Sprint(v)
+		}
+	}
+}
+
+// printSettings writes the effective settings and where they came from, with
+// secrets redacted
+func printSettings(w io.Writer, fs *flag.FlagSet, sources map[string]string) {
+	names := []string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		if !modeFlags[f.Name] || f.Name == "settings.file" {
+			names = append(names, f.Name)
+		}
+	})
+	sort.Strings(names)
+	for _, n := range names {
+		v := fs.Lookup(n).Value.String()
+		if secretSettings[n] && v != "" {
+			v = "<redacted>"
+		}
+		fmt.Fprintf(w, "%v=%q # %v, %v\n", n, v, sources[n], envName(n))
+	}
+}
+
+// parsePins parses a comma separated list of GPIO pins
+func parsePins(s string) ([]uint8, error) {
+	pins := []uint8{}
+	for _, v := range strings.Split(s, ",") {
+		p, err := strconv.ParseUint(strings.TrimSpace(v), 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pin %q", v)
+		}
+		pins = append(pins, uint8(p))
+	}
+	if len(pins) == 0 {
+		return nil, fmt.Errorf("at least one relay pin is required")
+	}
+	return pins, nil
+}
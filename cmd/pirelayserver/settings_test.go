@@ -0,0 +1,146 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// setEnv sets environment variables for the rest of the test
+func setEnv(t *testing.T, env map[string]string) {
+	for k, v := range env {
+		old, ok := os.LookupEnv(k)
+		os.Setenv(k, v)
+		k := k
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(k, old)
+			} else {
+				os.Unsetenv(k)
+			}
+		})
+	}
+}
+
+func TestLoadSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "settings.yaml")
+	err = ioutil.WriteFile(file, []byte("http:\n  addr: \":3002\"\nauth0:\n  domain: file.example.com\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown := filepath.Join(dir, "unknown.json")
+	err = ioutil.WriteFile(unknown, []byte(`{"http": {"port": 3000}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		// want is the value of each setting checked
+		want        map[string]string
+		wantSources map[string]string
+		wantErr     bool
+	}{
+		{
+			name:        "defaults",
+			want:        map[string]string{"http.addr": ":3000", "auth0.domain": ""},
+			wantSources: map[string]string{"http.addr": sourceDefault, "auth0.domain": sourceDefault},
+		},
+		{
+			name:        "settings file",
+			args:        []string{"--settings.file", file},
+			want:        map[string]string{"http.addr": ":3002", "auth0.domain": "file.example.com"},
+			wantSources: map[string]string{"http.addr": sourceFile, "auth0.domain": sourceFile},
+		},
+		{
+			name:        "settings file named in the environment",
+			env:         map[string]string{"POOLCTL_SETTINGS_FILE": file},
+			want:        map[string]string{"http.addr": ":3002"},
+			wantSources: map[string]string{"http.addr": sourceFile, "settings.file": sourceEnv},
+		},
+		{
+			name:        "env over settings file",
+			args:        []string{"--settings.file", file},
+			env:         map[string]string{"POOLCTL_HTTP_ADDR": ":3001", "AUTH0_DOMAIN": "legacy.example.com"},
+			want:        map[string]string{"http.addr": ":3001", "auth0.domain": "legacy.example.com"},
+			wantSources: map[string]string{"http.addr": sourceEnv, "auth0.domain": sourceEnv},
+		},
+		{
+			name:        "env over legacy env",
+			env:         map[string]string{"POOLCTL_AUTH0_DOMAIN": "new.example.com", "AUTH0_DOMAIN": "legacy.example.com"},
+			want:        map[string]string{"auth0.domain": "new.example.com"},
+			wantSources: map[string]string{"auth0.domain": sourceEnv},
+		},
+		{
+			name:        "flag over everything",
+			args:        []string{"--settings.file", file, "--http.addr", ":3004"},
+			env:         map[string]string{"POOLCTL_HTTP_ADDR": ":3001"},
+			want:        map[string]string{"http.addr": ":3004"},
+			wantSources: map[string]string{"http.addr": sourceFlag},
+		},
+		{
+			name:        "mode flags aren't read from the environment",
+			env:         map[string]string{"POOLCTL_PRINT_CONFIG": "true"},
+			want:        map[string]string{"print-config": "false"},
+			wantSources: map[string]string{"print-config": sourceDefault},
+		},
+		{
+			name:    "missing settings file",
+			args:    []string{"--settings.file", filepath.Join(dir, "nope.yaml")},
+			wantErr: true,
+		},
+		{
+			name:    "unknown setting",
+			args:    []string{"--settings.file", unknown},
+			wantErr: true,
+		},
+		{
+			name:    "invalid value",
+			env:     map[string]string{"POOLCTL_HTTP_TLS": "maybe"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnv(t, tt.env)
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.String("settings.file", "", "")
+			fs.Bool("print-config", false, "")
+			fs.String("http.addr", ":3000", "")
+			fs.Bool("http.tls", false, "")
+			fs.String("auth0.domain", "", "")
+			err := fs.Parse(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sources, err := loadSettings(fs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got := make(map[string]string)
+			gotSources := make(map[string]string)
+			for k := range tt.want {
+				got[k] = fs.Lookup(k).Value.String()
+			}
+			for k := range tt.wantSources {
+				gotSources[k] = sources[k]
+			}
+			if !reflect.DeepEqual(got, tt.want) || !reflect.DeepEqual(gotSources, tt.wantSources) {
+				t.Errorf("got %v from %v, want %v from %v", got, gotSources, tt.want, tt.wantSources)
+			}
+		})
+	}
+}
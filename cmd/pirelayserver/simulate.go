@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"github.com/clocklear/pirelayserver/cmd/pirelayserver/internal"
+)
+
+// runSimulate implements the `simulate` subcommand, which dry-runs a config
+// file and prints the result as JSON
+func runSimulate(args []string) int {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	var (
+		configFile = fs.String("config.file", "config.json", "Configuration file to simulate")
+		from       = fs.String("from", "", "Start of the simulation, RFC3339 (defaults to now)")
+		to         = fs.String("to", "", "End of the simulation, RFC3339 (defaults to a week after the start)")
+		relays     = fs.Uint("relays", 3, "Number of relays to simulate")
+	)
+	fs.Parse(args)
+	if *relays < 1 || *relays > math.MaxUint8 {
+		fmt.Fprintf(os.Stderr, "--relays must be between 1 and %v\n", math.MaxUint8)
+		return 1
+	}
+
+	dat, err := internal.ReadConfigFile(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	cfg, err := internal.ParseConfig(dat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	err = cfg.Validate(uint8(*relays))
+	if ve, ok := err.(*internal.ValidationError); ok {
+		fmt.Fprintln(os.Stderr, "invalid config:")
+		for _, v := range ve.Errors {
+			fmt.Fprintf(os.Stderr, "  %v: %v\n", v.Path, v.Message)
+		}
+		return 1
+	}
+
+	req := internal.SimulationRequest{
+		Config: cfg,
+		From:   time.Now(),
+		Relays: uint8(*relays),
+	}
+	if *from != "" {
+		req.From, err = time.Parse(time.RFC3339, *from)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	req.To = req.From.Add(7 * 24 * time.Hour)
+	if *to != "" {
+		req.To, err = time.Parse(time.RFC3339, *to)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	res, err := internal.Simulate(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	b, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(string(b))
+	return 0
+}
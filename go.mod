@@ -3,9 +3,11 @@ module github.com/clocklear/pirelayserver
 go 1.16
 
 require (
+	github.com/BurntSushi/toml v1.2.1
 	github.com/auth0/go-jwt-middleware v0.0.0-20190805220309-36081240882b
 	github.com/coreos/go-oidc v2.2.1+incompatible
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/go-kit/kit v0.9.0
 	github.com/go-logfmt/logfmt v0.4.0 // indirect
 	github.com/go-stack/stack v1.8.0 // indirect
@@ -19,7 +21,9 @@ require (
 	github.com/smartystreets/goconvey v1.6.4 // indirect
 	github.com/stianeikeland/go-rpio/v4 v4.4.0
 	github.com/urfave/negroni v1.0.0 // indirect
+	go.etcd.io/bbolt v1.3.6
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
 	gopkg.in/square/go-jose.v2 v2.4.1 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 )